@@ -3,7 +3,11 @@ package main
 import (
 	backend "MessageMesh/backend"
 	"MessageMesh/backend/models"
+	"MessageMesh/debug"
 	"context"
+	"fmt"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 // App struct
@@ -20,55 +24,265 @@ func NewApp() *App {
 // startup is called when the app starts. The context is saved
 // so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
+	if err := a.start(ctx); err != nil {
+		runtime.Quit(ctx)
+	}
+}
+
+// Start the network, connect to peers and join the blockchain
+func (a *App) start(ctx context.Context) error {
 	a.ctx = ctx
 
-	// Start the network, connect to peers and join the blockchain
-	a.network.ConnectToNetwork()
+	if err := a.network.ConnectToNetwork(); err != nil {
+		debug.Log("err", fmt.Sprintf("Refusing to start: %s", err.Error()))
+		return err
+	}
 
 	// Start the UI Data loop
 	go backend.UIDataLoop(a.network, a.ctx)
+	return nil
 }
 
 // Functions for the UI to get data from the network
 
-// Get the list of peers in the network
+// Get the list of peers in the active room
 func (a *App) GetPeerList() []string {
 	peers := make([]string, 0)
-	for _, peer := range a.network.PubSubService.PeerList() {
+	for _, peer := range a.network.PubSubService.ActivePeerList() {
 		peers = append(peers, peer.String())
 	}
 	return peers
 }
 
+// Connect to a peer by multiaddr and remember it for later restarts
+func (a *App) AddPeer(multiaddr string) error {
+	return a.network.P2pService.AddPeer(multiaddr)
+}
+
+// Block a peer ID or CIDR range, disconnecting it immediately
+func (a *App) BlockPeer(entry string) error {
+	return a.network.BlockPeer(entry)
+}
+
+// Unblock a peer ID or CIDR range
+func (a *App) UnblockPeer(entry string) error {
+	return a.network.UnblockPeer(entry)
+}
+
+// Add a peer ID or CIDR range to the allowlist, only allowlisted peers can connect once it has entries
+func (a *App) AllowPeer(entry string) error {
+	return a.network.AllowPeer(entry)
+}
+
+// Remove a peer ID or CIDR range from the allowlist
+func (a *App) DisallowPeer(entry string) error {
+	return a.network.DisallowPeer(entry)
+}
+
+// Get the allowlist and blocklist
+func (a *App) GetAccessList() backend.AccessList {
+	return a.network.P2pService.Gater.AccessList()
+}
+
+// Get the cluster this node belongs to
+func (a *App) GetClusterInfo() backend.ClusterInfo {
+	return a.network.ClusterInfo()
+}
+
+// Get the peers found in other clusters on the same topic
+func (a *App) GetClusterConflicts() []backend.ClusterConflict {
+	return a.network.ClusterConflicts()
+}
+
+// Leave our cluster for the cluster of a peer, replaying our messages into its chain
+func (a *App) RejoinCluster(peerID string) (backend.MergeReport, error) {
+	return a.network.RejoinCluster(peerID)
+}
+
+// Get the status of this node
+func (a *App) GetNodeStatus() backend.NodeStatus {
+	return a.network.NodeStatus()
+}
+
+// Get up to limit blocks of the chain of a peer, starting at index from
+func (a *App) GetHistory(peerID string, from int, limit int) (backend.History, error) {
+	return a.network.RequestHistory(peerID, from, limit)
+}
+
+// Verify every block of the local chain
+func (a *App) VerifyChain() backend.ChainReport {
+	return a.network.VerifyChain()
+}
+
+// Replace the local chain with the chain of the cluster, replicated through a member whose chain is valid
+func (a *App) ResyncChain() error {
+	return a.network.ResyncChain()
+}
+
+// Get the latest checkpoint signed by a leader, nil if there is none yet
+func (a *App) GetLatestCheckpoint() (*models.CheckpointData, error) {
+	return a.network.LatestCheckpoint()
+}
+
+// Prove that a message is in the chain, through the first checkpoint covering it
+func (a *App) ProveMessage(messageID string) (*models.InclusionProof, error) {
+	return a.network.ProveMessage(messageID)
+}
+
+// Ask a peer for the inclusion proof of a message and verify it
+func (a *App) RequestProof(peerID string, messageID string) (*models.InclusionProof, error) {
+	return a.network.RequestProof(peerID, messageID)
+}
+
+// Verify an inclusion proof, the signature of its checkpoint and that a leader of our cluster signed it
+func (a *App) VerifyProof(proof models.InclusionProof) error {
+	return a.network.VerifyInclusionProof(&proof)
+}
+
+// Export the blocks from one index to another to an archive file
+func (a *App) ExportSegment(from int, to int) (string, error) {
+	return a.network.ExportSegment(from, to)
+}
+
+// Verify an archive file and whether it matches the local chain
+func (a *App) VerifyArchive(path string) (backend.ArchiveReport, error) {
+	return a.network.VerifyArchive(path)
+}
+
+// Get the paths of the archive files
+func (a *App) ListArchives() ([]string, error) {
+	return a.network.ListArchives()
+}
+
+// Transfer leadership to a voter, or to the voter the leadership policy prefers if empty
+func (a *App) TransferLeadership(peerID string) error {
+	return a.network.TransferLeadership(peerID)
+}
+
 // Get the user's peer ID
 func (a *App) GetUserPeerID() string {
 	return a.network.PubSubService.SelfID().String()
 }
 
-// Send a message to a peer (Not in use by the UI)
-func (a *App) SendMessage(message string, receiver string) {
-	a.network.SendMessage(message, receiver)
+// Send a message to a peer in a room, the active room if room is empty (Not in use by the UI)
+func (a *App) SendMessage(message string, receiver string, room string) {
+	a.network.SendMessage(message, receiver, room)
 }
 
-// Send an encrypted message to a peer
-func (a *App) SendEncryptedMessage(message string, receiver string) {
-	a.network.SendEncryptedMessage(message, receiver)
+// Send an encrypted message to a peer in a room, the active room if room is empty
+func (a *App) SendEncryptedMessage(message string, receiver string, room string) {
+	a.network.SendEncryptedMessage(message, receiver, room)
+}
+
+// Reply to a message (Not in use by the UI)
+func (a *App) SendReply(message string, receiver string, replyTo string, room string) {
+	a.network.SendReply(message, receiver, replyTo, room)
+}
+
+// Send an encrypted reply to a message
+func (a *App) SendEncryptedReply(message string, receiver string, replyTo string, room string) {
+	a.network.SendEncryptedReply(message, receiver, replyTo, room)
+}
+
+// React to a message with an emoji
+func (a *App) React(messageID string, emoji string, room string) {
+	a.network.SendReaction(messageID, emoji, false, room)
+}
+
+// Remove our emoji reaction from a message
+func (a *App) RemoveReaction(messageID string, emoji string, room string) {
+	a.network.SendReaction(messageID, emoji, true, room)
+}
+
+// Set how long the messages with a peer are kept, 0 disables a limit
+func (a *App) SetRetention(peer string, expireAfterHours int, keepLast int, room string) {
+	a.network.SendRetention(peer, expireAfterHours, keepLast, room)
+}
+
+// Get the retention setting for the conversation with a peer
+func (a *App) GetRetention(peer string) (*models.Retention, error) {
+	var retention *models.Retention
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		if setting := blockchain.GetRetention([]string{a.network.PubSubService.SelfID().String(), peer}); setting != nil {
+			copied := *setting
+			retention = &copied
+		}
+	})
+	return retention, err
+}
+
+// Let a peer know we are typing
+func (a *App) SendTyping(receiver string) error {
+	return a.network.SendSignal("typing", receiver, "")
+}
+
+// Let a peer know we have read the message in a block
+func (a *App) SendReadReceipt(receiver string, blockHash string) error {
+	return a.network.SendSignal("read", receiver, blockHash)
 }
 
 // Get the blockchain (Not in use by the UI)
-func (a *App) GetBlockchain() []*models.Block {
-	return a.network.ConsensusService.Blockchain.Chain
+func (a *App) GetBlockchain() ([]*models.Block, error) {
+	chain := make([]*models.Block, 0)
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		for _, block := range blockchain.Chain {
+			chain = append(chain, block.Copy())
+		}
+	})
+	return chain, err
 }
 
-// Get the messages from the blockchain (Not in use by the UI)
-func (a *App) GetMessages() []*models.Message {
-	messages := make([]*models.Message, 0)
-	for _, block := range a.network.ConsensusService.Blockchain.Chain {
-		if block.BlockType == "message" {
-			messages = append(messages, &block.Data.(*models.MessageData).Message)
+// Get the messages from the blockchain with edits and deletes applied (Not in use by the UI)
+func (a *App) GetMessages() ([]*models.Message, error) {
+	var messages []*models.Message
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		messages = blockchain.EffectiveMessages()
+	})
+	return messages, err
+}
+
+// Get the original message block and all of its edits and deletes
+func (a *App) GetMessageHistory(blockHash string) ([]*models.Block, error) {
+	history := make([]*models.Block, 0)
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		for _, block := range blockchain.MessageHistory(blockHash) {
+			history = append(history, block.Copy())
 		}
-	}
-	return messages
+	})
+	return history, err
+}
+
+// Edit one of our messages (Not in use by the UI)
+func (a *App) EditMessage(blockHash string, message string, room string) error {
+	return a.network.SendMessageEdit(blockHash, message, room)
+}
+
+// Edit one of our encrypted messages
+func (a *App) EditEncryptedMessage(blockHash string, message string, room string) error {
+	return a.network.SendEncryptedMessageEdit(blockHash, message, room)
+}
+
+// Delete one of our messages
+func (a *App) DeleteMessage(blockHash string, room string) error {
+	return a.network.SendMessageEdit(blockHash, "", room)
+}
+
+// Get a message and all replies below it
+func (a *App) GetThread(messageID string) ([]*models.Message, error) {
+	var thread []*models.Message
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		thread = blockchain.Thread(messageID)
+	})
+	return thread, err
+}
+
+// Get the number of reactions on a message per emoji
+func (a *App) GetReactions(messageID string) (map[string]int, error) {
+	var reactions map[string]int
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		reactions = blockchain.Reactions(messageID)
+	})
+	return reactions, err
 }
 
 // Get a decrypted message from the blockchain
@@ -76,30 +290,64 @@ func (a *App) GetDecryptedMessage(message string, peerIDs []string) (string, err
 	return a.network.DecryptMessage(message, peerIDs)
 }
 
-// Get the messages from a specific peer
-func (a *App) GetMessagesFromPeer(peer string) []*models.Message {
+// Get the messages from a specific peer with edits and deletes applied
+func (a *App) GetMessagesFromPeer(peer string) ([]*models.Message, error) {
 	messages := make([]*models.Message, 0)
-	for _, block := range a.network.ConsensusService.Blockchain.Chain {
-		if block.BlockType == "message" {
-			if block.Data.(*models.MessageData).Message.Sender == peer || block.Data.(*models.MessageData).Message.Receiver == peer {
-				messages = append(messages, &block.Data.(*models.MessageData).Message)
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		for _, message := range blockchain.EffectiveMessages() {
+			if message.Sender == peer || message.Receiver == peer {
+				messages = append(messages, message)
 			}
 		}
-	}
-	return messages
+	})
+	return messages, err
 }
 
 // Get the accounts from the blockchain (Not in use by the UI)
-func (a *App) GetAccounts() []*models.Account {
+func (a *App) GetAccounts() ([]*models.Account, error) {
 	accounts := make([]*models.Account, 0)
-	for _, block := range a.network.ConsensusService.Blockchain.Chain {
-		if block.BlockType == "account" {
-			accounts = append(accounts, &block.Data.(*models.AccountData).Account)
+	err := a.network.Query(func(blockchain *models.Blockchain) {
+		for _, block := range blockchain.Entries() {
+			if block.BlockType == "account" {
+				account := block.Data.(*models.AccountData).Account
+				accounts = append(accounts, &account)
+			}
 		}
-	}
-	return accounts
+	})
+	return accounts, err
+}
+
+// Get the contacts saved on this node
+func (a *App) GetContacts() ([]backend.Contact, error) {
+	return backend.ReadContacts()
+}
+
+// Save a peer as a contact under a name
+func (a *App) SaveContact(peerID string, name string) (backend.Contact, error) {
+	return backend.SaveContact(peerID, name)
+}
+
+// Remove a contact
+func (a *App) DeleteContact(peerID string) error {
+	return backend.DeleteContact(peerID)
+}
+
+// Switch the active room, joining its topic if needed
+func (a *App) SetTopic(topic string) error {
+	return a.network.PubSubService.SetActiveTopic(topic)
+}
+
+// Leave a room topic
+func (a *App) LeaveTopic(topic string) error {
+	return a.network.PubSubService.LeaveTopic(topic)
+}
+
+// Get the joined topics
+func (a *App) GetTopics() []string {
+	return a.network.PubSubService.Topics()
 }
 
-func (a *App) SetTopic(topic string) {
-	//a.network.PubSubService.Topic = topic
+// Get the active room topic
+func (a *App) GetActiveTopic() string {
+	return a.network.PubSubService.ActiveTopic()
 }
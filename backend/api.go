@@ -0,0 +1,516 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// File the API token is kept in when API_TOKEN is not set
+	apiTokenPath = directory + "/api_token"
+	// Largest request body the API reads
+	maxAPIRequestSize = 1 << 20
+	// How long a client gets to send the request headers
+	apiHeaderTimeout = 10 * time.Second
+	// How often an idle event stream sends a comment, so proxies and clients keep it open
+	eventStreamKeepAlive = 30 * time.Second
+)
+
+// Serves the HTTP API of a node on localhost
+type apiServer struct {
+	network *Network
+	token   string
+}
+
+// Node status as reported by the API
+type apiStatus struct {
+	Node            NodeStatus        `json:"node"`
+	Cluster         ClusterInfo       `json:"cluster"`
+	Raft            map[string]string `json:"raft"` // Raft statistics, such as the term and the last log index
+	ReadConsistency string            `json:"readConsistency"`
+	ActiveTopic     string            `json:"activeTopic"`
+	Topics          []string          `json:"topics"`
+	Peers           int               `json:"peers"` // Peers in the active room
+}
+
+type apiPeers struct {
+	ActiveTopic string   `json:"activeTopic"`
+	Active      []string `json:"active"` // Peers in the active room
+	Mesh        []string `json:"mesh"`   // Peers on the mesh topic
+}
+
+type apiSendRequest struct {
+	Receiver  string `json:"receiver"`
+	Message   string `json:"message"`
+	ReplyTo   string `json:"replyTo,omitempty"`
+	Encrypted bool   `json:"encrypted"`
+	Room      string `json:"room,omitempty"` // Room to send in, the active room if empty
+}
+
+type apiSendResponse struct {
+	ID string `json:"id"` // ID of the queued message, follow it with the sendStatus events
+}
+
+// A peer we exchanged messages with
+type apiConversation struct {
+	PeerID        string `json:"peerID"`
+	Name          string `json:"name,omitempty"` // Name of the peer in our contacts
+	Messages      int    `json:"messages"`
+	LastTimestamp string `json:"lastTimestamp"`
+}
+
+type apiContactRequest struct {
+	Name string `json:"name"`
+}
+
+// Range of blocks to export, the whole chain if To is unset
+type apiExportRequest struct {
+	From int  `json:"from"`
+	To   *int `json:"to,omitempty"`
+}
+
+type apiArchiveRequest struct {
+	Path string `json:"path"`
+}
+
+type apiPathResponse struct {
+	Path string `json:"path"`
+}
+
+// Get the address of the API from API_ADDR, empty if the API is off.
+// The API is only served on a loopback address.
+func apiAddr() string {
+	if debug.APIAddr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(debug.APIAddr)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Invalid API_ADDR %s, the API is off", debug.APIAddr))
+		return ""
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		debug.Log("err", fmt.Sprintf("Invalid API_ADDR %s, using 127.0.0.1:%s", debug.APIAddr, port))
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return debug.APIAddr
+}
+
+// Get the token clients present to the API, from API_TOKEN or the token file.
+// A token is generated into the token file the first time.
+func apiToken() (string, error) {
+	if debug.APIToken != "" {
+		return debug.APIToken, nil
+	}
+	if token, err := os.ReadFile(apiTokenPath); err == nil && len(strings.TrimSpace(string(token))) > 0 {
+		return strings.TrimSpace(string(token)), nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(apiTokenPath, []byte(token), 0600); err != nil {
+		return "", err
+	}
+	debug.Log("api", "Generated an API token in "+apiTokenPath)
+	return token, nil
+}
+
+// Serve the HTTP API if API_ADDR is set
+func (network *Network) startAPI() {
+	addr := apiAddr()
+	if addr == "" {
+		return
+	}
+	token, err := apiToken()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to read the API token, the API is off: %s", err))
+		return
+	}
+	api := &apiServer{network: network, token: token}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           api.routes(),
+		ReadHeaderTimeout: apiHeaderTimeout,
+	}
+	debug.Log("api", "Serving the API on http://"+addr)
+	if err := server.ListenAndServe(); err != nil {
+		debug.Log("err", fmt.Sprintf("API stopped: %s", err))
+	}
+}
+
+// Get the handler of the HTTP API, requests must present the API token
+func (api *apiServer) routes() http.Handler {
+	return api.authorize(api.handler())
+}
+
+// Get the handler of the API endpoints, without checking the token
+func (api *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", api.handleStatus)
+	mux.HandleFunc("GET /api/peers", api.handlePeers)
+	mux.HandleFunc("POST /api/messages", api.handleSend)
+	mux.HandleFunc("GET /api/conversations", api.handleConversations)
+	mux.HandleFunc("GET /api/conversations/{peerID}", api.handleConversation)
+	mux.HandleFunc("GET /api/blocks", api.handleBlocks)
+	mux.HandleFunc("GET /api/blocks/{hash}", api.handleBlock)
+	mux.HandleFunc("GET /api/contacts", api.handleContacts)
+	mux.HandleFunc("PUT /api/contacts/{peerID}", api.handleSaveContact)
+	mux.HandleFunc("DELETE /api/contacts/{peerID}", api.handleDeleteContact)
+	mux.HandleFunc("GET /api/events", api.handleEvents)
+	mux.HandleFunc("GET /api/chain/verify", api.handleVerifyChain)
+	mux.HandleFunc("POST /api/chain/export", api.handleExportChain)
+	mux.HandleFunc("POST /api/archives/verify", api.handleVerifyArchive)
+	return mux
+}
+
+// Refuse requests without the API token, sent as a bearer token. Browsers cannot set
+// headers on an EventSource, so the token may also be sent as the token query parameter.
+func (api *apiServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			token = r.URL.Query().Get("token")
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid API token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to write API response: %s", err))
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Decode the JSON body of a request
+func readAPIRequest(w http.ResponseWriter, r *http.Request, value any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize)).Decode(value); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+func (api *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	network := api.network
+	status := apiStatus{
+		Node:            network.NodeStatus(),
+		Cluster:         network.ClusterInfo(),
+		Raft:            network.ConsensusService.Raft.Stats(),
+		ReadConsistency: network.ConsensusService.ReadConsistency,
+		ActiveTopic:     network.PubSubService.ActiveTopic(),
+		Topics:          network.PubSubService.Topics(),
+		Peers:           len(network.PubSubService.ActivePeerList()),
+	}
+	writeAPIJSON(w, http.StatusOK, status)
+}
+
+func (api *apiServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	pubSubService := api.network.PubSubService
+	peers := apiPeers{ActiveTopic: pubSubService.ActiveTopic(), Active: make([]string, 0), Mesh: make([]string, 0)}
+	for _, peerID := range pubSubService.ActivePeerList() {
+		peers.Active = append(peers.Active, peerID.String())
+	}
+	for _, peerID := range pubSubService.PeerList() {
+		peers.Mesh = append(peers.Mesh, peerID.String())
+	}
+	writeAPIJSON(w, http.StatusOK, peers)
+}
+
+// Send a plain or encrypted message
+func (api *apiServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	request := apiSendRequest{}
+	if !readAPIRequest(w, r, &request) {
+		return
+	}
+	if request.Receiver == "" || request.Message == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("receiver and message are required"))
+		return
+	}
+	send := api.network.QueueReply
+	if request.Encrypted {
+		send = api.network.QueueEncryptedReply
+	}
+	id, err := send(request.Message, request.Receiver, request.ReplyTo, request.Room)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusAccepted, apiSendResponse{ID: id})
+}
+
+// List the peers we exchanged messages with, most recent first
+func (api *apiServer) handleConversations(w http.ResponseWriter, r *http.Request) {
+	self := api.network.P2pService.Host.ID().String()
+	conversations := make(map[string]*apiConversation)
+	err := api.network.Query(func(blockchain *models.Blockchain) {
+		for _, message := range blockchain.EffectiveMessages() {
+			other := message.Receiver
+			if other == self {
+				other = message.Sender
+			} else if message.Sender != self {
+				continue
+			}
+			conversation, found := conversations[other]
+			if !found {
+				conversation = &apiConversation{PeerID: other}
+				conversations[other] = conversation
+			}
+			conversation.Messages++
+			conversation.LastTimestamp = message.Timestamp
+		}
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	names := make(map[string]string)
+	if contacts, err := ReadContacts(); err == nil {
+		for _, contact := range contacts {
+			names[contact.PeerID] = contact.Name
+		}
+	}
+	list := make([]*apiConversation, 0, len(conversations))
+	for _, conversation := range conversations {
+		conversation.Name = names[conversation.PeerID]
+		list = append(list, conversation)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastTimestamp > list[j].LastTimestamp })
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// Get the messages exchanged with a peer with edits and deletes applied, decrypted if ?decrypt=true
+func (api *apiServer) handleConversation(w http.ResponseWriter, r *http.Request) {
+	self := api.network.P2pService.Host.ID().String()
+	other := r.PathValue("peerID")
+	messages := make([]models.Message, 0)
+	err := api.network.Query(func(blockchain *models.Blockchain) {
+		for _, message := range blockchain.EffectiveMessages() {
+			if (message.Sender == self && message.Receiver == other) || (message.Sender == other && message.Receiver == self) {
+				messages = append(messages, *message)
+			}
+		}
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	// Messages that cannot be decrypted, such as plain ones, are returned as they are
+	if r.URL.Query().Get("decrypt") == "true" {
+		for i := range messages {
+			if messages[i].Message == "" {
+				continue
+			}
+			if plaintext, err := api.network.DecryptMessage(messages[i].Message, []string{self, other}); err == nil {
+				messages[i].Message = plaintext
+			}
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, messages)
+}
+
+// Get a range of blocks, ?from=0&limit=100
+func (api *apiServer) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	from, limit := 0, maxHistoryBlocks
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = strconv.Atoi(value); err != nil || from < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid from %s", value))
+			return
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %s", value))
+			return
+		}
+	}
+	if limit > maxHistoryBlocks {
+		limit = maxHistoryBlocks
+	}
+
+	history := History{Blocks: make([]*models.Block, 0)}
+	err = api.network.Query(func(blockchain *models.Blockchain) {
+		history.ClusterID = blockchain.ClusterID()
+		history.Length = len(blockchain.Chain)
+		for index := from; index < len(blockchain.Chain) && index < from+limit; index++ {
+			history.Blocks = append(history.Blocks, blockchain.Chain[index].Copy())
+		}
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, history)
+}
+
+// Get a block, or an entry of a batch, by its hash
+func (api *apiServer) handleBlock(w http.ResponseWriter, r *http.Request) {
+	var block *models.Block
+	err := api.network.Query(func(blockchain *models.Blockchain) {
+		if found := blockchain.GetBlockByHash(r.PathValue("hash")); found != nil {
+			block = found.Copy()
+		}
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if block == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("block %s not found", r.PathValue("hash")))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, block)
+}
+
+func (api *apiServer) handleContacts(w http.ResponseWriter, r *http.Request) {
+	contacts, err := ReadContacts()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, contacts)
+}
+
+func (api *apiServer) handleSaveContact(w http.ResponseWriter, r *http.Request) {
+	request := apiContactRequest{}
+	if !readAPIRequest(w, r, &request) {
+		return
+	}
+	contact, err := SaveContact(r.PathValue("peerID"), request.Name)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, contact)
+}
+
+func (api *apiServer) handleDeleteContact(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteContact(r.PathValue("peerID")); err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stream the events of the bus as Server-Sent Events, ?topics=blockCommitted,messageDecrypted
+// limits them to some event types
+func (api *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	topics := make([]string, 0)
+	if value := r.URL.Query().Get("topics"); value != "" {
+		for _, topic := range strings.Split(value, ",") {
+			if !slices.Contains(eventTypes, topic) {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("unknown topic %s, topics are %s", topic, strings.Join(eventTypes, ", ")))
+				return
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	events := api.network.Events.Subscribe("api "+r.RemoteAddr, defaultEventBuffer, topics...)
+	defer events.Close()
+	debug.Log("api", fmt.Sprintf("Streaming events to %s", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			debug.Log("api", fmt.Sprintf("Event stream to %s closed", r.RemoteAddr))
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-events.Events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				debug.Log("err", fmt.Sprintf("Failed to marshal %s event: %s", event.Type, err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (api *apiServer) handleVerifyChain(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, api.network.VerifyChain())
+}
+
+// Export a range of blocks to an archive file on the node
+func (api *apiServer) handleExportChain(w http.ResponseWriter, r *http.Request) {
+	request := apiExportRequest{}
+	if !readAPIRequest(w, r, &request) {
+		return
+	}
+	to := 0
+	if request.To != nil {
+		to = *request.To
+	} else {
+		api.network.ConsensusService.View(func(blockchain *models.Blockchain) {
+			to = len(blockchain.Chain) - 1
+		})
+	}
+	path, err := api.network.ExportSegment(request.From, to)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiPathResponse{Path: path})
+}
+
+// Verify an archive file on the node against the local chain
+func (api *apiServer) handleVerifyArchive(w http.ResponseWriter, r *http.Request) {
+	request := apiArchiveRequest{}
+	if !readAPIRequest(w, r, &request) {
+		return
+	}
+	report, err := api.network.VerifyArchive(request.Path)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, report)
+}
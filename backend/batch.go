@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	libp2praft "github.com/libp2p/go-libp2p-raft"
+)
+
+const (
+	// Most ops committed in one block
+	defaultBatchSize = 100
+	// How long the leader collects ops before committing them
+	defaultBatchWindow = 50 * time.Millisecond
+)
+
+// Collects the ops the leader commits, so that many of them share one Raft commit and one block
+type opBatcher struct {
+	mu      sync.Mutex
+	pending []*raftOP
+	// Ops taken from the queue that are being committed
+	committing []*raftOP
+	size       int
+	window     time.Duration
+	// Signalled when the first op of a batch is queued and when the batch is full
+	ready chan struct{}
+}
+
+// Get the most ops per block from BATCH_SIZE
+func batchSize() int {
+	if debug.BatchSize == "" {
+		return defaultBatchSize
+	}
+	size, err := strconv.Atoi(debug.BatchSize)
+	if err != nil || size < 1 {
+		debug.Log("err", fmt.Sprintf("Invalid BATCH_SIZE %s, using %d", debug.BatchSize, defaultBatchSize))
+		return defaultBatchSize
+	}
+	return size
+}
+
+// Get how long ops are collected from BATCH_WINDOW
+func batchWindow() time.Duration {
+	if debug.BatchWindow == "" {
+		return defaultBatchWindow
+	}
+	window, err := time.ParseDuration(debug.BatchWindow)
+	if err != nil || window < 0 {
+		debug.Log("err", fmt.Sprintf("Invalid BATCH_WINDOW %s, using %s", debug.BatchWindow, defaultBatchWindow))
+		return defaultBatchWindow
+	}
+	return window
+}
+
+func newOpBatcher() *opBatcher {
+	return &opBatcher{
+		pending: make([]*raftOP, 0),
+		size:    batchSize(),
+		window:  batchWindow(),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Queue an op to be committed with the next batch, the result of its commit is sent on op.done
+func (batcher *opBatcher) Submit(op *raftOP) {
+	op.done = make(chan error, 1)
+	batcher.mu.Lock()
+	batcher.pending = append(batcher.pending, op)
+	queued := len(batcher.pending)
+	batcher.mu.Unlock()
+
+	if queued == 1 || queued >= batcher.size {
+		select {
+		case batcher.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Check whether an op that is not committed yet matches, so new ops can refer to it
+func (batcher *opBatcher) anyPending(match func(op *raftOP) bool) bool {
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+	for _, op := range append(batcher.committing, batcher.pending...) {
+		if match(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a message with an ID is waiting to be committed
+func (batcher *opBatcher) pendingMessage(id string) bool {
+	return batcher.anyPending(func(op *raftOP) bool {
+		return op.Type == "ADD_MESSAGE_BLOCK" && op.Message.ID == id
+	})
+}
+
+// Check whether the first message between two sorted peer IDs is waiting to be committed
+func (batcher *opBatcher) pendingFirstMessage(peerIDs []string) bool {
+	if len(peerIDs) != 2 {
+		return false
+	}
+	return batcher.anyPending(func(op *raftOP) bool {
+		return op.Type == "ADD_FIRST_MESSAGE_BLOCK" && op.FirstMessage.PeerIDs[0] == peerIDs[0] && op.FirstMessage.PeerIDs[1] == peerIDs[1]
+	})
+}
+
+// Check whether a reaction of a sender with an emoji on a message is waiting to be committed
+func (batcher *opBatcher) pendingReaction(reaction *models.Reaction) bool {
+	return batcher.anyPending(func(op *raftOP) bool {
+		return op.Type == "ADD_REACTION_BLOCK" && op.Reaction.MessageID == reaction.MessageID && op.Reaction.Sender == reaction.Sender && op.Reaction.Emoji == reaction.Emoji
+	})
+}
+
+// Check whether a retention setting for the conversation between two sorted peer IDs is waiting to be committed
+func (batcher *opBatcher) pendingRetention(peerIDs []string) bool {
+	return batcher.anyPending(func(op *raftOP) bool {
+		return op.Type == "ADD_RETENTION_BLOCK" && op.Retention.PeerIDs[0] == peerIDs[0] && op.Retention.PeerIDs[1] == peerIDs[1]
+	})
+}
+
+// Check whether an edit or delete with the same signature is waiting to be committed
+func (batcher *opBatcher) pendingEdit(edit *models.MessageEdit) bool {
+	return batcher.anyPending(func(op *raftOP) bool {
+		return (op.Type == "ADD_EDIT_BLOCK" || op.Type == "ADD_DELETE_BLOCK") && op.Edit.TargetHash == edit.TargetHash && string(op.Edit.Signature) == string(edit.Signature)
+	})
+}
+
+func (batcher *opBatcher) full() bool {
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+	return len(batcher.pending) >= batcher.size
+}
+
+// Take up to a batch of the queued ops, oldest first. They count as pending until the next take.
+func (batcher *opBatcher) take() []*raftOP {
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+	count := len(batcher.pending)
+	if count > batcher.size {
+		count = batcher.size
+	}
+	ops := batcher.pending[:count:count]
+	batcher.pending = batcher.pending[count:]
+	batcher.committing = ops
+	return ops
+}
+
+// Commit the queued ops once the window has passed or a batch is full
+func batchLoop(batcher *opBatcher, raftconsensus *libp2praft.Consensus, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-batcher.ready:
+		}
+
+		if !batcher.full() {
+			window := time.NewTimer(batcher.window)
+			select {
+			case <-stop:
+				window.Stop()
+				return
+			case <-window.C:
+			case <-batcher.ready:
+				window.Stop()
+			}
+		}
+
+		for ops := batcher.take(); len(ops) > 0; ops = batcher.take() {
+			commitBatch(ops, raftconsensus)
+		}
+	}
+}
+
+// Commit ops in one block, a single op is committed as a block of its own
+func commitBatch(ops []*raftOP, raftconsensus *libp2praft.Consensus) {
+	op := ops[0]
+	if len(ops) > 1 {
+		op = &raftOP{
+			Type:      "ADD_BATCH",
+			Ops:       ops,
+			Timestamp: time.Now().Unix(),
+		}
+		debug.Log("raft", fmt.Sprintf("Committing a batch of %d ops", len(ops)))
+	}
+	response, err := raftconsensus.CommitOp(op)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to commit %d ops: %s", len(ops), err))
+	}
+	result, _ := response.(applyResult)
+	for i, op := range ops {
+		if op.done == nil {
+			continue
+		}
+		switch {
+		case err != nil:
+			op.done <- err
+		case !result.Applied:
+			op.done <- errNotApplied
+		default:
+			// Nil unless the op was left out of the batch
+			op.done <- result.Rejected[i]
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	libp2pnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Stream protocol nodes exchange their cluster ID and genesis hash on
+	clusterProtocol = protocol.ID("/messagemesh/cluster/1.0.0")
+	// Stream protocol a rejoined node replays its unique messages on
+	mergeProtocol = protocol.ID("/messagemesh/merge/1.0.0")
+	// Largest merge request accepted
+	maxMergeSize = 16 * 1024 * 1024
+	// How long a rejoining node waits to join and replicate the winning chain
+	rejoinTimeout = 2 * time.Minute
+	// How long the leader waits for the items of a merge request to be committed
+	mergeCommitTimeout = 30 * time.Second
+)
+
+// The cluster a node belongs to
+type ClusterInfo struct {
+	ClusterID   string `json:"clusterID"`   // Empty until the cluster is founded
+	GenesisHash string `json:"genesisHash"` // Hash of the genesis block
+	Leader      string `json:"leader"`      // Peer ID of the leader, empty if unknown
+	Length      int    `json:"length"`      // Number of blocks
+}
+
+// A peer on the mesh topic that belongs to another cluster
+type ClusterConflict struct {
+	PeerID     string      `json:"peerID"`
+	Remote     ClusterInfo `json:"remote"`
+	DetectedAt int64       `json:"detectedAt"`
+}
+
+// The result of rejoining another cluster
+type MergeReport struct {
+	ClusterID     string        `json:"clusterID"`     // Cluster that was joined
+	FirstMessages int           `json:"firstMessages"` // Conversations the leader committed
+	Messages      int           `json:"messages"`      // Messages the leader committed
+	Reactions     int           `json:"reactions"`
+	Retentions    int           `json:"retentions"`
+	Edits         int           `json:"edits"`    // Edits and deletes of messages from before the split
+	Existing      int           `json:"existing"` // Items the winning chain already had
+	Rejected      int           `json:"rejected"` // Items the leader refused or could not commit
+	Skipped       int           `json:"skipped"`  // Messages that could not be re-encrypted for the winning chain
+	Results       []MergeResult `json:"results"`
+}
+
+// What the leader did with one item of a merge request
+type MergeResult struct {
+	Kind   string `json:"kind"`            // firstMessage, message, reaction, retention, edit or envelope
+	ID     string `json:"id"`              // Message ID, or the peers of a conversation
+	Status string `json:"status"`          // committed, exists or rejected
+	Error  string `json:"error,omitempty"` // Why the item was rejected
+}
+
+// The content a node replays into the chain of the leader. The leader only accepts items
+// authored by the requesting peer, or envelopes still signed by the peer that published them.
+type mergeRequest struct {
+	FirstMessages []models.FirstMessage `json:"firstMessages"`
+	Messages      []models.Message      `json:"messages"`
+	Reactions     []models.Reaction     `json:"reactions"`
+	Retentions    []models.Retention    `json:"retentions"`
+	Edits         []models.MessageEdit  `json:"edits"`
+	// Messages of other peers in the signed pubsub messages they were published in
+	Envelopes [][]byte `json:"envelopes"`
+}
+
+// Result of the items a leader could not commit before mergeCommitTimeout
+var errCommitTimeout = errors.New("not committed in time")
+
+// The answer of the leader to a merge request, one result per item in the order they were sent
+type mergeResponse struct {
+	Results []MergeResult `json:"results"`
+}
+
+// Get the cluster this node belongs to
+func (network *Network) ClusterInfo() ClusterInfo {
+	consensusService := network.ConsensusService
+	info := ClusterInfo{Leader: string(consensusService.Raft.Leader())}
+	consensusService.View(func(blockchain *models.Blockchain) {
+		info.ClusterID = blockchain.ClusterID()
+		info.GenesisHash = blockchain.GenesisHash()
+		info.Length = len(blockchain.Chain)
+	})
+	return info
+}
+
+// Get the peers found in other clusters
+func (network *Network) ClusterConflicts() []ClusterConflict {
+	consensusService := network.ConsensusService
+	consensusService.conflictsMu.Lock()
+	defer consensusService.conflictsMu.Unlock()
+
+	conflicts := make([]ClusterConflict, 0, len(consensusService.conflicts))
+	for _, conflict := range consensusService.conflicts {
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].PeerID < conflicts[j].PeerID })
+	return conflicts
+}
+
+// Answer a cluster info request
+func (network *Network) handleClusterInfo(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	if err := json.NewEncoder(stream).Encode(network.ClusterInfo()); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer cluster info request: %s", err))
+	}
+}
+
+// Ask a peer which cluster it belongs to
+func (network *Network) requestClusterInfo(peerID peer.ID) (ClusterInfo, error) {
+	info := ClusterInfo{}
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, joinTimeout)
+	defer cancel()
+
+	stream, err := network.P2pService.Host.NewStream(ctx, peerID, clusterProtocol)
+	if err != nil {
+		return info, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	err = json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&info)
+	return info, err
+}
+
+// Compare the cluster of a peer that joined the mesh topic with ours and record a split brain
+func (network *Network) checkCluster(peerID peer.ID) {
+	remote, err := network.requestClusterInfo(peerID)
+	if err != nil {
+		debug.Log("raft", fmt.Sprintf("Cluster info request to %s failed: %s", peerID, err))
+		return
+	}
+	local := network.ClusterInfo()
+
+	consensusService := network.ConsensusService
+	consensusService.conflictsMu.Lock()
+	defer consensusService.conflictsMu.Unlock()
+
+	// Nodes that have not joined a cluster yet cannot conflict
+	if local.ClusterID == "" || remote.ClusterID == "" || local.ClusterID == remote.ClusterID {
+		delete(consensusService.conflicts, peerID)
+		return
+	}
+	debug.Log("err", fmt.Sprintf("Split brain: peer %s is in cluster %s with %d blocks, we are in cluster %s with %d blocks", peerID, remote.ClusterID, remote.Length, local.ClusterID, local.Length))
+	consensusService.conflicts[peerID] = ClusterConflict{
+		PeerID:     peerID.String(),
+		Remote:     remote,
+		DetectedAt: time.Now().Unix(),
+	}
+}
+
+// Leave our cluster and join the cluster of a peer, then replay the content we authored
+// into the winning chain. The leader of the winning cluster drops messages it already has.
+// Run it on every node of the losing side, each of them replays its own content.
+func (network *Network) RejoinCluster(peerIDStr string) (MergeReport, error) {
+	report := MergeReport{}
+	target, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return report, fmt.Errorf("invalid peer ID %s: %s", peerIDStr, err.Error())
+	}
+	remote, err := network.requestClusterInfo(target)
+	if err != nil {
+		return report, fmt.Errorf("failed to get the cluster of %s: %s", peerIDStr, err.Error())
+	}
+	if remote.ClusterID == "" {
+		return report, fmt.Errorf("peer %s is not in a cluster", peerIDStr)
+	}
+	// Keep the content of our chain, decrypting our own conversations while we still hold their keys
+	var losing *models.Blockchain
+	var messages []*models.Message
+	clusterID := ""
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		losing = blockchain
+		messages = blockchain.EffectiveMessages()
+		clusterID = blockchain.ClusterID()
+	})
+	if remote.ClusterID == clusterID {
+		return report, fmt.Errorf("already in cluster %s", remote.ClusterID)
+	}
+	report.ClusterID = remote.ClusterID
+
+	self := network.PubSubService.SelfID().String()
+	plaintexts := make(map[string]string)
+	for _, message := range messages {
+		if message.Sender != self && message.Receiver != self {
+			continue
+		}
+		if plaintext, err := network.DecryptMessage(message.Message, []string{message.Sender, message.Receiver}); err == nil {
+			plaintexts[message.ID] = plaintext
+		}
+	}
+
+	debug.Log("raft", fmt.Sprintf("Leaving cluster %s to rejoin cluster %s through %s", clusterID, remote.ClusterID, target))
+	if err := network.restartRaft(target); err != nil {
+		return report, err
+	}
+	if err := network.waitForReplication(rejoinTimeout); err != nil {
+		return report, err
+	}
+
+	request, report := network.mergeContent(losing, plaintexts, report)
+	leader, err := peer.Decode(string(network.ConsensusService.Raft.Leader()))
+	if err != nil {
+		return report, fmt.Errorf("no leader to replay messages to")
+	}
+	results, err := network.requestMerge(leader, request)
+	if err != nil {
+		return report, err
+	}
+	report.count(results)
+
+	// The conflicts were with the cluster we joined
+	network.ConsensusService.conflictsMu.Lock()
+	network.ConsensusService.conflicts = make(map[peer.ID]ClusterConflict)
+	network.ConsensusService.conflictsMu.Unlock()
+
+	debug.Log("raft", fmt.Sprintf("Rejoined cluster %s and replayed %d messages, %d rejected, skipped %d", report.ClusterID, report.Messages, report.Rejected, report.Skipped))
+	return report, nil
+}
+
+// Stop the Raft instance and its loops, and start a fresh one joining through the target peer
+func (network *Network) restartRaft(target peer.ID) error {
+	consensusService := network.ConsensusService
+	close(consensusService.stop)
+	if err := consensusService.Raft.Shutdown().Error(); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to shut down Raft: %s", err))
+	}
+	// Snapshots of the old cluster must not be restored
+	if err := os.RemoveAll(snapshotsPath); err != nil {
+		return err
+	}
+	return network.startRaft(target)
+}
+
+// Wait until this node has joined a cluster and applied everything the leader committed
+func (network *Network) waitForReplication(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if network.caughtUp() {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting to join the cluster")
+}
+
+// Check whether this node has joined a founded cluster and applied everything the leader committed
+func (network *Network) caughtUp() bool {
+	if !network.joined() || network.ClusterInfo().ClusterID == "" {
+		return false
+	}
+	stats := network.ConsensusService.Raft.Stats()
+	commitIndex, _ := strconv.ParseUint(stats["commit_index"], 10, 64)
+	appliedIndex, _ := strconv.ParseUint(stats["applied_index"], 10, 64)
+	return commitIndex > 0 && appliedIndex >= commitIndex
+}
+
+// Collect the content of the losing chain to replay. Conversations that already exist in the
+// winning chain use its key, so our own messages are re-encrypted with it and the messages of
+// other conversations, which we cannot decrypt, are skipped.
+func (network *Network) mergeContent(losing *models.Blockchain, plaintexts map[string]string, report MergeReport) (mergeRequest, MergeReport) {
+	request := mergeRequest{}
+	self := network.PubSubService.SelfID().String()
+
+	keyPair, err := ReadKeyPair()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Error reading key pair: %s", err.Error()))
+	}
+
+	// Key of the winning chain for each conversation that exists on both sides with a different key
+	conflicting := make(map[string][]byte)
+	for _, block := range losing.Entries() {
+		if block.BlockType != "firstMessage" {
+			continue
+		}
+		firstMessage := block.Data.(*models.FirstMessageData).FirstMessage
+		pair := firstMessage.PeerIDs[0] + firstMessage.PeerIDs[1]
+		var existing *models.FirstMessage
+		network.ConsensusService.View(func(winning *models.Blockchain) {
+			existing = winning.CheckPeerFirstMessage(firstMessage.PeerIDs)
+		})
+		if existing == nil {
+			if firstMessage.PeerIDs[0] == self || firstMessage.PeerIDs[1] == self {
+				request.FirstMessages = append(request.FirstMessages, firstMessage)
+			}
+			continue
+		}
+		if string(existing.SymetricKey0) == string(firstMessage.SymetricKey0) {
+			continue
+		}
+		conflicting[pair] = nil
+		if firstMessage.PeerIDs[0] != self && firstMessage.PeerIDs[1] != self {
+			continue
+		}
+		if keyPair.PrivKey == nil {
+			continue
+		}
+		symmetricKey, err := keyPair.DecryptWithPrivateKey(existing.GetSymetricKey(self))
+		if err != nil {
+			debug.Log("err", fmt.Sprintf("Error decrypting symmetric key for %s and %s: %s", firstMessage.PeerIDs[0], firstMessage.PeerIDs[1], err.Error()))
+			continue
+		}
+		conflicting[pair] = symmetricKey
+		// The cached key of the losing chain is no longer valid
+		if err := SaveSymmetricKey(symmetricKey, firstMessage.PeerIDs); err != nil {
+			debug.Log("err", fmt.Sprintf("Error saving symmetric key: %s", err.Error()))
+		}
+	}
+
+	// The leader only accepts what we authored, the other nodes of our side replay their own
+	for _, message := range losing.EffectiveMessages() {
+		if message.Sender != self {
+			continue
+		}
+		peerIDs := []string{message.Sender, message.Receiver}
+		sort.Strings(peerIDs)
+		symmetricKey, isConflicting := conflicting[peerIDs[0]+peerIDs[1]]
+		if isConflicting {
+			plaintext, decrypted := plaintexts[message.ID]
+			if symmetricKey == nil || !decrypted {
+				report.Skipped++
+				continue
+			}
+			encrypted, err := EncryptWithSymmetricKey([]byte(plaintext), symmetricKey)
+			if err != nil {
+				report.Skipped++
+				continue
+			}
+			message.Message = base64.StdEncoding.EncodeToString(encrypted)
+		}
+		request.Messages = append(request.Messages, *message)
+	}
+
+	for _, block := range losing.Entries() {
+		switch block.BlockType {
+		case "reaction":
+			if reaction := block.Data.(*models.ReactionData).Reaction; reaction.Sender == self {
+				request.Reactions = append(request.Reactions, reaction)
+			}
+		case "retention":
+			if retention := block.Data.(*models.RetentionData).Retention; retention.Setter == self {
+				request.Retentions = append(request.Retentions, retention)
+			}
+		case "edit", "delete":
+			// Replayed messages already carry their edits, only edits of messages from before the split
+			// can be replayed, as the signature of an edit covers the block it targets
+			edit := block.Data.(*models.EditData).MessageEdit
+			if edit.Sender != self {
+				continue
+			}
+			onWinning := false
+			network.ConsensusService.View(func(winning *models.Blockchain) {
+				onWinning = winning.GetBlockByHash(edit.TargetHash) != nil
+			})
+			if onWinning {
+				request.Edits = append(request.Edits, edit)
+			}
+		}
+	}
+	return request, report
+}
+
+// Count the results of a merge request by what the leader did with each item
+func (report *MergeReport) count(results []MergeResult) {
+	report.Results = results
+	for _, result := range results {
+		switch result.Status {
+		case "exists":
+			report.Existing++
+			continue
+		case "rejected":
+			report.Rejected++
+			continue
+		}
+		switch result.Kind {
+		case "firstMessage":
+			report.FirstMessages++
+		case "message":
+			report.Messages++
+		case "reaction":
+			report.Reactions++
+		case "retention":
+			report.Retentions++
+		case "edit":
+			report.Edits++
+		}
+	}
+}
+
+// Send content to the leader and get what it did with each item
+func (network *Network) requestMerge(leader peer.ID, request mergeRequest) ([]MergeResult, error) {
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, rejoinTimeout)
+	defer cancel()
+
+	stream, err := network.P2pService.Host.NewStream(ctx, leader, mergeProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the leader %s: %s", leader, err.Error())
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(rejoinTimeout))
+	if err := json.NewEncoder(stream).Encode(request); err != nil {
+		return nil, err
+	}
+	response := mergeResponse{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxMergeSize)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("no answer from the leader %s: %s", leader, err.Error())
+	}
+	return response.Results, nil
+}
+
+// An item of a merge request that the leader queued, waiting for its commit
+type mergeItem struct {
+	result int
+	op     *raftOP
+	// Checks that the item is in the chain once its op was committed, nil to trust the result of its op
+	committed func(blockchain *models.Blockchain) bool
+}
+
+// Replay content sent by a member, in its original order. It goes through the same checks
+// as content received over pubsub, so messages the chain already has are dropped. Items must
+// be authored by the member, the messages it holds for others must still be signed by their publisher.
+func (network *Network) handleMerge(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(rejoinTimeout))
+	remote := stream.Conn().RemotePeer()
+
+	consensusService := network.ConsensusService
+	if consensusService.Raft.State() != raft.Leader || !consensusService.Membership.isMember(remote) || !network.P2pService.PeerAllowed(remote) {
+		debug.Log("raft", fmt.Sprintf("Refused merge request from %s", remote))
+		stream.Reset()
+		return
+	}
+
+	request := mergeRequest{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxMergeSize)).Decode(&request); err != nil {
+		debug.Log("err", fmt.Sprintf("Invalid merge request from %s: %s", remote, err))
+		stream.Reset()
+		return
+	}
+	debug.Log("raft", fmt.Sprintf("Replaying %d messages and %d held envelopes from %s", len(request.Messages), len(request.Envelopes), remote))
+
+	results := make([]MergeResult, 0)
+	queued := make([]mergeItem, 0)
+	add := func(kind string, id string, op *raftOP, err error, committed func(blockchain *models.Blockchain) bool) {
+		result := MergeResult{Kind: kind, ID: id, Status: "committed"}
+		switch {
+		case errors.Is(err, errExists):
+			result.Status = "exists"
+		case err != nil:
+			result.Status = "rejected"
+			result.Error = err.Error()
+		default:
+			queued = append(queued, mergeItem{result: len(results), op: op, committed: committed})
+		}
+		results = append(results, result)
+	}
+	addFirstMessage := func(firstMessage models.FirstMessage, author string) {
+		id := strings.Join(firstMessage.PeerIDs, "/")
+		if len(firstMessage.PeerIDs) != 2 || (firstMessage.PeerIDs[0] != author && firstMessage.PeerIDs[1] != author) {
+			add("firstMessage", id, nil, fmt.Errorf("conversation is not one of %s", author), nil)
+			return
+		}
+		op, err := addFirstMessageBlock(network, firstMessage, consensusService.batcher, consensusService.Actor)
+		add("firstMessage", id, op, err, func(blockchain *models.Blockchain) bool {
+			return blockchain.CheckPeerFirstMessage(firstMessage.PeerIDs) != nil
+		})
+	}
+	addMessage := func(message models.Message, author string) {
+		if message.Sender != author {
+			add("message", message.ID, nil, fmt.Errorf("message was not sent by %s", author), nil)
+			return
+		}
+		op, err := addMessageBlock(network, message, consensusService.batcher, consensusService.Actor)
+		id := message.ID
+		if op != nil {
+			id = op.Message.ID
+		}
+		add("message", id, op, err, func(blockchain *models.Blockchain) bool {
+			return blockchain.GetMessageByID(id) != nil
+		})
+	}
+
+	author := remote.String()
+	for _, firstMessage := range request.FirstMessages {
+		addFirstMessage(firstMessage, author)
+	}
+	for _, message := range request.Messages {
+		addMessage(message, author)
+	}
+	for _, reaction := range request.Reactions {
+		id := reaction.MessageID + "/" + reaction.Emoji
+		if reaction.Sender != author {
+			add("reaction", id, nil, fmt.Errorf("reaction was not sent by %s", author), nil)
+			continue
+		}
+		op, err := addReactionBlock(network, reaction, consensusService.batcher, consensusService.Actor)
+		add("reaction", id, op, err, nil)
+	}
+	for _, retention := range request.Retentions {
+		id := strings.Join(retention.PeerIDs, "/")
+		if retention.Setter != author {
+			add("retention", id, nil, fmt.Errorf("retention was not set by %s", author), nil)
+			continue
+		}
+		op, err := addRetentionBlock(network, retention, consensusService.batcher, consensusService.Actor)
+		add("retention", id, op, err, nil)
+	}
+	for _, edit := range request.Edits {
+		if edit.Sender != author {
+			add("edit", edit.TargetHash, nil, fmt.Errorf("edit was not sent by %s", author), nil)
+			continue
+		}
+		op, err := addEditBlock(network, edit, consensusService.batcher, consensusService.Actor)
+		add("edit", edit.TargetHash, op, err, nil)
+	}
+	for _, signed := range request.Envelopes {
+		envelope, publisher, err := openSignedEnvelope(signed)
+		if err != nil {
+			add("envelope", "", nil, err, nil)
+			continue
+		}
+		switch envelope.Type {
+		case "Message":
+			message := models.Message{}
+			if err := json.Unmarshal(envelope.Data, &message); err != nil {
+				add("envelope", "", nil, fmt.Errorf("malformed Message: %s", err.Error()), nil)
+				continue
+			}
+			addMessage(message, publisher.String())
+		case "FirstMessage":
+			firstMessage := models.FirstMessage{}
+			if err := json.Unmarshal(envelope.Data, &firstMessage); err != nil {
+				add("envelope", "", nil, fmt.Errorf("malformed FirstMessage: %s", err.Error()), nil)
+				continue
+			}
+			addFirstMessage(firstMessage, publisher.String())
+		default:
+			add("envelope", "", nil, fmt.Errorf("%s envelopes cannot be held", envelope.Type), nil)
+		}
+	}
+
+	// Answer with what was committed, not with what was queued
+	timeout := time.NewTimer(mergeCommitTimeout)
+	defer timeout.Stop()
+	timedOut := false
+	for _, item := range queued {
+		var err error
+		if timedOut {
+			select {
+			case err = <-item.op.done:
+			default:
+				err = errCommitTimeout
+			}
+		} else {
+			select {
+			case err = <-item.op.done:
+			case <-timeout.C:
+				timedOut = true
+				err = errCommitTimeout
+			}
+		}
+		if err == nil && item.committed != nil {
+			consensusService.View(func(blockchain *models.Blockchain) {
+				if !item.committed(blockchain) {
+					err = fmt.Errorf("not applied to the chain")
+				}
+			})
+		}
+		if err != nil {
+			results[item.result].Status = "rejected"
+			results[item.result].Error = err.Error()
+		}
+	}
+	if err := json.NewEncoder(stream).Encode(mergeResponse{Results: results}); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer merge request from %s: %s", remote, err))
+	}
+}
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"MessageMesh/debug"
+	"errors"
 	"fmt"
 	"sort"
 	"time"
@@ -11,68 +12,244 @@ import (
 	"github.com/hashicorp/raft"
 	consensus "github.com/libp2p/go-libp2p-consensus"
 	libp2praft "github.com/libp2p/go-libp2p-raft"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// Directory of the Raft snapshots
+const snapshotsPath = directory + "/raft_testing_tmp"
+
 type raftState struct {
 	Blockchain models.Blockchain
+	// Raft index of the last command applied, kept in snapshots so linearizable reads know how far a restored chain is
+	Index uint64
+	// Why ops of the last applied batch were left out, by their position in the batch. It is not replicated
+	rejected map[int]error
 }
 
 type raftOP struct {
-	Type         string // "ADD_MESSAGE_BLOCK" or "ADD_ACCOUNT_BLOCK" or "ADD_FIRST_MESSAGE_BLOCK"
+	Type         string // "FOUND_CLUSTER", "ADD_MESSAGE_BLOCK", "ADD_ACCOUNT_BLOCK", "ADD_FIRST_MESSAGE_BLOCK", "ADD_EDIT_BLOCK", "ADD_DELETE_BLOCK", "ADD_REACTION_BLOCK", "ADD_RETENTION_BLOCK", "ADD_CHECKPOINT_BLOCK" or "ADD_BATCH"
 	Message      *models.Message
 	Account      *models.Account
 	FirstMessage *models.FirstMessage
+	Edit         *models.MessageEdit
+	Reaction     *models.Reaction
+	Retention    *models.Retention
+	Genesis      *models.GenesisData
+	Checkpoint   *models.CheckpointData
+	Ops          []*raftOP // Ops of a batch, committed as the entries of one block in order
+	Timestamp    int64     // Block timestamp chosen by the leader
+	// Receives the result of the commit of a queued op, it is not replicated
+	done chan error
 }
 
-func (o *raftOP) ApplyTo(state consensus.State) (consensus.State, error) {
-	currentState := state.(*raftState)
+var (
+	// An op was not queued because this node is not the leader
+	errNotLeader = errors.New("this node is not the leader")
+	// An op was not queued because the chain already has it or it is waiting to be committed
+	errExists = errors.New("already in the chain")
+	// An op was committed to the log but the chain refused it
+	errNotApplied = errors.New("refused by the chain")
+)
 
+// Check an op against the chain it is applied to
+func (o *raftOP) validate(blockchain *models.Blockchain) error {
 	switch o.Type {
+	case "FOUND_CLUSTER":
+		if o.Genesis == nil || o.Genesis.ClusterID == "" {
+			return fmt.Errorf("cluster is missing an ID")
+		}
+		if len(blockchain.Chain) != 1 || blockchain.ClusterID() != "" {
+			return fmt.Errorf("cluster is already founded")
+		}
 	case "ADD_MESSAGE_BLOCK":
 		if o.Message.Sender == "" || o.Message.Receiver == "" || o.Message.Message == "" {
-			return currentState, fmt.Errorf("message is missing required fields")
+			return fmt.Errorf("message is missing required fields")
 		}
 		if o.Message.Sender == o.Message.Receiver {
-			return currentState, fmt.Errorf("message sender and receiver cannot be the same")
+			return fmt.Errorf("message sender and receiver cannot be the same")
+		}
+		if o.Message.ID == "" {
+			return fmt.Errorf("message is missing an ID")
+		}
+		if blockchain.GetMessageByID(o.Message.ID) != nil {
+			return fmt.Errorf("message ID %s already exists", o.Message.ID)
+		}
+		if o.Message.ReplyTo != "" && blockchain.GetMessageByID(o.Message.ReplyTo) == nil {
+			return fmt.Errorf("reply to unknown message %s", o.Message.ReplyTo)
 		}
 	case "ADD_ACCOUNT_BLOCK":
 		if o.Account.Username == "" {
-			return currentState, fmt.Errorf("account is missing required fields")
+			return fmt.Errorf("account is missing required fields")
 		}
 	case "ADD_FIRST_MESSAGE_BLOCK":
 		if len(o.FirstMessage.PeerIDs) != 2 {
-			return currentState, fmt.Errorf("first message must have exactly 2 peer IDs")
+			return fmt.Errorf("first message must have exactly 2 peer IDs")
 		}
 		if o.FirstMessage.PeerIDs[0] == o.FirstMessage.PeerIDs[1] {
-			return currentState, fmt.Errorf("first message peer IDs cannot be the same")
+			return fmt.Errorf("first message peer IDs cannot be the same")
 		}
 		if o.FirstMessage.PeerIDs[0] == "" || o.FirstMessage.PeerIDs[1] == "" {
-			return currentState, fmt.Errorf("first message peer IDs cannot be empty")
+			return fmt.Errorf("first message peer IDs cannot be empty")
 		}
 		if o.FirstMessage.SymetricKey0 == nil || o.FirstMessage.SymetricKey1 == nil {
-			return currentState, fmt.Errorf("first message symetric keys cannot be empty")
+			return fmt.Errorf("first message symetric keys cannot be empty")
+		}
+	case "ADD_EDIT_BLOCK":
+		if o.Edit.Message == "" {
+			return fmt.Errorf("edit is missing the replacement message")
+		}
+		if err := validateMessageEdit(blockchain, o.Edit); err != nil {
+			return err
+		}
+	case "ADD_DELETE_BLOCK":
+		if o.Edit.Message != "" {
+			return fmt.Errorf("delete cannot carry a message")
+		}
+		if err := validateMessageEdit(blockchain, o.Edit); err != nil {
+			return err
+		}
+	case "ADD_REACTION_BLOCK":
+		if o.Reaction.Sender == "" || o.Reaction.Emoji == "" {
+			return fmt.Errorf("reaction is missing required fields")
+		}
+		if blockchain.GetMessageByID(o.Reaction.MessageID) == nil {
+			return fmt.Errorf("reaction to unknown message %s", o.Reaction.MessageID)
+		}
+	case "ADD_RETENTION_BLOCK":
+		if err := validateRetention(o.Retention); err != nil {
+			return err
+		}
+	case "ADD_CHECKPOINT_BLOCK":
+		if err := validateCheckpoint(blockchain, o.Checkpoint); err != nil {
+			return err
+		}
+	case "ADD_BATCH":
+		if len(o.Ops) == 0 {
+			return fmt.Errorf("batch has no ops")
+		}
+		for _, op := range o.Ops {
+			if blockType, _ := op.entry(); blockType == "" {
+				return fmt.Errorf("%s cannot be batched", op.Type)
+			}
 		}
 	}
+	return nil
+}
+
+// Get the block type and data an op is committed as inside a batch, empty for ops that cannot be batched
+func (o *raftOP) entry() (string, models.BlockData) {
+	switch o.Type {
+	case "ADD_MESSAGE_BLOCK":
+		return "message", &models.MessageData{Message: *o.Message}
+	case "ADD_ACCOUNT_BLOCK":
+		return "account", &models.AccountData{Account: *o.Account}
+	case "ADD_FIRST_MESSAGE_BLOCK":
+		sort.Strings(o.FirstMessage.PeerIDs)
+		return "firstMessage", &models.FirstMessageData{FirstMessage: *o.FirstMessage}
+	case "ADD_EDIT_BLOCK":
+		return "edit", &models.EditData{MessageEdit: *o.Edit}
+	case "ADD_DELETE_BLOCK":
+		return "delete", &models.EditData{MessageEdit: *o.Edit}
+	case "ADD_REACTION_BLOCK":
+		return "reaction", &models.ReactionData{Reaction: *o.Reaction}
+	case "ADD_RETENTION_BLOCK":
+		sort.Strings(o.Retention.PeerIDs)
+		return "retention", &models.RetentionData{Retention: *o.Retention}
+	}
+	return "", nil
+}
+
+func (o *raftOP) ApplyTo(state consensus.State) (consensus.State, error) {
+	currentState := state.(*raftState)
+	if err := o.validate(&currentState.Blockchain); err != nil {
+		return currentState, err
+	}
 
 	// Apply the operation if validation passed
 	switch o.Type {
+	case "FOUND_CLUSTER":
+		currentState.Blockchain.Chain[0] = models.CreateClusterGenesisBlock(*o.Genesis)
+		debug.Log("raft", fmt.Sprintf("Founded cluster: %s", o.Genesis.ClusterID))
+
 	case "ADD_MESSAGE_BLOCK":
-		newBlock := currentState.Blockchain.AddMessageBlock(*o.Message)
+		newBlock := currentState.Blockchain.AddMessageBlock(*o.Message, o.Timestamp)
 		debug.Log("raft", fmt.Sprintf("New message block added: %d", newBlock.Index))
 
 	case "ADD_ACCOUNT_BLOCK":
-		newBlock := currentState.Blockchain.AddAccountBlock(*o.Account)
+		newBlock := currentState.Blockchain.AddAccountBlock(*o.Account, o.Timestamp)
 		debug.Log("raft", fmt.Sprintf("New account block added: %d", newBlock.Index))
 
 	case "ADD_FIRST_MESSAGE_BLOCK":
-		newBlock := currentState.Blockchain.AddFirstMessageBlock(*o.FirstMessage)
+		newBlock := currentState.Blockchain.AddFirstMessageBlock(*o.FirstMessage, o.Timestamp)
 		debug.Log("raft", fmt.Sprintf("New first message block added: %d", newBlock.Index))
+
+	case "ADD_EDIT_BLOCK":
+		newBlock := currentState.Blockchain.AddEditBlock(*o.Edit, o.Timestamp)
+		debug.Log("raft", fmt.Sprintf("New edit block added: %d", newBlock.Index))
+
+	case "ADD_DELETE_BLOCK":
+		newBlock := currentState.Blockchain.AddDeleteBlock(*o.Edit, o.Timestamp)
+		debug.Log("raft", fmt.Sprintf("New delete block added: %d", newBlock.Index))
+
+	case "ADD_REACTION_BLOCK":
+		newBlock := currentState.Blockchain.AddReactionBlock(*o.Reaction, o.Timestamp)
+		debug.Log("raft", fmt.Sprintf("New reaction block added: %d", newBlock.Index))
+
+	case "ADD_RETENTION_BLOCK":
+		newBlock := currentState.Blockchain.AddRetentionBlock(*o.Retention, o.Timestamp)
+		debug.Log("raft", fmt.Sprintf("New retention block added: %d", newBlock.Index))
+
+	case "ADD_CHECKPOINT_BLOCK":
+		newBlock := currentState.Blockchain.AddCheckpointBlock(*o.Checkpoint, o.Timestamp)
+		debug.Log("raft", fmt.Sprintf("New checkpoint block added: %d", newBlock.Index))
+
+	case "ADD_BATCH":
+		// An invalid op is left out of the batch, the others are still committed
+		batch := currentState.Blockchain.OpenBatch(o.Timestamp)
+		currentState.rejected = make(map[int]error)
+		for i, op := range o.Ops {
+			if err := op.validate(&currentState.Blockchain); err != nil {
+				debug.Log("raft", fmt.Sprintf("Left %s out of batch block %d: %s", op.Type, batch.Index, err))
+				currentState.rejected[i] = err
+				continue
+			}
+			batch.AddEntry(op.entry())
+		}
+		if newBlock := currentState.Blockchain.CloseBatch(); newBlock != nil {
+			debug.Log("raft", fmt.Sprintf("New batch block added: %d with %d entries", newBlock.Index, len(newBlock.Entries)))
+		} else {
+			debug.Log("raft", "Batch had no valid ops")
+		}
 	}
 
 	return currentState, nil
 }
 
 func StartConsensus(network *Network) (*ConsensusService, error) {
+	consensusService := &ConsensusService{
+		Mode:            nodeMode(),
+		ReadConsistency: readConsistency(),
+		restored:        make(chan struct{}, 1),
+		conflicts:       make(map[peer.ID]ClusterConflict),
+	}
+	network.ConsensusService = consensusService
+	debug.Log("raft", fmt.Sprintf("Node mode: %s, %s reads", consensusService.Mode, consensusService.ReadConsistency))
+
+	if err := network.startRaft(""); err != nil {
+		return nil, err
+	}
+	network.P2pService.Host.SetStreamHandler(joinProtocol, network.handleJoin)
+	network.P2pService.Host.SetStreamHandler(clusterProtocol, network.handleClusterInfo)
+	network.P2pService.Host.SetStreamHandler(mergeProtocol, network.handleMerge)
+	network.P2pService.Host.SetStreamHandler(statusProtocol, network.handleStatus)
+	network.P2pService.Host.SetStreamHandler(historyProtocol, network.handleHistory)
+	network.P2pService.Host.SetStreamHandler(readIndexProtocol, network.handleReadIndex)
+	network.P2pService.Host.SetStreamHandler(proofProtocol, network.handleProof)
+	return consensusService, nil
+}
+
+// Start a Raft instance with a fresh blockchain and join a cluster, through the target peer if set
+func (network *Network) startRaft(target peer.ID) error {
 	// Initialize blockchain with genesis block
 	initialState := &raftState{
 		Blockchain: models.Blockchain{
@@ -83,23 +260,9 @@ func StartConsensus(network *Network) (*ConsensusService, error) {
 	// Create the consensus with blockchain state
 	raftconsensus := libp2praft.NewOpLog(initialState, &raftOP{})
 
-	pids := network.PubSubService.PeerList()
-	pids = append(pids, network.P2pService.Host.ID())
-	servers := make([]raft.Server, len(pids))
-	for i, pid := range pids {
-		servers[i] = raft.Server{
-			Suffrage: raft.Voter,
-			ID:       raft.ServerID(pid.String()),
-			Address:  raft.ServerAddress(pid.String()),
-		}
-	}
-	serverConfig := raft.Configuration{
-		Servers: servers,
-	}
-
 	transport, err := libp2praft.NewLibp2pTransport(network.P2pService.Host, 3*time.Second)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	config := raft.DefaultConfig()
@@ -109,108 +272,96 @@ func StartConsensus(network *Network) (*ConsensusService, error) {
 	config.CommitTimeout = 500 * time.Millisecond
 	config.LeaderLeaseTimeout = 1000 * time.Millisecond
 
-	snapshots, err := raft.NewFileSnapshotStore("db/raft_testing_tmp", 3, nil)
+	snapshots, err := raft.NewFileSnapshotStore(snapshotsPath, 3, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	logStore := raft.NewInmemStore()
 	// logStore, _ := raftboltdb.NewBoltStore("db/raft.db")
 
-	// Check if we're the first node
-	isFirstNode := len(pids) <= 1
-
-	// Only bootstrap if we're the first node
-	if isFirstNode {
-		debug.Log("raft", "Bootstrapping new cluster as first node")
-		if err := raft.BootstrapCluster(config, logStore, logStore, snapshots, transport, serverConfig); err != nil {
-			return nil, fmt.Errorf("bootstrap error: %v", err)
-		}
-	}
-
-	raftInstance, err := raft.NewRaft(config, raftconsensus.FSM(), logStore, logStore, snapshots, transport)
+	// Queries share the lock of the chain with the FSM
+	fsm := &lockedFSM{fsm: raftconsensus.FSM(), state: initialState, lock: &network.ConsensusService.chainLock, restored: network.ConsensusService.restored}
+	raftInstance, err := raft.NewRaft(config, fsm, logStore, logStore, snapshots, transport)
 	if err != nil {
-		return nil, err
-	}
-
-	// If we're not the first node, wait for the leader to add us
-	if !isFirstNode {
-		debug.Log("raft", "Waiting to be added to existing cluster...")
-		// The leader will add us through the networkLoop
+		return err
 	}
 
 	actor := libp2praft.NewActor(raftInstance)
 	raftconsensus.SetActor(actor)
 
-	consensusService := &ConsensusService{
-		LatestBlock: make(chan models.Block),
-		Blockchain:  &initialState.Blockchain,
-		Connected:   make(chan bool),
-		Raft:        raftInstance,
-		Actor:       actor,
-		Consensus:   raftconsensus,
+	membership := NewMembership(network, raftInstance)
+	batcher := newOpBatcher()
+	stop := make(chan struct{})
+
+	consensusService := network.ConsensusService
+	consensusService.chainLock.Lock()
+	consensusService.Blockchain = &initialState.Blockchain
+	consensusService.state = initialState
+	consensusService.chainLock.Unlock()
+	consensusService.Raft = raftInstance
+	consensusService.Actor = actor
+	consensusService.Consensus = raftconsensus
+	consensusService.Membership = membership
+	consensusService.batcher = batcher
+	consensusService.stop = stop
+
+	go networkLoop(network, raftInstance, membership, stop)
+	go blockchainLoop(network, raftInstance, raftconsensus, batcher, actor, stop)
+	go batchLoop(batcher, raftconsensus, stop)
+	go leadershipLoop(network, raftInstance, stop)
+	go syncLoop(network, stop)
+	// Observers hold messages until they are committed
+	if consensusService.Mode == observerMode {
+		go mailboxLoop(network, stop)
 	}
 
-	go networkLoop(network, raftInstance)
-	go blockchainLoop(network, raftInstance, raftconsensus, actor)
+	// Ask the mesh peers to join their cluster, or found a new one
+	go network.joinCluster(target, stop)
 
-	return consensusService, nil
+	return nil
 }
 
-func networkLoop(network *Network, raftInstance *raft.Raft) {
+func networkLoop(network *Network, raftInstance *raft.Raft, membership *Membership, stop chan struct{}) {
 	debug.Log("raft", "Starting network loop")
 
-	// Verify channel connection
-	debug.Log("raft", "Checking PubSubService channels...")
 	if network.PubSubService == nil {
 		debug.Log("raft", "ERROR: PubSubService is nil")
 		return
 	}
-	if network.PubSubService.PeerJoin == nil {
-		debug.Log("raft", "ERROR: PeerJoin channel is nil")
-		return
-	}
-
-	debug.Log("raft", "Channels verified, starting main loop")
+	// Membership must see every join, so it gets a larger buffer than the UI
+	peers := network.Events.Subscribe("membership", 256, EventPeerJoined, EventPeerLeft)
+	defer peers.Close()
 
 	for {
 		select {
-		case peer := <-network.PubSubService.PeerJoin:
-			debug.Log("raft", fmt.Sprintf("Network loop received peer join: %s", peer))
-			// Only add voter if we are the leader
-			if raftInstance.State() == raft.Leader {
-				future := raftInstance.AddVoter(
-					raft.ServerID(peer.String()),
-					raft.ServerAddress(peer.String()),
-					0,
-					5*time.Second,
-				)
-				if err := future.Error(); err != nil {
-					debug.Log("err", fmt.Sprintf("Failed to add voter: %s", err))
-				}
-			}
+		case <-stop:
+			return
 
-		case peer := <-network.PubSubService.PeerLeave:
-			debug.Log("raft", fmt.Sprintf("Peer left: %s", peer))
-			if raftInstance.State() == raft.Leader {
-				future := raftInstance.RemoveServer(
-					raft.ServerID(peer.String()),
-					0,
-					5*time.Second,
-				)
-				if err := future.Error(); err != nil {
-					debug.Log("err", fmt.Sprintf("Failed to remove server: %s", err))
-				}
+		case event := <-peers.Events:
+			peer, err := peer.Decode(event.Peer)
+			if err != nil {
+				continue
+			}
+			if event.Type == EventPeerLeft {
+				debug.Log("raft", fmt.Sprintf("Peer left: %s", peer))
+				membership.PeerLeft(peer)
+				continue
+			}
+			debug.Log("raft", fmt.Sprintf("Network loop received peer join: %s", peer))
+			// Blocked peers, or peers missing from the allowlist, never take part in consensus
+			if !network.P2pService.PeerAllowed(peer) {
+				debug.Log("raft", fmt.Sprintf("Not adding disallowed peer: %s", peer))
+				continue
 			}
+			membership.PeerJoined(peer)
+			// Look for peers of other clusters on the same topic
+			go network.checkCluster(peer)
 
 		case leader := <-raftInstance.LeaderCh():
 			if leader {
 				debug.Log("raft", "I am the leader")
-				go func() {
-					time.Sleep(5 * time.Minute)
-					debug.Log("raft", "Transferring leadership")
-					raftInstance.LeadershipTransfer()
-				}()
+				go membership.Reconcile()
 			} else {
 				debug.Log("raft", "I am not the leader")
 			}
@@ -218,126 +369,362 @@ func networkLoop(network *Network, raftInstance *raft.Raft) {
 	}
 }
 
-func blockchainLoop(network *Network, raftInstance *raft.Raft, raftconsensus *libp2praft.Consensus, actor *libp2praft.Actor) {
+// Log a block that was committed
+func logCommittedBlock(block *models.Block) {
+	// Type assertion to access specific data
+	switch block.BlockType {
+	case "message":
+		if messageData, ok := block.Data.(*models.MessageData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed message from: %s", messageData.Message.Sender))
+			debug.Log("raft", fmt.Sprintf("Committed message: %s", messageData.Message.Message))
+		}
+	case "account":
+		if accountData, ok := block.Data.(*models.AccountData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed account: %s", accountData.Account.Username))
+		}
+	case "firstMessage":
+		if firstMessageData, ok := block.Data.(*models.FirstMessageData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed first message: %s and %s", firstMessageData.FirstMessage.PeerIDs[0], firstMessageData.FirstMessage.PeerIDs[1]))
+		}
+	case "reaction":
+		if reactionData, ok := block.Data.(*models.ReactionData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed reaction: %s on %s", reactionData.Reaction.Emoji, reactionData.Reaction.MessageID))
+		}
+	case "retention":
+		if retentionData, ok := block.Data.(*models.RetentionData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed retention: %s and %s", retentionData.Retention.PeerIDs[0], retentionData.Retention.PeerIDs[1]))
+		}
+	case "edit", "delete":
+		if editData, ok := block.Data.(*models.EditData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed %s of block: %d", block.BlockType, editData.MessageEdit.TargetIndex))
+		}
+	case "checkpoint":
+		if checkpointData, ok := block.Data.(*models.CheckpointData); ok {
+			debug.Log("raft", fmt.Sprintf("Committed checkpoint at height: %d", checkpointData.Height))
+		}
+	case "batch":
+		debug.Log("raft", fmt.Sprintf("Committed batch of %d entries", len(block.Entries)))
+	default:
+		debug.Log("raft", fmt.Sprintf("Committed block type: %s", block.BlockType))
+	}
+}
+
+func blockchainLoop(network *Network, raftInstance *raft.Raft, raftconsensus *libp2praft.Consensus, batcher *opBatcher, actor *libp2praft.Actor, stop chan struct{}) {
+	interval := checkpointInterval()
+	// Index and hash of the last block passed on to the event bus
+	published := -1
+	publishedHash := ""
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		published = len(blockchain.Chain) - 1
+		publishedHash = blockchain.GetLatestBlock().Hash
+	})
 	for {
 		select {
+		case <-stop:
+			return
+
 		// New block added to the blockchain
 		case <-raftconsensus.Subscribe():
-			// First time the blockchain is updated
-			newState, _ := raftconsensus.GetCurrentState()
-			blockchain := newState.(*raftState).Blockchain
-			debug.Log("raft", fmt.Sprintf("Blockchain updated, current length: %d", len(blockchain.Chain)))
-			latestBlock := blockchain.GetLatestBlock()
-
-			// Type assertion to access specific data
-			switch latestBlock.BlockType {
-			case "message":
-				if messageData, ok := latestBlock.Data.(*models.MessageData); ok {
-					debug.Log("raft", fmt.Sprintf("Latest message from: %s", messageData.Message.Sender))
-					debug.Log("raft", fmt.Sprintf("Latest message: %s", messageData.Message.Message))
+			// Several blocks can be committed before the loop is notified, so every block after
+			// the last one passed on is passed on
+			blocks := make([]*models.Block, 0)
+			length := 0
+			network.ConsensusService.View(func(blockchain *models.Blockchain) {
+				length = len(blockchain.Chain)
+				// A chain that was replaced, by a snapshot or a rejoin, is passed on from its latest block
+				if published < 0 || published >= length || blockchain.Chain[published].Hash != publishedHash {
+					published = length - 2
 				}
-			case "account":
-				if accountData, ok := latestBlock.Data.(*models.AccountData); ok {
-					debug.Log("raft", fmt.Sprintf("Latest account: %s", accountData.Account.Username))
+				for _, block := range blockchain.Chain[published+1:] {
+					blocks = append(blocks, block.Copy())
 				}
-			case "firstMessage":
-				if firstMessageData, ok := latestBlock.Data.(*models.FirstMessageData); ok {
-					debug.Log("raft", fmt.Sprintf("Latest first message: %s and %s", firstMessageData.FirstMessage.PeerIDs[0], firstMessageData.FirstMessage.PeerIDs[1]))
+				published = length - 1
+				publishedHash = blockchain.Chain[published].Hash
+			})
+			debug.Log("raft", fmt.Sprintf("Blockchain updated, current length: %d", length))
+
+			for _, block := range blocks {
+				logCommittedBlock(block)
+				// The entries of a batch are passed on one by one, so every message is still acknowledged by itself
+				entries := []*models.Block{block}
+				if block.BlockType == "batch" {
+					entries = block.Entries
+				}
+				for _, entry := range entries {
+					network.Events.Publish(Event{Type: EventBlockCommitted, Block: entry})
 				}
-			default:
-				debug.Log("raft", fmt.Sprintf("Latest block type: %s", latestBlock.BlockType))
-			}
-			network.ConsensusService.LatestBlock <- models.Block{
-				Index:     latestBlock.Index,
-				Timestamp: latestBlock.Timestamp,
-				PrevHash:  latestBlock.PrevHash,
-				Hash:      latestBlock.Hash,
-				BlockType: latestBlock.BlockType,
-				Data:      latestBlock.Data,
 			}
+			addCheckpointBlock(network, interval, raftconsensus, actor)
 
-		case inbound := <-network.PubSubService.Inbound:
+		case packet := <-network.PubSubService.Inbound:
+			inbound := packet.Value
+			if network.ConsensusService.Mode == observerMode {
+				network.storeInMailbox(inbound, packet.Signed)
+			}
 			// If inbound is a message
 			if message, ok := inbound.(models.Message); ok {
 				debug.Log("raft", fmt.Sprintf("Inbound message: %s", message.Message))
-				addMessageBlock(network, message, raftconsensus, actor)
+				addMessageBlock(network, message, batcher, actor)
 			}
 			if firstMessage, ok := inbound.(models.FirstMessage); ok {
 				debug.Log("raft", fmt.Sprintf("Inbound first message: %s and %s", firstMessage.PeerIDs[0], firstMessage.PeerIDs[1]))
-				addFirstMessageBlock(network, firstMessage, raftconsensus, actor)
+				addFirstMessageBlock(network, firstMessage, batcher, actor)
+			}
+			if edit, ok := inbound.(models.MessageEdit); ok {
+				debug.Log("raft", fmt.Sprintf("Inbound edit of block: %d", edit.TargetIndex))
+				addEditBlock(network, edit, batcher, actor)
+			}
+			if reaction, ok := inbound.(models.Reaction); ok {
+				debug.Log("raft", fmt.Sprintf("Inbound reaction: %s on %s", reaction.Emoji, reaction.MessageID))
+				addReactionBlock(network, reaction, batcher, actor)
+			}
+			if retention, ok := inbound.(models.Retention); ok {
+				debug.Log("raft", fmt.Sprintf("Inbound retention from: %s", retention.Setter))
+				addRetentionBlock(network, retention, batcher, actor)
 			}
 		}
 	}
 }
 
-func addMessageBlock(network *Network, message models.Message, raftconsensus *libp2praft.Consensus, actor *libp2praft.Actor) {
-	if actor.IsLeader() {
-		debug.Log("raft", fmt.Sprintf("Adding message block: %s", message.Message))
-		if message.Sender == "" || message.Receiver == "" || message.Message == "" {
-			debug.Log("raft", "Message is missing required fields")
-			return
-		}
-		if message.Sender == message.Receiver {
-			debug.Log("raft", "Message sender and receiver cannot be the same")
-			return
-		}
-		// Create a message block using the new structure
-		op := &raftOP{
-			Type: "ADD_MESSAGE_BLOCK",
-			Message: &models.Message{
-				Sender:    message.Sender,
-				Receiver:  message.Receiver,
-				Message:   message.Message,
-				Timestamp: time.Now().Format(time.RFC3339),
-			},
-		}
-
-		_, err := raftconsensus.CommitOp(op)
-		if err != nil {
-			debug.Log("err", fmt.Sprintf("Failed to commit block: %s", err))
-		}
+// Queue a message block, returning the queued op or why the message was not added
+func addMessageBlock(network *Network, message models.Message, batcher *opBatcher, actor *libp2praft.Actor) (*raftOP, error) {
+	if !actor.IsLeader() {
+		return nil, errNotLeader
+	}
+	debug.Log("raft", fmt.Sprintf("Adding message block: %s", message.Message))
+	if message.Sender == "" || message.Receiver == "" || message.Message == "" {
+		debug.Log("raft", "Message is missing required fields")
+		return nil, fmt.Errorf("message is missing required fields")
+	}
+	if message.Sender == message.Receiver {
+		debug.Log("raft", "Message sender and receiver cannot be the same")
+		return nil, fmt.Errorf("message sender and receiver cannot be the same")
+	}
+	// Older clients do not send message IDs
+	if message.ID == "" {
+		message.ID = models.NewMessageID()
+	}
+	exists, replyFound := false, true
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		exists = blockchain.GetMessageByID(message.ID) != nil || batcher.pendingMessage(message.ID)
+		replyFound = message.ReplyTo == "" || blockchain.GetMessageByID(message.ReplyTo) != nil || batcher.pendingMessage(message.ReplyTo)
+	})
+	if exists {
+		debug.Log("raft", fmt.Sprintf("Message block already exists: %s", message.ID))
+		return nil, errExists
+	}
+	if !replyFound {
+		debug.Log("raft", fmt.Sprintf("Reply to unknown message: %s", message.ReplyTo))
+		return nil, fmt.Errorf("reply to unknown message %s", message.ReplyTo)
 	}
+	// Create a message block using the new structure
+	op := &raftOP{
+		Type:      "ADD_MESSAGE_BLOCK",
+		Timestamp: time.Now().Unix(),
+		Message: &models.Message{
+			ID:        message.ID,
+			Sender:    message.Sender,
+			Receiver:  message.Receiver,
+			Message:   message.Message,
+			Timestamp: time.Now().Format(time.RFC3339),
+			ReplyTo:   message.ReplyTo,
+		},
+	}
+
+	batcher.Submit(op)
+	return op, nil
 }
 
-func addFirstMessageBlock(network *Network, firstMessage models.FirstMessage, raftconsensus *libp2praft.Consensus, actor *libp2praft.Actor) {
-	if actor.IsLeader() {
-		sort.Strings(firstMessage.PeerIDs)
-		if currentState := network.ConsensusService.Blockchain.Chain; currentState != nil {
-			for _, block := range currentState {
-				if block.BlockType == "firstMessage" {
-					if block.Data.(*models.FirstMessageData).FirstMessage.PeerIDs[0] == firstMessage.PeerIDs[0] && block.Data.(*models.FirstMessageData).FirstMessage.PeerIDs[1] == firstMessage.PeerIDs[1] {
-						debug.Log("raft", fmt.Sprintf("First message block already exists: %s and %s", block.Data.(*models.FirstMessageData).FirstMessage.PeerIDs[0], block.Data.(*models.FirstMessageData).FirstMessage.PeerIDs[1]))
-						return
-					}
+func addFirstMessageBlock(network *Network, firstMessage models.FirstMessage, batcher *opBatcher, actor *libp2praft.Actor) (*raftOP, error) {
+	if !actor.IsLeader() {
+		return nil, errNotLeader
+	}
+	if len(firstMessage.PeerIDs) != 2 {
+		debug.Log("raft", "First message peer IDs must be exactly 2")
+		return nil, fmt.Errorf("first message peer IDs must be exactly 2")
+	}
+	sort.Strings(firstMessage.PeerIDs)
+	exists := batcher.pendingFirstMessage(firstMessage.PeerIDs)
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		for _, block := range blockchain.Entries() {
+			if block.BlockType == "firstMessage" {
+				if block.Data.(*models.FirstMessageData).FirstMessage.PeerIDs[0] == firstMessage.PeerIDs[0] && block.Data.(*models.FirstMessageData).FirstMessage.PeerIDs[1] == firstMessage.PeerIDs[1] {
+					exists = true
 				}
 			}
 		}
-		if len(firstMessage.PeerIDs) != 2 {
-			debug.Log("raft", "First message peer IDs must be exactly 2")
-			return
-		}
-		if firstMessage.PeerIDs[0] == "" || firstMessage.PeerIDs[1] == "" {
-			debug.Log("raft", "First message peer IDs cannot be empty")
-			return
-		}
-		if firstMessage.SymetricKey0 == nil || firstMessage.SymetricKey1 == nil {
-			debug.Log("raft", "First message symetric keys cannot be empty")
+	})
+	if exists {
+		debug.Log("raft", fmt.Sprintf("First message block already exists: %s and %s", firstMessage.PeerIDs[0], firstMessage.PeerIDs[1]))
+		return nil, errExists
+	}
+	if firstMessage.PeerIDs[0] == "" || firstMessage.PeerIDs[1] == "" {
+		debug.Log("raft", "First message peer IDs cannot be empty")
+		return nil, fmt.Errorf("first message peer IDs cannot be empty")
+	}
+	if firstMessage.SymetricKey0 == nil || firstMessage.SymetricKey1 == nil {
+		debug.Log("raft", "First message symetric keys cannot be empty")
+		return nil, fmt.Errorf("first message symetric keys cannot be empty")
+	}
+
+	debug.Log("raft", fmt.Sprintf("Adding first message block: %s and %s", firstMessage.PeerIDs[0], firstMessage.PeerIDs[1]))
+	op := &raftOP{
+		Type:      "ADD_FIRST_MESSAGE_BLOCK",
+		Timestamp: time.Now().Unix(),
+		FirstMessage: &models.FirstMessage{
+			PeerIDs:      firstMessage.PeerIDs,
+			SymetricKey0: firstMessage.SymetricKey0,
+			SymetricKey1: firstMessage.SymetricKey1,
+		},
+	}
+
+	batcher.Submit(op)
+	return op, nil
+}
+
+// Check that an edit or delete targets a message of its sender and is signed by them
+func validateMessageEdit(blockchain *models.Blockchain, edit *models.MessageEdit) error {
+	if err := blockchain.CheckMessageEdit(edit); err != nil {
+		return err
+	}
+	verified, err := VerifyPeerSignature(edit.Sender, edit.SigningBytes(), edit.Signature, edit.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("edit signature is invalid")
+	}
+	return nil
+}
+
+func addEditBlock(network *Network, edit models.MessageEdit, batcher *opBatcher, actor *libp2praft.Actor) (*raftOP, error) {
+	if !actor.IsLeader() {
+		return nil, errNotLeader
+	}
+	var err error
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		if blockchain.HasMessageEdit(&edit) || batcher.pendingEdit(&edit) {
+			err = errExists
 			return
 		}
+		err = validateMessageEdit(blockchain, &edit)
+	})
+	if errors.Is(err, errExists) {
+		debug.Log("raft", fmt.Sprintf("Edit of block %d already exists", edit.TargetIndex))
+		return nil, err
+	}
+	if err != nil {
+		debug.Log("raft", fmt.Sprintf("Rejected edit of block %d: %s", edit.TargetIndex, err.Error()))
+		return nil, err
+	}
 
-		debug.Log("raft", fmt.Sprintf("Adding first message block: %s and %s", firstMessage.PeerIDs[0], firstMessage.PeerIDs[1]))
-		op := &raftOP{
-			Type: "ADD_FIRST_MESSAGE_BLOCK",
-			FirstMessage: &models.FirstMessage{
-				PeerIDs:      firstMessage.PeerIDs,
-				SymetricKey0: firstMessage.SymetricKey0,
-				SymetricKey1: firstMessage.SymetricKey1,
-			},
-		}
+	// An empty replacement message deletes the original
+	opType := "ADD_EDIT_BLOCK"
+	if edit.Message == "" {
+		opType = "ADD_DELETE_BLOCK"
+	}
+	debug.Log("raft", fmt.Sprintf("Adding %s block for: %d", opType, edit.TargetIndex))
+	op := &raftOP{
+		Type:      opType,
+		Edit:      &edit,
+		Timestamp: time.Now().Unix(),
+	}
 
-		_, err := raftconsensus.CommitOp(op)
-		if err != nil {
-			debug.Log("err", fmt.Sprintf("Failed to commit block: %s", err))
-		}
+	batcher.Submit(op)
+	return op, nil
+}
+
+func addReactionBlock(network *Network, reaction models.Reaction, batcher *opBatcher, actor *libp2praft.Actor) (*raftOP, error) {
+	if !actor.IsLeader() {
+		return nil, errNotLeader
+	}
+	if reaction.Sender == "" || reaction.Emoji == "" {
+		debug.Log("raft", "Reaction is missing required fields")
+		return nil, fmt.Errorf("reaction is missing required fields")
+	}
+	found := false
+	// Replaying a reaction that is already in effect would only add a block
+	exists := false
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		found = blockchain.GetMessageByID(reaction.MessageID) != nil || batcher.pendingMessage(reaction.MessageID)
+		exists = blockchain.HasReaction(reaction.MessageID, reaction.Sender, reaction.Emoji) != reaction.Remove && !batcher.pendingReaction(&reaction)
+	})
+	if exists {
+		debug.Log("raft", fmt.Sprintf("Reaction %s on %s already exists", reaction.Emoji, reaction.MessageID))
+		return nil, errExists
+	}
+	if !found {
+		debug.Log("raft", fmt.Sprintf("Reaction to unknown message: %s", reaction.MessageID))
+		return nil, fmt.Errorf("reaction to unknown message %s", reaction.MessageID)
+	}
+
+	debug.Log("raft", fmt.Sprintf("Adding reaction block: %s on %s", reaction.Emoji, reaction.MessageID))
+	op := &raftOP{
+		Type:      "ADD_REACTION_BLOCK",
+		Timestamp: time.Now().Unix(),
+		Reaction: &models.Reaction{
+			MessageID: reaction.MessageID,
+			Sender:    reaction.Sender,
+			Emoji:     reaction.Emoji,
+			Remove:    reaction.Remove,
+			Timestamp: time.Now().Format(time.RFC3339),
+		},
+	}
+
+	batcher.Submit(op)
+	return op, nil
+}
+
+// Check that a retention setting is for a conversation between two peers and set by one of them
+func validateRetention(retention *models.Retention) error {
+	if len(retention.PeerIDs) != 2 {
+		return fmt.Errorf("retention must have exactly 2 peer IDs")
+	}
+	if retention.PeerIDs[0] == "" || retention.PeerIDs[1] == "" || retention.PeerIDs[0] == retention.PeerIDs[1] {
+		return fmt.Errorf("retention peer IDs must be two different peers")
+	}
+	if retention.Setter != retention.PeerIDs[0] && retention.Setter != retention.PeerIDs[1] {
+		return fmt.Errorf("retention can only be set by a peer of the conversation")
+	}
+	if retention.ExpireAfterHours < 0 || retention.KeepLast < 0 {
+		return fmt.Errorf("retention values cannot be negative")
+	}
+	return nil
+}
+
+func addRetentionBlock(network *Network, retention models.Retention, batcher *opBatcher, actor *libp2praft.Actor) (*raftOP, error) {
+	if !actor.IsLeader() {
+		return nil, errNotLeader
+	}
+	if err := validateRetention(&retention); err != nil {
+		debug.Log("raft", fmt.Sprintf("Rejected retention: %s", err.Error()))
+		return nil, err
+	}
+
+	sort.Strings(retention.PeerIDs)
+	exists := false
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		current := blockchain.GetRetention(retention.PeerIDs)
+		exists = current != nil && current.ExpireAfterHours == retention.ExpireAfterHours && current.KeepLast == retention.KeepLast && !batcher.pendingRetention(retention.PeerIDs)
+	})
+	if exists {
+		debug.Log("raft", fmt.Sprintf("Retention of %s and %s is already set", retention.PeerIDs[0], retention.PeerIDs[1]))
+		return nil, errExists
 	}
+
+	debug.Log("raft", fmt.Sprintf("Adding retention block: %s and %s", retention.PeerIDs[0], retention.PeerIDs[1]))
+	op := &raftOP{
+		Type:      "ADD_RETENTION_BLOCK",
+		Timestamp: time.Now().Unix(),
+		Retention: &models.Retention{
+			PeerIDs:          retention.PeerIDs,
+			ExpireAfterHours: retention.ExpireAfterHours,
+			KeepLast:         retention.KeepLast,
+			Setter:           retention.Setter,
+			Timestamp:        time.Now().Format(time.RFC3339),
+		},
+	}
+
+	batcher.Submit(op)
+	return op, nil
 }
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"MessageMesh/debug"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	contactsfile   = "contacts.db"
+	contactsdbpath = directory + "/" + contactsfile
+	// Longest contact name
+	maxContactName = 64
+)
+
+// Serialises access to the contacts database
+var contactsDBMutex sync.Mutex
+
+// A peer saved under a name of our choosing, kept on this node only
+type Contact struct {
+	PeerID  string `json:"peerID"`
+	Name    string `json:"name"`
+	AddedAt int64  `json:"addedAt"`
+}
+
+// Save a contact, replacing the name of a peer that is already saved
+func SaveContact(peerIDStr string, name string) (Contact, error) {
+	contact := Contact{PeerID: peerIDStr, Name: name, AddedAt: time.Now().Unix()}
+	if _, err := peer.Decode(peerIDStr); err != nil {
+		return contact, fmt.Errorf("invalid peer ID %s: %s", peerIDStr, err.Error())
+	}
+	if name == "" || len(name) > maxContactName {
+		return contact, fmt.Errorf("contact name must be 1 to %d characters", maxContactName)
+	}
+	contactJSON, err := json.Marshal(contact)
+	if err != nil {
+		return contact, err
+	}
+
+	contactsDBMutex.Lock()
+	defer contactsDBMutex.Unlock()
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return contact, err
+	}
+	boltDB, err := bolt.Open(contactsdbpath, 0600, nil)
+	if err != nil {
+		return contact, err
+	}
+	defer boltDB.Close()
+
+	return contact, boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("contacts"))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return bucket.Put([]byte(peerIDStr), contactJSON)
+	})
+}
+
+// Get the saved contacts, sorted by name
+func ReadContacts() ([]Contact, error) {
+	contacts := make([]Contact, 0)
+
+	contactsDBMutex.Lock()
+	defer contactsDBMutex.Unlock()
+
+	if _, err := os.Stat(contactsdbpath); os.IsNotExist(err) {
+		return contacts, nil
+	}
+	boltDB, err := bolt.Open(contactsdbpath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer boltDB.Close()
+
+	err = boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("contacts"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			contact := Contact{}
+			if err := json.Unmarshal(value, &contact); err != nil {
+				debug.Log("err", fmt.Sprintf("Invalid Contact for %s", string(key)))
+				return nil
+			}
+			contacts = append(contacts, contact)
+			return nil
+		})
+	})
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Name < contacts[j].Name })
+	return contacts, err
+}
+
+// Remove a saved contact
+func DeleteContact(peerIDStr string) error {
+	contactsDBMutex.Lock()
+	defer contactsDBMutex.Unlock()
+
+	if _, err := os.Stat(contactsdbpath); os.IsNotExist(err) {
+		return fmt.Errorf("contact %s not found", peerIDStr)
+	}
+	boltDB, err := bolt.Open(contactsdbpath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer boltDB.Close()
+
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("contacts"))
+		if bucket == nil || bucket.Get([]byte(peerIDStr)) == nil {
+			return fmt.Errorf("contact %s not found", peerIDStr)
+		}
+		return bucket.Delete([]byte(peerIDStr))
+	})
+}
@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	libp2praft "github.com/libp2p/go-libp2p-raft"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Directory of the control socket, only the user running the node can enter it
+	controlDirectory = directory + "/control"
+	// Unix socket the command line talks to a running node on
+	controlSocketPath = controlDirectory + "/control.sock"
+	// How long a command waits for the node to answer
+	controlTimeout = 30 * time.Second
+)
+
+// Serve the API endpoints on the control socket. Only the user running the node can
+// open the socket, so requests on it need no token.
+func (network *Network) startControlSocket() {
+	// The socket is created in a private directory, so it is never reachable by others,
+	// not even before its own permissions are set
+	if err := os.MkdirAll(controlDirectory, 0700); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to create the control socket: %s", err))
+		return
+	}
+	if err := os.Chmod(controlDirectory, 0700); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to restrict the control socket directory: %s", err))
+		return
+	}
+	// Another node answering on the socket keeps it, only a socket left behind by a
+	// node that did not shut down cleanly is replaced
+	if conn, err := net.DialTimeout("unix", controlSocketPath, time.Second); err == nil {
+		conn.Close()
+		debug.Log("err", fmt.Sprintf("Another node is serving the control socket %s, not replacing it", controlSocketPath))
+		return
+	}
+	os.Remove(controlSocketPath)
+	listener, err := net.Listen("unix", controlSocketPath)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to create the control socket: %s", err))
+		return
+	}
+	if err := os.Chmod(controlSocketPath, 0600); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to restrict the control socket: %s", err))
+		listener.Close()
+		return
+	}
+	api := &apiServer{network: network}
+	server := &http.Server{Handler: api.handler(), ReadHeaderTimeout: apiHeaderTimeout}
+	debug.Log("api", "Serving the control socket on "+controlSocketPath)
+	if err := server.Serve(listener); err != nil {
+		debug.Log("err", fmt.Sprintf("Control socket stopped: %s", err))
+	}
+}
+
+// Sends API requests to the node running on the data directory
+type ControlClient struct {
+	client *http.Client
+}
+
+// Connect to the control socket of a running node, failing if no node is running
+func DialControl() (*ControlClient, error) {
+	conn, err := net.DialTimeout("unix", controlSocketPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("no node is running on %s: %s", directory, err.Error())
+	}
+	conn.Close()
+	client := &http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", controlSocketPath)
+			},
+		},
+	}
+	return &ControlClient{client: client}, nil
+}
+
+// Send a request to an API endpoint, decoding the JSON response into response if it is not nil
+func (control *ControlClient) Do(method string, path string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		requestJSON, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(requestJSON)
+	}
+	httpRequest, err := http.NewRequest(method, "http://node"+path, body)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := control.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode >= 300 {
+		apiError := map[string]string{}
+		if err := json.NewDecoder(httpResponse.Body).Decode(&apiError); err == nil && apiError["error"] != "" {
+			return fmt.Errorf("%s", apiError["error"])
+		}
+		return fmt.Errorf("node answered %s", httpResponse.Status)
+	}
+	if response == nil || httpResponse.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+// Read the chain of the latest Raft snapshot in the data directory, for when no node is running.
+// Blocks committed after the snapshot are not included.
+func ReadSnapshotChain() (*models.Blockchain, *raft.SnapshotMeta, error) {
+	snapshots, err := raft.NewFileSnapshotStore(snapshotsPath, 3, io.Discard)
+	if err != nil {
+		return nil, nil, err
+	}
+	metas, err := snapshots.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(metas) == 0 {
+		return nil, nil, fmt.Errorf("no snapshot of the chain in %s", snapshotsPath)
+	}
+	meta, reader, err := snapshots.Open(metas[0].ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	state := &raftState{}
+	if err := libp2praft.DecodeSnapshot(state, reader); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot %s: %s", meta.ID, err.Error())
+	}
+	return &state.Blockchain, meta, nil
+}
+
+// Get the peer ID of the key pair in the data directory
+func LocalPeerID() (string, error) {
+	if _, err := os.Stat(dbpath); os.IsNotExist(err) {
+		return "", fmt.Errorf("no identity in %s, create one with init", directory)
+	}
+	keyPair, err := ReadKeyPair()
+	if err != nil {
+		return "", err
+	}
+	peerID, err := peer.IDFromPublicKey(keyPair.PubKey)
+	if err != nil {
+		return "", err
+	}
+	return peerID.String(), nil
+}
+
+// Write the private key of the node to a file, base64 encoded
+func ExportKeyPair(path string) error {
+	if _, err := LocalPeerID(); err != nil {
+		return err
+	}
+	keyPair, err := ReadKeyPair()
+	if err != nil {
+		return err
+	}
+	privateKey, err := libp2pcrypto.MarshalPrivateKey(keyPair.PrivKey)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, privateKey)
+}
+
+// Write a marshalled private key to a file that only the user can read, base64 encoded
+func writeKeyFile(path string, privateKey []byte) error {
+	return os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(privateKey)+"\n"), 0600)
+}
+
+// Replace the key pair of the node with a private key exported by ExportKeyPair,
+// returning the new peer ID and where the replaced key was backed up. An existing
+// identity is only replaced with force. The node must not be running.
+func ImportKeyPair(path string, force bool) (string, string, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	marshalled, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid key file %s: %s", path, err.Error())
+	}
+	privateKey, err := libp2pcrypto.UnmarshalPrivateKey(marshalled)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid key file %s: %s", path, err.Error())
+	}
+	publicKey, err := libp2pcrypto.MarshalPublicKey(privateKey.GetPublic())
+	if err != nil {
+		return "", "", err
+	}
+	peerID, err := peer.IDFromPrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", "", err
+	}
+	boltDB, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return "", "", err
+	}
+	defer boltDB.Close()
+
+	backup := ""
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("keys"))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		// The replaced key is written out before it is overwritten, so the old identity is not lost
+		if existing := bucket.Get([]byte("private")); existing != nil {
+			if !force {
+				return fmt.Errorf("an identity already exists in %s, import with -force to replace it", directory)
+			}
+			backup = fmt.Sprintf("%s/identity-%d.key", directory, time.Now().Unix())
+			if existingKey, err := libp2pcrypto.UnmarshalPrivateKey(existing); err == nil {
+				if existingID, err := peer.IDFromPrivateKey(existingKey); err == nil {
+					backup = fmt.Sprintf("%s/identity-%s-%d.key", directory, existingID, time.Now().Unix())
+				}
+			}
+			if err := writeKeyFile(backup, existing); err != nil {
+				return fmt.Errorf("back up the existing key: %s", err)
+			}
+		}
+		if err := bucket.Put([]byte("private"), marshalled); err != nil {
+			return fmt.Errorf("put: %s", err)
+		}
+		return bucket.Put([]byte("public"), publicKey)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return peerID.String(), backup, nil
+}
@@ -0,0 +1,215 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the events published on the event bus
+const (
+	EventBlockCommitted   = "blockCommitted"
+	EventPeerJoined       = "peerJoined"
+	EventPeerLeft         = "peerLeft"
+	EventPeerList         = "peerList"
+	EventLeaderChanged    = "leaderChanged"
+	EventMessageDecrypted = "messageDecrypted"
+	EventSendStatus       = "sendStatus"
+	EventSignal           = "signal"
+)
+
+// Every event type, in the order they are listed above
+var eventTypes = []string{EventBlockCommitted, EventPeerJoined, EventPeerLeft, EventPeerList, EventLeaderChanged, EventMessageDecrypted, EventSendStatus, EventSignal}
+
+const (
+	// Events a subscriber buffers before further events are dropped for it
+	defaultEventBuffer = 64
+	// Full batches the internal subscribers can buffer, every entry is published as an event of its own
+	bufferedBatches = 4
+)
+
+// Get the buffer of the subscribers inside the node, which must see every committed block
+// to acknowledge messages. It holds several full batches on top of the default buffer.
+func internalEventBuffer() int {
+	return defaultEventBuffer + bufferedBatches*batchSize()
+}
+
+// An event published on the event bus, only the field matching its type is set
+type Event struct {
+	Type      string          `json:"type"`
+	Timestamp int64           `json:"timestamp"`
+	Block     *models.Block   `json:"block,omitempty"`   // Committed block, batches are published entry by entry
+	Peer      string          `json:"peer,omitempty"`    // Peer that joined or left the mesh topic
+	Peers     []string        `json:"peers,omitempty"`   // Peers of the active room
+	Leader    *LeaderChange   `json:"leader,omitempty"`  // New Raft leader
+	Message   *models.Message `json:"message,omitempty"` // Message of one of our conversations with its payload decrypted
+	Send      *SendStatus     `json:"send,omitempty"`    // Progress of a message we sent
+	Signal    *models.Signal  `json:"signal,omitempty"`  // Accepted typing, receipt or presence signal
+}
+
+// Progress of a message we sent: sent, failed, committed, delivered or read
+type SendStatus struct {
+	MessageID string `json:"messageID,omitempty"`
+	Receiver  string `json:"receiver"`
+	Hash      string `json:"hash,omitempty"` // Hash of the message block once committed
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"` // Set if the message failed
+}
+
+// Publishes events to any number of subscribers. Publishing never blocks, a subscriber
+// that does not keep up misses the events that do not fit in its buffer.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// A subscriber of the event bus, reading the events of its types from Events
+type Subscription struct {
+	Events <-chan Event
+	events chan Event
+	name   string
+	// Types of the events delivered, every type if empty
+	types   map[string]bool
+	dropped atomic.Int64
+	bus     *EventBus
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe to the events of some types, or to every event if none are given.
+// The name identifies the subscriber in the logs.
+func (bus *EventBus) Subscribe(name string, buffer int, types ...string) *Subscription {
+	if buffer < 1 {
+		buffer = defaultEventBuffer
+	}
+	events := make(chan Event, buffer)
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		name:   name,
+		types:  make(map[string]bool),
+		bus:    bus,
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+	bus.mu.Lock()
+	bus.subscribers[sub] = struct{}{}
+	bus.mu.Unlock()
+	return sub
+}
+
+// Stop receiving events and close the Events channel
+func (sub *Subscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	if _, subscribed := sub.bus.subscribers[sub]; !subscribed {
+		return
+	}
+	delete(sub.bus.subscribers, sub)
+	close(sub.events)
+}
+
+// Publish an event to every subscriber of its type
+func (bus *EventBus) Publish(event Event) {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+	// Held for writing by Close, so no subscriber channel is closed while sending
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	for sub := range bus.subscribers {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			dropped := sub.dropped.Add(1)
+			debug.Log("events", fmt.Sprintf("Subscriber %s is full, dropped %s event (%d dropped)", sub.name, event.Type, dropped))
+		}
+	}
+}
+
+// Publish the progress of a message we sent
+func (network *Network) publishSendStatus(status SendStatus) {
+	network.Events.Publish(Event{Type: EventSendStatus, Send: &status})
+}
+
+// Get the ID and receiver of a message envelope, empty if it does not hold a message
+func envelopeMessage(envelope MessageEnvelope) (string, string) {
+	if envelope.Type != "Message" {
+		return "", ""
+	}
+	message := models.Message{}
+	if err := json.Unmarshal(envelope.Data, &message); err != nil {
+		return "", ""
+	}
+	return message.ID, message.Receiver
+}
+
+// React to committed messages and signals for this node: acknowledge messages addressed
+// to us, decrypt the messages of our conversations and follow the messages we sent
+func (network *Network) messageLoop(sub *Subscription) {
+	self := network.P2pService.Host.ID().String()
+	for event := range sub.Events {
+		switch event.Type {
+		case EventBlockCommitted:
+			if event.Block.BlockType != "message" {
+				continue
+			}
+			message := event.Block.Data.(*models.MessageData).Message
+			if message.Receiver == self {
+				sendDeliveredReceipt(network, event.Block)
+			}
+			if message.Sender == self {
+				network.publishSendStatus(SendStatus{MessageID: message.ID, Receiver: message.Receiver, Hash: event.Block.Hash, Status: "committed"})
+			}
+			if message.Sender == self || message.Receiver == self {
+				network.publishDecrypted(message)
+			}
+
+		case EventSignal:
+			signal := event.Signal
+			if signal.Type != "delivered" && signal.Type != "read" {
+				continue
+			}
+			var message *models.Message
+			network.ConsensusService.View(func(blockchain *models.Blockchain) {
+				if block := blockchain.GetBlockByHash(signal.Reference); block != nil && block.BlockType == "message" {
+					messageCopy := block.Data.(*models.MessageData).Message
+					message = &messageCopy
+				}
+			})
+			if message != nil && message.Sender == self && message.Receiver == signal.Sender {
+				network.publishSendStatus(SendStatus{MessageID: message.ID, Receiver: message.Receiver, Hash: signal.Reference, Status: signal.Type})
+			}
+		}
+	}
+}
+
+// Publish a message of an encrypted conversation with its payload decrypted
+func (network *Network) publishDecrypted(message models.Message) {
+	if message.Erased() {
+		return
+	}
+	encrypted := false
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		encrypted = blockchain.CheckPeerFirstMessage([]string{message.Sender, message.Receiver}) != nil
+	})
+	if !encrypted {
+		return
+	}
+	plaintext, err := network.DecryptMessage(message.Message, []string{message.Sender, message.Receiver})
+	if err != nil {
+		return
+	}
+	message.Message = plaintext
+	network.Events.Publish(Event{Type: EventMessageDecrypted, Message: &message})
+}
@@ -0,0 +1,435 @@
+package backend
+
+import (
+	"MessageMesh/debug"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the peers database holding the access lists
+const (
+	allowlistBucket = "allowlist"
+	blocklistBucket = "blocklist"
+)
+
+// A connection gater enforcing a persisted allowlist and blocklist of peer IDs and CIDR ranges.
+// Blocked entries always win. While the allowlist is empty every other peer is allowed,
+// otherwise a peer must match an allowed peer ID or connect from an allowed range.
+type PeerGater struct {
+	mu         sync.RWMutex
+	allowPeers map[peer.ID]bool
+	blockPeers map[peer.ID]bool
+	allowNets  map[string]*net.IPNet
+	blockNets  map[string]*net.IPNet
+}
+
+// The entries of the access lists, as shown to the UI
+type AccessList struct {
+	Allow []string `json:"allow"`
+	Block []string `json:"block"`
+}
+
+// Create a connection gater from the access lists in the peers database
+func NewPeerGater() *PeerGater {
+	gater := &PeerGater{
+		allowPeers: make(map[peer.ID]bool),
+		blockPeers: make(map[peer.ID]bool),
+		allowNets:  make(map[string]*net.IPNet),
+		blockNets:  make(map[string]*net.IPNet),
+	}
+	for _, bucket := range []string{allowlistBucket, blocklistBucket} {
+		entries, err := readAccessList(bucket)
+		if err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to Read the %s! %s", bucket, err.Error()))
+			continue
+		}
+		for _, entry := range entries {
+			if _, err := gater.set(bucket, entry, true); err != nil {
+				debug.Log("err", fmt.Sprintf("Invalid %s Entry: %s", bucket, entry))
+			}
+		}
+	}
+	return gater
+}
+
+// Parse an access list entry, either a peer ID, a CIDR range or a single IP address
+func parseAccessEntry(entry string) (peer.ID, *net.IPNet, error) {
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return "", &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", ipnet, nil
+	}
+	peerID, err := peer.Decode(entry)
+	if err != nil {
+		return "", nil, err
+	}
+	return peerID, nil, nil
+}
+
+// Add or remove an entry of the allowlist or blocklist in memory, returning its canonical form
+func (gater *PeerGater) set(bucket string, entry string, add bool) (string, error) {
+	peerID, ipnet, err := parseAccessEntry(entry)
+	if err != nil {
+		return "", err
+	}
+
+	gater.mu.Lock()
+	defer gater.mu.Unlock()
+
+	peers, nets := gater.allowPeers, gater.allowNets
+	if bucket == blocklistBucket {
+		peers, nets = gater.blockPeers, gater.blockNets
+	}
+	switch {
+	case ipnet != nil && add:
+		nets[ipnet.String()] = ipnet
+	case ipnet != nil:
+		delete(nets, ipnet.String())
+	case add:
+		peers[peerID] = true
+	default:
+		delete(peers, peerID)
+	}
+	if ipnet != nil {
+		return ipnet.String(), nil
+	}
+	return peerID.String(), nil
+}
+
+// Update an entry of the allowlist or blocklist and persist it
+func (gater *PeerGater) update(bucket string, entry string, add bool) error {
+	canonical, err := gater.set(bucket, strings.TrimSpace(entry), add)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID or CIDR range %s: %s", entry, err.Error())
+	}
+	return writeAccessEntry(bucket, canonical, add)
+}
+
+// Block a peer ID or CIDR range
+func (gater *PeerGater) Block(entry string) error {
+	return gater.update(blocklistBucket, entry, true)
+}
+
+// Remove a peer ID or CIDR range from the blocklist
+func (gater *PeerGater) Unblock(entry string) error {
+	return gater.update(blocklistBucket, entry, false)
+}
+
+// Allow a peer ID or CIDR range, once the allowlist has entries only they can connect
+func (gater *PeerGater) Allow(entry string) error {
+	return gater.update(allowlistBucket, entry, true)
+}
+
+// Remove a peer ID or CIDR range from the allowlist
+func (gater *PeerGater) Disallow(entry string) error {
+	return gater.update(allowlistBucket, entry, false)
+}
+
+// Get the entries of the allowlist and blocklist
+func (gater *PeerGater) AccessList() AccessList {
+	gater.mu.RLock()
+	defer gater.mu.RUnlock()
+
+	list := AccessList{Allow: make([]string, 0), Block: make([]string, 0)}
+	for peerID := range gater.allowPeers {
+		list.Allow = append(list.Allow, peerID.String())
+	}
+	for cidr := range gater.allowNets {
+		list.Allow = append(list.Allow, cidr)
+	}
+	for peerID := range gater.blockPeers {
+		list.Block = append(list.Block, peerID.String())
+	}
+	for cidr := range gater.blockNets {
+		list.Block = append(list.Block, cidr)
+	}
+	sort.Strings(list.Allow)
+	sort.Strings(list.Block)
+	return list
+}
+
+// Check whether an address falls in one of the ranges
+func containsAddr(nets map[string]*net.IPNet, addr multiaddr.Multiaddr) bool {
+	if addr == nil || len(nets) == 0 {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a peer connecting from an address, either may be empty when it is not known yet
+func (gater *PeerGater) allows(peerID peer.ID, addr multiaddr.Multiaddr) bool {
+	gater.mu.RLock()
+	defer gater.mu.RUnlock()
+
+	if peerID != "" && gater.blockPeers[peerID] {
+		return false
+	}
+	if containsAddr(gater.blockNets, addr) {
+		return false
+	}
+	if len(gater.allowPeers) == 0 && len(gater.allowNets) == 0 {
+		return true
+	}
+	// Without the peer ID or address the allowlist cannot be checked yet
+	if peerID == "" || addr == nil {
+		return true
+	}
+	return gater.allowPeers[peerID] || containsAddr(gater.allowNets, addr)
+}
+
+// Check a peer whose address is not known. With an allowlist the peer ID itself must be on it,
+// since no address can match an allowed range.
+func (gater *PeerGater) allowsPeer(peerID peer.ID) bool {
+	if !gater.allows(peerID, nil) {
+		return false
+	}
+	gater.mu.RLock()
+	defer gater.mu.RUnlock()
+	if len(gater.allowPeers) == 0 && len(gater.allowNets) == 0 {
+		return true
+	}
+	return gater.allowPeers[peerID]
+}
+
+// Check whether the allowlist has entries
+func (gater *PeerGater) HasAllowlist() bool {
+	gater.mu.RLock()
+	defer gater.mu.RUnlock()
+	return len(gater.allowPeers) > 0 || len(gater.allowNets) > 0
+}
+
+// Check whether a peer explicitly matches the allowlist by peer ID or address
+func (gater *PeerGater) allowlisted(peerID peer.ID, addr multiaddr.Multiaddr) bool {
+	gater.mu.RLock()
+	defer gater.mu.RUnlock()
+	return gater.allowPeers[peerID] || containsAddr(gater.allowNets, addr)
+}
+
+// InterceptPeerDial refuses to dial blocked peers
+func (gater *PeerGater) InterceptPeerDial(peerID peer.ID) bool {
+	return gater.allows(peerID, nil)
+}
+
+// InterceptAddrDial refuses to dial a peer at an address it is not allowed from
+func (gater *PeerGater) InterceptAddrDial(peerID peer.ID, addr multiaddr.Multiaddr) bool {
+	return gater.allows(peerID, addr)
+}
+
+// InterceptAccept refuses inbound connections from blocked ranges
+func (gater *PeerGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return gater.allows("", addrs.RemoteMultiaddr())
+}
+
+// InterceptSecured refuses connections once the remote peer ID is known
+func (gater *PeerGater) InterceptSecured(direction network.Direction, peerID peer.ID, addrs network.ConnMultiaddrs) bool {
+	allowed := gater.allows(peerID, addrs.RemoteMultiaddr())
+	if !allowed {
+		debug.Log("gater", fmt.Sprintf("Refused Connection with %s at %s", peerID.String(), addrs.RemoteMultiaddr().String()))
+	}
+	return allowed
+}
+
+// InterceptUpgraded accepts every connection that was secured
+func (gater *PeerGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// Check whether a peer may take part in the mesh, using the addresses it is connected from
+func (p2p *P2PService) PeerAllowed(peerID peer.ID) bool {
+	conns := p2p.Host.Network().ConnsToPeer(peerID)
+	if len(conns) == 0 {
+		return p2p.Gater.allowsPeer(peerID)
+	}
+	for _, conn := range conns {
+		if p2p.Gater.allows(peerID, conn.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a peer explicitly matches the allowlist on one of its connections
+func (p2p *P2PService) PeerAllowlisted(peerID peer.ID) bool {
+	if p2p.Gater.allowlisted(peerID, nil) {
+		return true
+	}
+	for _, conn := range p2p.Host.Network().ConnsToPeer(peerID) {
+		if p2p.Gater.allowlisted(peerID, conn.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Block a peer ID or CIDR range and disconnect it right away
+func (network *Network) BlockPeer(entry string) error {
+	if err := network.P2pService.Gater.Block(entry); err != nil {
+		return err
+	}
+	debug.Log("gater", "Blocked "+entry)
+	network.EnforceAccessList()
+	return nil
+}
+
+// Unblock a peer ID or CIDR range, it can connect again
+func (network *Network) UnblockPeer(entry string) error {
+	if err := network.P2pService.Gater.Unblock(entry); err != nil {
+		return err
+	}
+	debug.Log("gater", "Unblocked "+entry)
+	return nil
+}
+
+// Allow a peer ID or CIDR range, disconnecting peers that are no longer allowed
+func (network *Network) AllowPeer(entry string) error {
+	if err := network.P2pService.Gater.Allow(entry); err != nil {
+		return err
+	}
+	debug.Log("gater", "Allowed "+entry)
+	network.EnforceAccessList()
+	return nil
+}
+
+// Remove a peer ID or CIDR range from the allowlist, disconnecting it if others remain allowed
+func (network *Network) DisallowPeer(entry string) error {
+	if err := network.P2pService.Gater.Disallow(entry); err != nil {
+		return err
+	}
+	debug.Log("gater", "Disallowed "+entry)
+	network.EnforceAccessList()
+	return nil
+}
+
+// Apply the access lists to live connections and to the Raft configuration
+func (network *Network) EnforceAccessList() {
+	disallowed := make(map[peer.ID]bool)
+	for _, conn := range network.P2pService.Host.Network().Conns() {
+		if !network.P2pService.Gater.allows(conn.RemotePeer(), conn.RemoteMultiaddr()) {
+			disallowed[conn.RemotePeer()] = true
+		}
+	}
+	for peerID := range disallowed {
+		debug.Log("gater", fmt.Sprintf("Disconnecting Peer: %s", peerID.String()))
+		if err := network.P2pService.Host.Network().ClosePeer(peerID); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to Disconnect Peer %s! %s", peerID.String(), err.Error()))
+		}
+	}
+
+	// Only the leader changes the cluster configuration
+	if network.ConsensusService == nil || network.ConsensusService.Raft == nil {
+		return
+	}
+	raftInstance := network.ConsensusService.Raft
+	if raftInstance.State() != raft.Leader {
+		return
+	}
+	future := raftInstance.GetConfiguration()
+	if err := future.Error(); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to get configuration: %s", err))
+		return
+	}
+	for _, server := range future.Configuration().Servers {
+		peerID, err := peer.Decode(string(server.ID))
+		if err != nil || peerID == network.PubSubService.SelfID() {
+			continue
+		}
+		if !disallowed[peerID] && network.P2pService.PeerAllowed(peerID) {
+			continue
+		}
+		debug.Log("raft", fmt.Sprintf("Removing disallowed server: %s", peerID))
+		if err := raftInstance.RemoveServer(server.ID, 0, 5*time.Second).Error(); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to remove server: %s", err))
+		}
+	}
+
+	// Fill the voter slots that were freed
+	network.ConsensusService.Membership.Reconcile()
+}
+
+// Get all entries of an access list bucket
+func readAccessList(bucket string) ([]string, error) {
+	entries := make([]string, 0)
+
+	peersDBMutex.Lock()
+	defer peersDBMutex.Unlock()
+
+	if _, err := os.Stat(peersdbpath); os.IsNotExist(err) {
+		return entries, nil
+	}
+	boltDB, err := bolt.Open(peersdbpath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer boltDB.Close()
+
+	err = boltDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key []byte, value []byte) error {
+			entries = append(entries, string(key))
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Add or remove an entry of an access list bucket
+func writeAccessEntry(bucket string, entry string, add bool) error {
+	peersDBMutex.Lock()
+	defer peersDBMutex.Unlock()
+
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	boltDB, err := bolt.Open(peersdbpath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer boltDB.Close()
+
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		if !add {
+			return b.Delete([]byte(entry))
+		}
+		return b.Put([]byte(entry), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
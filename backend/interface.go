@@ -3,14 +3,17 @@ package backend
 import (
 	"MessageMesh/backend/models"
 	"context"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/raft"
-	host "github.com/libp2p/go-libp2p-core/host"
-	"github.com/libp2p/go-libp2p-core/peer"
-	discovery "github.com/libp2p/go-libp2p-discovery"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	libp2praft "github.com/libp2p/go-libp2p-raft"
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	discovery "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 )
 
 type Network struct {
@@ -20,6 +23,8 @@ type Network struct {
 	PubSubService *PubSubService
 	// Consensus Service (Raft consensus)
 	ConsensusService *ConsensusService
+	// Event bus the services publish to, and the UI and APIs subscribe to
+	Events *EventBus
 }
 
 type P2PService struct {
@@ -31,23 +36,25 @@ type P2PService struct {
 	KadDHT *dht.IpfsDHT
 	// Discovery
 	Discovery *discovery.RoutingDiscovery
+	// Local network discovery
+	Mdns mdns.Service
+	// Allowlist and blocklist of peers
+	Gater *PeerGater
 	// PubSub
 	PubSub *pubsub.PubSub
 }
 
 type PubSubService struct {
-	// Topic
+	// Active room topic
 	Topic string
 	// Listen to new messages
-	Inbound chan any
+	Inbound chan InboundPacket
+	// Inbound ephemeral signals (typing, receipts, presence), the accepted ones are published as events
+	Signals chan models.Signal
 	// Send messages
 	Outbound chan any
-	// Listen to new peers
-	PeerJoin chan peer.ID
-	// Listen to peer leave
-	PeerLeave chan peer.ID
-	// List of peer IDs
-	PeerIDs chan []peer.ID
+	// Publishes peers joining and leaving, and the peer list of the active room
+	events *EventBus
 	// Self peer ID
 	selfid peer.ID
 	// Context
@@ -58,19 +65,45 @@ type PubSubService struct {
 	pstopic *pubsub.Topic
 	// PubSub subscription
 	psub *pubsub.Subscription
+	// PubSub router used to join rooms
+	pubsub *pubsub.PubSub
+	// Joined room topics by name
+	rooms map[string]*pubSubRoom
+	// Guards Topic and rooms
+	mu sync.RWMutex
 }
 
 type ConsensusService struct {
-	// Listen to latest block in blockchain
-	LatestBlock chan models.Block
-	// Blockchain
+	// Blockchain, read it through View or Query
 	Blockchain *models.Blockchain
-	// Consensus connected
-	Connected chan bool
+	// State of the Raft FSM holding the blockchain
+	state *raftState
+	// Shared by the FSM applying blocks and the queries reading them
+	chainLock sync.RWMutex
 	// Raft instance
 	Raft *raft.Raft
 	// Libp2p Raft actor
 	Actor *libp2praft.Actor
 	// Libp2p Raft consensus
 	Consensus *libp2praft.Consensus
+	// Raft membership policy
+	Membership *Membership
+	// Batches the ops the leader commits
+	batcher *opBatcher
+	// How this node takes part in consensus: voter or observer
+	Mode string
+	// How queries read the chain: local or linearizable
+	ReadConsistency string
+	// Stops the loops of the Raft instance
+	stop chan struct{}
+	// Notified when a snapshot was installed
+	restored chan struct{}
+	// Held while the chain is resynced
+	resyncMu   sync.Mutex
+	lastResync time.Time
+	// Leader whose chain failed verification, it is not resynced from while it leads
+	invalidLeader peer.ID
+	// Peers found in other clusters
+	conflictsMu sync.Mutex
+	conflicts   map[peer.ID]ClusterConflict
 }
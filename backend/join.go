@@ -0,0 +1,256 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+	libp2pnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Stream protocol a node asks to join the cluster on
+	joinProtocol = protocol.ID("/messagemesh/join/1.0.0")
+	// Timeout of a single join request
+	joinTimeout = 5 * time.Second
+	// Delay between join attempts while no cluster has been found
+	joinRetryInterval = 5 * time.Second
+	// How long a founding node looks for an existing cluster before bootstrapping a new one
+	foundMeshTimeout = 30 * time.Second
+	// Largest join message accepted
+	maxJoinMessageSize = 64 * 1024
+)
+
+type joinRequest struct {
+	Proof    string `json:"proof,omitempty"`    // Proof of an invitation token, see admissionProof
+	Observer bool   `json:"observer,omitempty"` // Join as a non-voting observer
+}
+
+type joinServer struct {
+	ID       string `json:"id"`
+	Suffrage string `json:"suffrage"`
+}
+
+type joinResponse struct {
+	Leader  string       `json:"leader"`  // Peer ID of the current leader, empty if unknown
+	Servers []joinServer `json:"servers"` // Current Raft configuration
+	Member  bool         `json:"member"`  // Whether the requester is part of the configuration
+}
+
+// Answer a join request with the leader and configuration. The leader also adds the requester,
+// other nodes record its admission so any future leader knows it.
+func (network *Network) handleJoin(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	remote := stream.Conn().RemotePeer()
+
+	request := joinRequest{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&request); err != nil {
+		debug.Log("err", fmt.Sprintf("Invalid join request from %s: %s", remote, err))
+		stream.Reset()
+		return
+	}
+	if !network.P2pService.PeerAllowed(remote) {
+		debug.Log("raft", fmt.Sprintf("Refused join request from disallowed peer: %s", remote))
+		stream.Reset()
+		return
+	}
+
+	consensusService := network.ConsensusService
+	membership := consensusService.Membership
+	membership.checkAdmission(remote, request.Proof)
+	membership.setObserver(remote, request.Observer)
+
+	if consensusService.Raft.State() == raft.Leader {
+		if err := membership.Add(remote); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to add joining peer %s: %s", remote, err))
+		}
+	}
+
+	response := joinResponse{
+		Leader:  string(consensusService.Raft.Leader()),
+		Servers: make([]joinServer, 0),
+	}
+	if configuration, err := membership.configuration(); err == nil {
+		for _, server := range configuration.Servers {
+			response.Servers = append(response.Servers, joinServer{ID: string(server.ID), Suffrage: server.Suffrage.String()})
+			if server.ID == raft.ServerID(remote.String()) {
+				response.Member = true
+			}
+		}
+	}
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer join request from %s: %s", remote, err))
+	}
+}
+
+// Ask a peer to join its cluster
+func (network *Network) requestJoin(peerID peer.ID) (joinResponse, error) {
+	response := joinResponse{}
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, joinTimeout)
+	defer cancel()
+
+	// The leader may not be connected yet, look it up in the DHT
+	host := network.P2pService.Host
+	if host.Network().Connectedness(peerID) != libp2pnetwork.Connected && len(host.Peerstore().Addrs(peerID)) == 0 {
+		peerinfo, err := network.P2pService.KadDHT.FindPeer(ctx, peerID)
+		if err != nil {
+			return response, err
+		}
+		host.Peerstore().AddAddrs(peerinfo.ID, peerinfo.Addrs, time.Hour)
+	}
+
+	stream, err := host.NewStream(ctx, peerID, joinProtocol)
+	if err != nil {
+		return response, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+
+	request := joinRequest{Observer: network.ConsensusService.Mode == observerMode}
+	if debug.JoinToken != "" {
+		request.Proof = admissionProof(debug.JoinToken, host.ID())
+	}
+	if err := json.NewEncoder(stream).Encode(request); err != nil {
+		return response, err
+	}
+	err = json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&response)
+	return response, err
+}
+
+// Check whether this node is part of a Raft configuration
+func (network *Network) joined() bool {
+	return network.ConsensusService.Membership.isMember(network.P2pService.Host.ID())
+}
+
+// Join an existing cluster through the mesh peers, or only through the target peer if set,
+// following them to the leader. A new cluster is only bootstrapped when FOUND_MESH is set,
+// no peer reported a cluster and this node was not part of one before.
+func (network *Network) joinCluster(target peer.ID, stop chan struct{}) {
+	started := time.Now()
+	// Whether a peer reported a configuration, a cluster exists even when it has no leader right now
+	sawServers := false
+	for !network.joined() {
+		peers := network.PubSubService.PeerList()
+		if target != "" {
+			peers = []peer.ID{target}
+		}
+		for _, peerID := range peers {
+			response, err := network.requestJoin(peerID)
+			if err != nil {
+				debug.Log("raft", fmt.Sprintf("Join request to %s failed: %s", peerID, err))
+				continue
+			}
+			debug.Log("raft", fmt.Sprintf("Peer %s reports leader %q with %d servers", peerID, response.Leader, len(response.Servers)))
+			if len(response.Servers) > 0 {
+				sawServers = true
+			}
+			if response.Member || response.Leader == "" || response.Leader == peerID.String() {
+				continue
+			}
+
+			// Ask the leader directly
+			leaderID, err := peer.Decode(response.Leader)
+			if err != nil || leaderID == network.P2pService.Host.ID() {
+				continue
+			}
+			if _, err := network.requestJoin(leaderID); err != nil {
+				debug.Log("raft", fmt.Sprintf("Join request to leader %s failed: %s", leaderID, err))
+			}
+		}
+
+		// Wait for the leader to replicate the configuration to us
+		select {
+		case <-stop:
+			return
+		case <-time.After(joinRetryInterval):
+		}
+		if network.joined() {
+			break
+		}
+
+		if target != "" {
+			continue
+		}
+		// An observer cannot vote, so it could never elect itself the leader of a new cluster
+		if debug.FoundMesh && network.ConsensusService.Mode == observerMode {
+			debug.Log("raft", "Observers cannot found a mesh, waiting for a cluster to join")
+		} else if debug.FoundMesh && time.Since(started) > foundMeshTimeout {
+			if sawServers {
+				debug.Log("raft", "A cluster exists but could not be joined yet, retrying")
+			} else if clusterID := network.restoredClusterID(); clusterID != "" {
+				debug.Log("raft", fmt.Sprintf("This node belongs to cluster %s, waiting for its peers", clusterID))
+			} else {
+				network.foundCluster()
+				return
+			}
+		} else if !debug.FoundMesh {
+			debug.Log("raft", "No cluster found yet, set FOUND_MESH=true to found a new mesh")
+		}
+	}
+	debug.Log("raft", "Joined the cluster")
+}
+
+// Get the ID of the cluster of a chain restored from a snapshot, empty if the node never was in one
+func (network *Network) restoredClusterID() string {
+	clusterID := ""
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		clusterID = blockchain.ClusterID()
+	})
+	return clusterID
+}
+
+// Bootstrap a new cluster with this node as its only voter, then commit a genesis block
+// with a new cluster ID so that nodes of different clusters can tell each other apart
+func (network *Network) foundCluster() {
+	self := network.P2pService.Host.ID().String()
+	debug.Log("raft", "Bootstrapping new cluster as founding node")
+	raftInstance := network.ConsensusService.Raft
+	future := raftInstance.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(self),
+			Address:  raft.ServerAddress(self),
+		}},
+	})
+	if err := future.Error(); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to bootstrap the cluster: %s", err))
+		return
+	}
+
+	// A single voter elects itself
+	deadline := time.Now().Add(foundMeshTimeout)
+	for raftInstance.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			debug.Log("err", "Founding node did not become the leader")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	clusterID := make([]byte, 16)
+	if _, err := rand.Read(clusterID); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to generate a cluster ID: %s", err))
+		return
+	}
+	op := &raftOP{
+		Type: "FOUND_CLUSTER",
+		Genesis: &models.GenesisData{
+			ClusterID: hex.EncodeToString(clusterID),
+			Founder:   self,
+			Founded:   time.Now().Unix(),
+		},
+	}
+	if _, err := network.ConsensusService.Consensus.CommitOp(op); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to commit the genesis block: %s", err))
+	}
+}
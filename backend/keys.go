@@ -11,8 +11,8 @@ import (
 	"os"
 	"sort"
 
-	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
-	"github.com/libp2p/go-libp2p-core/peer"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -201,6 +201,23 @@ func VerifySignature(plaintext []byte, sig []byte, pubKey libp2pcrypto.PubKey) (
 	return verification, nil
 }
 
+// VerifyPeerSignature checks that a marshalled public key belongs to the peer ID
+// and that the signature over the data was made with it
+func VerifyPeerSignature(peerIDStr string, data []byte, sig []byte, marshalledPubKey []byte) (bool, error) {
+	pubKey, err := libp2pcrypto.UnmarshalPublicKey(marshalledPubKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal public key: %s", err.Error())
+	}
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode peer ID: %s", err.Error())
+	}
+	if !peerID.MatchesPublicKey(pubKey) {
+		return false, fmt.Errorf("public key does not belong to peer %s", peerIDStr)
+	}
+	return VerifySignature(data, sig, pubKey)
+}
+
 func (keypair *KeyPair) EncryptWithPublicKey(plaintext []byte) ([]byte, error) {
 	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, keypair.PublicKey.(*rsa.PublicKey), plaintext)
 	if err != nil {
@@ -0,0 +1,297 @@
+package backend
+
+import (
+	"MessageMesh/debug"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+	libp2pnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	// Stream protocol nodes report their uptime, progress and latency on
+	statusProtocol = protocol.ID("/messagemesh/status/1.0.0")
+
+	defaultLeadershipPolicy   = "uptime"
+	defaultLeadershipInterval = 5 * time.Minute
+	// A candidate must beat the leader's latency by this factor, so leadership does not flap
+	latencyHysteresis = 0.8
+)
+
+// When this node started
+var startedAt = time.Now()
+
+// The status a node reports to its peers
+type NodeStatus struct {
+	PeerID       string  `json:"peerID"`
+	Mode         string  `json:"mode"`         // voter or observer
+	State        string  `json:"state"`        // Raft state: Leader, Follower, Candidate or Shutdown
+	StartedAt    int64   `json:"startedAt"`    // Unix time the node started
+	AppliedIndex uint64  `json:"appliedIndex"` // Last Raft index applied to the chain
+	Latency      float64 `json:"latency"`      // Mean latency to the other voters in milliseconds, 0 if unknown
+}
+
+// A change of the Raft leader
+type LeaderChange struct {
+	Leader    string `json:"leader"` // Peer ID of the new leader, empty while there is none
+	IsSelf    bool   `json:"isSelf"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Get the leadership policy from LEADERSHIP_POLICY: stay, uptime, latency or rotate
+func leadershipPolicy() string {
+	switch debug.LeadershipPolicy {
+	case "":
+		return defaultLeadershipPolicy
+	case "stay", "uptime", "latency", "rotate":
+		return debug.LeadershipPolicy
+	default:
+		debug.Log("err", fmt.Sprintf("Invalid LEADERSHIP_POLICY %s, using %s", debug.LeadershipPolicy, defaultLeadershipPolicy))
+		return defaultLeadershipPolicy
+	}
+}
+
+// Get how often the leadership policy is evaluated from LEADERSHIP_INTERVAL
+func leadershipInterval() time.Duration {
+	if debug.LeadershipInterval == "" {
+		return defaultLeadershipInterval
+	}
+	interval, err := time.ParseDuration(debug.LeadershipInterval)
+	if err != nil || interval <= 0 {
+		debug.Log("err", fmt.Sprintf("Invalid LEADERSHIP_INTERVAL %s, using %s", debug.LeadershipInterval, defaultLeadershipInterval))
+		return defaultLeadershipInterval
+	}
+	return interval
+}
+
+// Get the status of this node
+func (network *Network) NodeStatus() NodeStatus {
+	raftInstance := network.ConsensusService.Raft
+	appliedIndex, _ := strconv.ParseUint(raftInstance.Stats()["applied_index"], 10, 64)
+	return NodeStatus{
+		PeerID:       network.P2pService.Host.ID().String(),
+		Mode:         network.ConsensusService.Mode,
+		State:        raftInstance.State().String(),
+		StartedAt:    startedAt.Unix(),
+		AppliedIndex: appliedIndex,
+		Latency:      network.meanVoterLatency(),
+	}
+}
+
+// Get the mean latency to the other voters as recorded by the peerstore
+func (network *Network) meanVoterLatency() float64 {
+	configuration, err := network.ConsensusService.Membership.configuration()
+	if err != nil {
+		return 0
+	}
+	self := network.P2pService.Host.ID()
+	total, count := time.Duration(0), 0
+	for _, server := range configuration.Servers {
+		peerID, err := peer.Decode(string(server.ID))
+		if err != nil || peerID == self || server.Suffrage != raft.Voter {
+			continue
+		}
+		if latency := network.P2pService.Host.Peerstore().LatencyEWMA(peerID); latency > 0 {
+			total += latency
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return float64(total.Milliseconds()) / float64(count)
+}
+
+// Answer a status request
+func (network *Network) handleStatus(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	if err := json.NewEncoder(stream).Encode(network.NodeStatus()); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer status request: %s", err))
+	}
+}
+
+// Ask a peer for its status
+func (network *Network) requestStatus(peerID peer.ID) (NodeStatus, error) {
+	status := NodeStatus{}
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, joinTimeout)
+	defer cancel()
+
+	stream, err := network.P2pService.Host.NewStream(ctx, peerID, statusProtocol)
+	if err != nil {
+		return status, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	err = json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&status)
+	return status, err
+}
+
+// Ping the other voters so the peerstore latencies stay fresh
+func (network *Network) pingVoters() {
+	configuration, err := network.ConsensusService.Membership.configuration()
+	if err != nil {
+		return
+	}
+	self := network.P2pService.Host.ID()
+	for _, server := range configuration.Servers {
+		peerID, err := peer.Decode(string(server.ID))
+		if err != nil || peerID == self || server.Suffrage != raft.Voter {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(network.P2pService.Ctx, joinTimeout)
+		// Ping records the round trip time in the peerstore
+		result := <-ping.Ping(ctx, network.P2pService.Host, peerID)
+		cancel()
+		if result.Error != nil {
+			debug.Log("raft", fmt.Sprintf("Failed to ping voter %s: %s", peerID, result.Error))
+		}
+	}
+}
+
+// Get the status of every voter that has applied everything the leader committed.
+// Nodes that are behind never become the leader.
+func (network *Network) caughtUpVoters() []NodeStatus {
+	raftInstance := network.ConsensusService.Raft
+	commitIndex, _ := strconv.ParseUint(raftInstance.Stats()["commit_index"], 10, 64)
+	configuration, err := network.ConsensusService.Membership.configuration()
+	if err != nil {
+		return nil
+	}
+
+	self := network.P2pService.Host.ID()
+	candidates := make([]NodeStatus, 0)
+	for _, server := range configuration.Servers {
+		peerID, err := peer.Decode(string(server.ID))
+		if err != nil || peerID == self || server.Suffrage != raft.Voter {
+			continue
+		}
+		status, err := network.requestStatus(peerID)
+		if err != nil {
+			debug.Log("raft", fmt.Sprintf("Status request to %s failed: %s", peerID, err))
+			continue
+		}
+		if status.AppliedIndex < commitIndex {
+			debug.Log("raft", fmt.Sprintf("Voter %s is behind: applied %d of %d", peerID, status.AppliedIndex, commitIndex))
+			continue
+		}
+		candidates = append(candidates, status)
+	}
+	return candidates
+}
+
+// Pick the voter the policy prefers over this node, if any
+func (network *Network) leadershipCandidate(policy string) (NodeStatus, bool) {
+	self := network.NodeStatus()
+	best, found := NodeStatus{}, false
+	for _, candidate := range network.caughtUpVoters() {
+		switch policy {
+		case "uptime":
+			if candidate.StartedAt < self.StartedAt && (!found || candidate.StartedAt < best.StartedAt) {
+				best, found = candidate, true
+			}
+		case "latency":
+			if candidate.Latency > 0 && self.Latency > 0 && candidate.Latency < self.Latency*latencyHysteresis && (!found || candidate.Latency < best.Latency) {
+				best, found = candidate, true
+			}
+		case "rotate":
+			if !found {
+				best, found = candidate, true
+			}
+		}
+	}
+	return best, found
+}
+
+// Transfer leadership to a voter, or to the voter the policy prefers if the peer ID is empty.
+// Only the leader can transfer, and never to a voter that is behind.
+func (network *Network) TransferLeadership(peerIDStr string) error {
+	raftInstance := network.ConsensusService.Raft
+	if raftInstance.State() != raft.Leader {
+		return fmt.Errorf("not the leader, the leader is %s", raftInstance.Leader())
+	}
+
+	if peerIDStr == "" {
+		policy := leadershipPolicy()
+		if policy == "stay" {
+			policy = "rotate"
+		}
+		candidate, found := network.leadershipCandidate(policy)
+		if !found {
+			return fmt.Errorf("no voter is a better leader")
+		}
+		peerIDStr = candidate.PeerID
+	} else {
+		caughtUp := false
+		for _, candidate := range network.caughtUpVoters() {
+			if candidate.PeerID == peerIDStr {
+				caughtUp = true
+			}
+		}
+		if !caughtUp {
+			return fmt.Errorf("%s is not a voter that is up to date", peerIDStr)
+		}
+	}
+
+	debug.Log("raft", fmt.Sprintf("Transferring leadership to %s", peerIDStr))
+	return raftInstance.LeadershipTransferToServer(raft.ServerID(peerIDStr), raft.ServerAddress(peerIDStr)).Error()
+}
+
+// Evaluate the leadership policy periodically and report leader changes
+func leadershipLoop(network *Network, raftInstance *raft.Raft, stop chan struct{}) {
+	policy, interval := leadershipPolicy(), leadershipInterval()
+	debug.Log("raft", fmt.Sprintf("Leadership policy: %s every %s", policy, interval))
+
+	observations := make(chan raft.Observation, 8)
+	observer := raft.NewObserver(observations, false, func(observation *raft.Observation) bool {
+		_, ok := observation.Data.(raft.LeaderObservation)
+		return ok
+	})
+	raftInstance.RegisterObserver(observer)
+	defer raftInstance.DeregisterObserver(observer)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-observations:
+			// The observation does not expose the leader in this Raft version
+			leader := string(raftInstance.Leader())
+			debug.Log("raft", fmt.Sprintf("Leader changed: %q", leader))
+			change := LeaderChange{
+				Leader:    leader,
+				IsSelf:    leader == network.P2pService.Host.ID().String(),
+				Timestamp: time.Now().Unix(),
+			}
+			network.Events.Publish(Event{Type: EventLeaderChanged, Leader: &change})
+
+		case <-ticker.C:
+			if policy == "latency" {
+				network.pingVoters()
+			}
+			if policy == "stay" || raftInstance.State() != raft.Leader {
+				continue
+			}
+			candidate, found := network.leadershipCandidate(policy)
+			if !found {
+				continue
+			}
+			debug.Log("raft", fmt.Sprintf("Policy %s prefers %s as leader", policy, candidate.PeerID))
+			if err := raftInstance.LeadershipTransferToServer(raft.ServerID(candidate.PeerID), raft.ServerAddress(candidate.PeerID)).Error(); err != nil {
+				debug.Log("err", fmt.Sprintf("Failed to transfer leadership: %s", err))
+			}
+		}
+	}
+}
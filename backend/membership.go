@@ -0,0 +1,374 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// Bucket of the peers database holding admitted peers
+	admittedBucket = "admitted"
+	// Bucket of the peers database holding observer nodes
+	observersBucket = "observers"
+
+	defaultMaxVoters         = 5
+	defaultMemberGracePeriod = 2 * time.Minute
+	// Timeout of membership changes
+	membershipTimeout = 5 * time.Second
+)
+
+// The Raft membership policy applied by the leader. Admitted peers become voters
+// until the maximum is reached, every other peer and every observer node replicates
+// the chain as a non-voter.
+// Disconnected peers keep their membership for a grace period before they are removed.
+type Membership struct {
+	network      *Network
+	raft         *raft.Raft
+	maxVoters    int
+	gracePeriod  time.Duration
+	inviteTokens []string
+
+	mu        sync.Mutex
+	admitted  map[peer.ID]bool
+	observers map[peer.ID]bool
+	pending   map[peer.ID]*time.Timer
+}
+
+// Create the membership policy
+func NewMembership(network *Network, raftInstance *raft.Raft) *Membership {
+	membership := &Membership{
+		network:      network,
+		raft:         raftInstance,
+		maxVoters:    maxVoters(),
+		gracePeriod:  memberGracePeriod(),
+		inviteTokens: inviteTokens(),
+		admitted:     make(map[peer.ID]bool),
+		observers:    make(map[peer.ID]bool),
+		pending:      make(map[peer.ID]*time.Timer),
+	}
+
+	entries, err := readAccessList(admittedBucket)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Read the Admitted Peers! %s", err.Error()))
+	}
+	for _, entry := range entries {
+		if peerID, err := peer.Decode(entry); err == nil {
+			membership.admitted[peerID] = true
+		}
+	}
+
+	entries, err = readAccessList(observersBucket)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Read the Observer Peers! %s", err.Error()))
+	}
+	for _, entry := range entries {
+		if peerID, err := peer.Decode(entry); err == nil {
+			membership.observers[peerID] = true
+		}
+	}
+
+	debug.Log("raft", fmt.Sprintf("Membership policy: %d voters, %s grace period, %d invitation tokens, open admission %t", membership.maxVoters, membership.gracePeriod, len(membership.inviteTokens), debug.OpenAdmission))
+	return membership
+}
+
+// Get the maximum number of voters from MAX_VOTERS
+func maxVoters() int {
+	if debug.MaxVoters == "" {
+		return defaultMaxVoters
+	}
+	voters, err := strconv.Atoi(debug.MaxVoters)
+	if err != nil || voters < 1 {
+		debug.Log("err", fmt.Sprintf("Invalid MAX_VOTERS %s, using %d", debug.MaxVoters, defaultMaxVoters))
+		return defaultMaxVoters
+	}
+	return voters
+}
+
+// Get the removal grace period from MEMBER_GRACE_PERIOD
+func memberGracePeriod() time.Duration {
+	if debug.MemberGracePeriod == "" {
+		return defaultMemberGracePeriod
+	}
+	grace, err := time.ParseDuration(debug.MemberGracePeriod)
+	if err != nil || grace < 0 {
+		debug.Log("err", fmt.Sprintf("Invalid MEMBER_GRACE_PERIOD %s, using %s", debug.MemberGracePeriod, defaultMemberGracePeriod))
+		return defaultMemberGracePeriod
+	}
+	return grace
+}
+
+// Get the invitation tokens from INVITE_TOKENS
+func inviteTokens() []string {
+	tokens := make([]string, 0)
+	for _, token := range strings.Split(debug.InviteTokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Prove knowledge of an invitation token without revealing it, bound to the peer presenting it
+func admissionProof(token string, peerID peer.ID) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(peerID.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check whether a peer may become a voter. Only the founder of the cluster, allowlisted peers
+// and peers that presented an invitation token are admitted, unless OPEN_ADMISSION is set.
+func (membership *Membership) Admitted(peerID peer.ID) bool {
+	if debug.OpenAdmission {
+		return true
+	}
+	if membership.founder() == peerID.String() || membership.network.P2pService.PeerAllowlisted(peerID) {
+		return true
+	}
+	membership.mu.Lock()
+	defer membership.mu.Unlock()
+	return membership.admitted[peerID]
+}
+
+// Get the peer ID of the founder of the cluster
+func (membership *Membership) founder() string {
+	founder := ""
+	membership.network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		founder = blockchain.Founder()
+	})
+	return founder
+}
+
+// Record a peer that presented a valid invitation
+func (membership *Membership) admit(peerID peer.ID) {
+	membership.mu.Lock()
+	membership.admitted[peerID] = true
+	membership.mu.Unlock()
+
+	if err := writeAccessEntry(admittedBucket, peerID.String(), true); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Save the Admitted Peer! %s", err.Error()))
+	}
+	debug.Log("raft", fmt.Sprintf("Admitted peer: %s", peerID))
+}
+
+// Check whether a peer is admitted, admitting it if it proves knowledge of an invitation token.
+// Every node records admitted peers so any future leader knows them.
+func (membership *Membership) checkAdmission(peerID peer.ID, proof string) bool {
+	if membership.Admitted(peerID) {
+		return true
+	}
+	if proof == "" || !membership.network.P2pService.PeerAllowed(peerID) {
+		return false
+	}
+	for _, token := range membership.inviteTokens {
+		if hmac.Equal([]byte(proof), []byte(admissionProof(token, peerID))) {
+			membership.admit(peerID)
+			return true
+		}
+	}
+	debug.Log("raft", fmt.Sprintf("Refused admission of peer: %s", peerID))
+	return false
+}
+
+// Check whether a peer joined as an observer, observers never become voters
+func (membership *Membership) Observer(peerID peer.ID) bool {
+	membership.mu.Lock()
+	defer membership.mu.Unlock()
+	return membership.observers[peerID]
+}
+
+// Record the mode a peer joined with. Every node records observers so any future leader knows them.
+func (membership *Membership) setObserver(peerID peer.ID, observer bool) {
+	membership.mu.Lock()
+	changed := membership.observers[peerID] != observer
+	if observer {
+		membership.observers[peerID] = true
+	} else {
+		delete(membership.observers, peerID)
+	}
+	membership.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if err := writeAccessEntry(observersBucket, peerID.String(), observer); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Save the Observer Peer! %s", err.Error()))
+	}
+	debug.Log("raft", fmt.Sprintf("Peer %s joins as observer: %t", peerID, observer))
+}
+
+// Handle a peer joining the mesh topic, cancelling its pending removal
+func (membership *Membership) PeerJoined(peerID peer.ID) {
+	membership.mu.Lock()
+	if timer, ok := membership.pending[peerID]; ok {
+		timer.Stop()
+		delete(membership.pending, peerID)
+		debug.Log("raft", fmt.Sprintf("Peer rejoined within the grace period: %s", peerID))
+	}
+	membership.mu.Unlock()
+
+	// A returning non-voter may fill a free voter slot
+	if membership.raft.State() == raft.Leader && membership.isMember(peerID) {
+		membership.Reconcile()
+	}
+}
+
+// Add a peer that asked to join, as a voter if it is admitted and a slot is free
+func (membership *Membership) Add(peerID peer.ID) error {
+	if membership.raft.State() != raft.Leader {
+		return fmt.Errorf("not the leader")
+	}
+	configuration, err := membership.configuration()
+	if err != nil {
+		return err
+	}
+	for _, server := range configuration.Servers {
+		if server.ID != raft.ServerID(peerID.String()) {
+			continue
+		}
+		// A voter that restarted as an observer gives up its vote
+		if server.Suffrage == raft.Voter && membership.Observer(peerID) {
+			debug.Log("raft", fmt.Sprintf("Demoting observer: %s", peerID))
+			if err := membership.raft.DemoteVoter(server.ID, 0, membershipTimeout).Error(); err != nil {
+				return err
+			}
+		}
+		membership.Reconcile()
+		return nil
+	}
+
+	if !membership.Observer(peerID) && membership.Admitted(peerID) && countVoters(configuration) < membership.maxVoters {
+		debug.Log("raft", fmt.Sprintf("Adding voter: %s", peerID))
+		return membership.raft.AddVoter(raft.ServerID(peerID.String()), raft.ServerAddress(peerID.String()), 0, membershipTimeout).Error()
+	}
+	debug.Log("raft", fmt.Sprintf("Adding non-voter: %s", peerID))
+	return membership.raft.AddNonvoter(raft.ServerID(peerID.String()), raft.ServerAddress(peerID.String()), 0, membershipTimeout).Error()
+}
+
+// Handle a peer leaving the mesh topic, it is removed once the grace period has passed
+func (membership *Membership) PeerLeft(peerID peer.ID) {
+	membership.mu.Lock()
+	defer membership.mu.Unlock()
+
+	if _, ok := membership.pending[peerID]; ok {
+		return
+	}
+	membership.pending[peerID] = time.AfterFunc(membership.gracePeriod, func() {
+		membership.mu.Lock()
+		delete(membership.pending, peerID)
+		membership.mu.Unlock()
+		membership.remove(peerID)
+	})
+}
+
+// Remove a peer that did not come back, then fill its voter slot
+func (membership *Membership) remove(peerID peer.ID) {
+	if membership.raft.State() != raft.Leader {
+		return
+	}
+	if membership.network.P2pService.Host.Network().Connectedness(peerID) == network.Connected && membership.inMesh(peerID) {
+		return
+	}
+
+	debug.Log("raft", fmt.Sprintf("Removing server after the grace period: %s", peerID))
+	future := membership.raft.RemoveServer(raft.ServerID(peerID.String()), 0, membershipTimeout)
+	if err := future.Error(); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to remove server: %s", err))
+		return
+	}
+	membership.Reconcile()
+}
+
+// Promote admitted non-voters that are not observers while there are free voter slots
+func (membership *Membership) Reconcile() {
+	if membership.raft.State() != raft.Leader {
+		return
+	}
+	configuration, err := membership.configuration()
+	if err != nil {
+		return
+	}
+
+	voters := countVoters(configuration)
+	candidates := make([]string, 0)
+	for _, server := range configuration.Servers {
+		if server.Suffrage == raft.Nonvoter {
+			candidates = append(candidates, string(server.ID))
+		}
+	}
+	sort.Strings(candidates)
+
+	for _, candidate := range candidates {
+		if voters >= membership.maxVoters {
+			return
+		}
+		peerID, err := peer.Decode(candidate)
+		if err != nil || !membership.inMesh(peerID) || !membership.network.P2pService.PeerAllowed(peerID) || !membership.Admitted(peerID) || membership.Observer(peerID) {
+			continue
+		}
+		debug.Log("raft", fmt.Sprintf("Promoting non-voter: %s", peerID))
+		future := membership.raft.AddVoter(raft.ServerID(candidate), raft.ServerAddress(candidate), 0, membershipTimeout)
+		if err := future.Error(); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to promote non-voter: %s", err))
+			continue
+		}
+		voters++
+	}
+}
+
+// Get the current Raft configuration
+func (membership *Membership) configuration() (raft.Configuration, error) {
+	future := membership.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to get configuration: %s", err))
+		return raft.Configuration{}, err
+	}
+	return future.Configuration(), nil
+}
+
+// Check whether a peer is in the Raft configuration
+func (membership *Membership) isMember(peerID peer.ID) bool {
+	configuration, err := membership.configuration()
+	if err != nil {
+		return false
+	}
+	for _, server := range configuration.Servers {
+		if server.ID == raft.ServerID(peerID.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a peer is subscribed to the mesh topic
+func (membership *Membership) inMesh(peerID peer.ID) bool {
+	for _, meshPeer := range membership.network.PubSubService.PeerList() {
+		if meshPeer == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// Count the voters of a configuration
+func countVoters(configuration raft.Configuration) int {
+	voters := 0
+	for _, server := range configuration.Servers {
+		if server.Suffrage == raft.Voter {
+			voters++
+		}
+	}
+	return voters
+}
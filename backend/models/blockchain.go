@@ -4,8 +4,10 @@ import (
 	"MessageMesh/debug"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"time"
 )
 
@@ -14,14 +16,23 @@ type BlockData interface {
 	CalculateDataHash() string
 }
 
+// Block data with a shape that must be checked before it can be hashed
+type shapedData interface {
+	CheckShape() error
+}
+
 // Base Block struct
 type Block struct {
-	Index     int       `json:"Index"`
-	Timestamp int64     `json:"Timestamp"`
-	PrevHash  string    `json:"PrevHash"`
-	Hash      string    `json:"Hash"`
-	BlockType string    `json:"BlockType"`
-	Data      BlockData `json:"Data"`
+	Index     int    `json:"Index"`
+	Timestamp int64  `json:"Timestamp"`
+	PrevHash  string `json:"PrevHash"`
+	Hash      string `json:"Hash"`
+	BlockType string `json:"BlockType"`
+	// Merkle root over the payloads of the block, so one payload can be proven without the others
+	MerkleRoot string    `json:"MerkleRoot"`
+	Data       BlockData `json:"Data"`
+	// Entries of a batch block in commit order. An entry carries the index of its block and a hash of its own.
+	Entries []*Block `json:"Entries,omitempty"`
 }
 
 // MessageData implements BlockData
@@ -30,17 +41,60 @@ type MessageData struct {
 }
 
 func (md *MessageData) CalculateDataHash() string {
-	return md.Sender + md.Receiver + md.Message.Message + md.Timestamp
+	return md.Sender + md.Receiver + md.Message.PayloadDigest() + md.Timestamp + md.ID + md.ReplyTo
+}
+
+// ReactionData implements BlockData
+type ReactionData struct {
+	Reaction
+}
+
+func (rd *ReactionData) CalculateDataHash() string {
+	return rd.MessageID + rd.Sender + rd.Emoji + strconv.FormatBool(rd.Remove) + rd.Timestamp
 }
 
 type FirstMessageData struct {
 	FirstMessage
 }
 
+// A first message is between exactly two peers
+func (md *FirstMessageData) CheckShape() error {
+	if len(md.PeerIDs) != 2 {
+		return fmt.Errorf("first message has %d peer IDs instead of 2", len(md.PeerIDs))
+	}
+	return nil
+}
+
 func (md *FirstMessageData) CalculateDataHash() string {
 	return md.PeerIDs[0] + md.PeerIDs[1] + hex.EncodeToString(md.SymetricKey0) + hex.EncodeToString(md.SymetricKey1)
 }
 
+// EditData implements BlockData
+type EditData struct {
+	MessageEdit
+}
+
+func (ed *EditData) CalculateDataHash() string {
+	return ed.Sender + strconv.Itoa(ed.TargetIndex) + ed.TargetHash + ed.MessageEdit.PayloadDigest() + ed.Timestamp + hex.EncodeToString(ed.Signature)
+}
+
+// RetentionData implements BlockData
+type RetentionData struct {
+	Retention
+}
+
+// A retention setting is for a conversation between exactly two peers
+func (rd *RetentionData) CheckShape() error {
+	if len(rd.PeerIDs) != 2 {
+		return fmt.Errorf("retention has %d peer IDs instead of 2", len(rd.PeerIDs))
+	}
+	return nil
+}
+
+func (rd *RetentionData) CalculateDataHash() string {
+	return rd.PeerIDs[0] + rd.PeerIDs[1] + strconv.Itoa(rd.ExpireAfterHours) + strconv.Itoa(rd.KeepLast) + rd.Setter + rd.Timestamp
+}
+
 // AccountData implements BlockData
 type AccountData struct {
 	Account
@@ -50,34 +104,237 @@ func (ad *AccountData) CalculateDataHash() string {
 	return ad.Username + ad.PublicKey
 }
 
-// Updated CalculateHash method for Block
+// GenesisData implements BlockData, it identifies the cluster that founded the chain
+type GenesisData struct {
+	ClusterID string `json:"clusterID"`
+	Founder   string `json:"founder"` // Peer ID of the founding node
+	Founded   int64  `json:"founded"`
+}
+
+func (gd *GenesisData) CalculateDataHash() string {
+	return gd.ClusterID + gd.Founder
+}
+
+// Updated CalculateHash method for Block. The data is covered through the Merkle root,
+// so the hash of a block can be checked from its header alone.
 func (b *Block) CalculateHash() string {
-	record := string(b.Index) + string(b.Timestamp) + b.PrevHash + b.BlockType
-	if b.Data != nil {
-		record += b.Data.CalculateDataHash()
-	}
+	record := strconv.Itoa(b.Index) + strconv.FormatInt(b.Timestamp, 10) + b.PrevHash + b.BlockType + b.MerkleRoot
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
 	return hex.EncodeToString(hashed)
 }
 
+// Get the leaves of the Merkle tree of the block, one per payload
+func (b *Block) Leaves() []string {
+	if b.BlockType == "batch" {
+		leaves := make([]string, len(b.Entries))
+		for i, entry := range b.Entries {
+			if entry.Data != nil {
+				leaves[i] = EntryHash(b.Index, i, entry.BlockType, entry.Data.CalculateDataHash())
+			}
+		}
+		return leaves
+	}
+	if b.Data == nil {
+		return nil
+	}
+	return []string{b.Data.CalculateDataHash()}
+}
+
+// Hash of the entry at a position of a batch block
+func EntryHash(index int, position int, blockType string, dataHash string) string {
+	hash := sha256.Sum256([]byte(strconv.Itoa(index) + strconv.Itoa(position) + blockType + dataHash))
+	return hex.EncodeToString(hash[:])
+}
+
+func (b *Block) CalculateMerkleRoot() string {
+	return MerkleRoot(b.Leaves())
+}
+
+// Set the Merkle root and the hash of a new block
+func (b *Block) seal() {
+	b.MerkleRoot = b.CalculateMerkleRoot()
+	b.Hash = b.CalculateHash()
+}
+
+// Get the header of the block
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		Index:      b.Index,
+		Timestamp:  b.Timestamp,
+		PrevHash:   b.PrevHash,
+		BlockType:  b.BlockType,
+		MerkleRoot: b.MerkleRoot,
+		Hash:       b.Hash,
+	}
+}
+
+// Decode a block, picking the type of its data from the block type
+func (b *Block) UnmarshalJSON(data []byte) error {
+	type blockFields Block
+	raw := struct {
+		*blockFields
+		Data json.RawMessage `json:"Data"`
+	}{blockFields: (*blockFields)(b)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var blockData BlockData
+	switch b.BlockType {
+	case "message":
+		blockData = &MessageData{}
+	case "account":
+		blockData = &AccountData{}
+	case "firstMessage":
+		blockData = &FirstMessageData{}
+	case "edit", "delete":
+		blockData = &EditData{}
+	case "reaction":
+		blockData = &ReactionData{}
+	case "retention":
+		blockData = &RetentionData{}
+	case "genesis":
+		blockData = &GenesisData{}
+	case "checkpoint":
+		blockData = &CheckpointData{}
+	case "batch":
+		// The payloads of a batch block are in its entries
+		if len(raw.Data) != 0 && string(raw.Data) != "null" {
+			return fmt.Errorf("batch block %d carries data", b.Index)
+		}
+	default:
+		return fmt.Errorf("unknown block type %s", b.BlockType)
+	}
+
+	// The genesis block of a cluster that is not founded yet has no data
+	if len(raw.Data) == 0 || string(raw.Data) == "null" {
+		b.Data = nil
+		return nil
+	}
+	if err := json.Unmarshal(raw.Data, blockData); err != nil {
+		return err
+	}
+	// Blocks from other peers are hashed to verify them, which malformed data would break
+	if shaped, ok := blockData.(shapedData); ok {
+		if err := shaped.CheckShape(); err != nil {
+			return fmt.Errorf("%s block %d: %s", b.BlockType, b.Index, err.Error())
+		}
+	}
+	b.Data = blockData
+	return nil
+}
+
+// Encode a block for Raft snapshots, which cannot decode the data interface otherwise
+func (b *Block) MarshalBinary() ([]byte, error) {
+	type blockFields Block
+	return json.Marshal((*blockFields)(b))
+}
+
+// Decode a block of a Raft snapshot
+func (b *Block) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, b)
+}
+
+// Copy a block and its data, so it stays unchanged while the chain erases expired payloads
+func (b *Block) Copy() *Block {
+	copied := *b
+	switch data := b.Data.(type) {
+	case *MessageData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *AccountData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *FirstMessageData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *EditData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *ReactionData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *RetentionData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *GenesisData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	case *CheckpointData:
+		dataCopy := *data
+		copied.Data = &dataCopy
+	}
+	if b.Entries != nil {
+		copied.Entries = make([]*Block, len(b.Entries))
+		for i, entry := range b.Entries {
+			copied.Entries[i] = entry.Copy()
+		}
+	}
+	return &copied
+}
+
 type Blockchain struct {
 	Chain []*Block
 }
 
+// Create the genesis block of a cluster that is not founded yet, it is the same on every node
 func CreateGenesisBlock() *Block {
 	block := &Block{
 		Index:     0,
-		Timestamp: time.Now().Unix(),
+		Timestamp: 0,
 		PrevHash:  "0",
 		BlockType: "genesis",
 		Data:      nil,
 	}
-	block.Hash = block.CalculateHash()
+	block.seal()
+	return block
+}
+
+// Create the genesis block of a founded cluster, it is the same on every node of the cluster
+func CreateClusterGenesisBlock(genesis GenesisData) *Block {
+	block := &Block{
+		Index:     0,
+		Timestamp: genesis.Founded,
+		PrevHash:  "0",
+		BlockType: "genesis",
+		Data:      &genesis,
+	}
+	block.seal()
 	return block
 }
 
+// Get the ID of the cluster that founded the chain, empty until it is founded
+func (bc *Blockchain) ClusterID() string {
+	if len(bc.Chain) == 0 {
+		return ""
+	}
+	if genesisData, ok := bc.Chain[0].Data.(*GenesisData); ok {
+		return genesisData.ClusterID
+	}
+	return ""
+}
+
+// Get the peer ID of the node that founded the cluster of the chain, empty before it is founded
+func (bc *Blockchain) Founder() string {
+	if len(bc.Chain) == 0 {
+		return ""
+	}
+	if genesisData, ok := bc.Chain[0].Data.(*GenesisData); ok {
+		return genesisData.Founder
+	}
+	return ""
+}
+
+// Get the hash of the genesis block
+func (bc *Blockchain) GenesisHash() string {
+	if len(bc.Chain) == 0 {
+		return ""
+	}
+	return bc.Chain[0].Hash
+}
+
 func (bc *Blockchain) GetMessageBlock(index int) *Block {
 	block := bc.Chain[index]
 	if block.BlockType != "message" {
@@ -86,16 +343,17 @@ func (bc *Blockchain) GetMessageBlock(index int) *Block {
 	return block
 }
 
-func (bc *Blockchain) AddMessageBlock(message Message) *Block {
+// Add a message block. Its timestamp is chosen by the leader, so the block is the same on every node.
+func (bc *Blockchain) AddMessageBlock(message Message, timestamp int64) *Block {
 	prevBlock := bc.Chain[len(bc.Chain)-1]
 	newBlock := &Block{
 		Index:     prevBlock.Index + 1,
-		Timestamp: time.Now().Unix(),
+		Timestamp: timestamp,
 		PrevHash:  prevBlock.Hash,
 		BlockType: "message",
 		Data:      &MessageData{Message: message},
 	}
-	newBlock.Hash = newBlock.CalculateHash()
+	newBlock.seal()
 	bc.Chain = append(bc.Chain, newBlock)
 	return newBlock
 }
@@ -108,31 +366,31 @@ func (bc *Blockchain) GetAccountBlock(index int) *Block {
 	return block
 }
 
-func (bc *Blockchain) AddAccountBlock(account Account) *Block {
+func (bc *Blockchain) AddAccountBlock(account Account, timestamp int64) *Block {
 	prevBlock := bc.Chain[len(bc.Chain)-1]
 	newBlock := &Block{
 		Index:     prevBlock.Index + 1,
-		Timestamp: time.Now().Unix(),
+		Timestamp: timestamp,
 		PrevHash:  prevBlock.Hash,
 		BlockType: "account",
 		Data:      &AccountData{Account: account},
 	}
-	newBlock.Hash = newBlock.CalculateHash()
+	newBlock.seal()
 	bc.Chain = append(bc.Chain, newBlock)
 	return newBlock
 }
 
-func (bc *Blockchain) AddFirstMessageBlock(firstMessage FirstMessage) *Block {
+func (bc *Blockchain) AddFirstMessageBlock(firstMessage FirstMessage, timestamp int64) *Block {
 	prevBlock := bc.Chain[len(bc.Chain)-1]
 	sort.Strings(firstMessage.PeerIDs)
 	newBlock := &Block{
 		Index:     prevBlock.Index + 1,
-		Timestamp: time.Now().Unix(),
+		Timestamp: timestamp,
 		PrevHash:  prevBlock.Hash,
 		BlockType: "firstMessage",
 		Data:      &FirstMessageData{FirstMessage: firstMessage},
 	}
-	newBlock.Hash = newBlock.CalculateHash()
+	newBlock.seal()
 	bc.Chain = append(bc.Chain, newBlock)
 	return newBlock
 }
@@ -145,30 +403,340 @@ func (bc *Blockchain) GetFirstMessageBlock(index int) *Block {
 	return block
 }
 
+func (bc *Blockchain) AddEditBlock(edit MessageEdit, timestamp int64) *Block {
+	prevBlock := bc.Chain[len(bc.Chain)-1]
+	newBlock := &Block{
+		Index:     prevBlock.Index + 1,
+		Timestamp: timestamp,
+		PrevHash:  prevBlock.Hash,
+		BlockType: "edit",
+		Data:      &EditData{MessageEdit: edit},
+	}
+	newBlock.seal()
+	bc.Chain = append(bc.Chain, newBlock)
+	return newBlock
+}
+
+func (bc *Blockchain) AddDeleteBlock(edit MessageEdit, timestamp int64) *Block {
+	prevBlock := bc.Chain[len(bc.Chain)-1]
+	newBlock := &Block{
+		Index:     prevBlock.Index + 1,
+		Timestamp: timestamp,
+		PrevHash:  prevBlock.Hash,
+		BlockType: "delete",
+		Data:      &EditData{MessageEdit: edit},
+	}
+	newBlock.seal()
+	bc.Chain = append(bc.Chain, newBlock)
+	return newBlock
+}
+
+func (bc *Blockchain) AddReactionBlock(reaction Reaction, timestamp int64) *Block {
+	prevBlock := bc.Chain[len(bc.Chain)-1]
+	newBlock := &Block{
+		Index:     prevBlock.Index + 1,
+		Timestamp: timestamp,
+		PrevHash:  prevBlock.Hash,
+		BlockType: "reaction",
+		Data:      &ReactionData{Reaction: reaction},
+	}
+	newBlock.seal()
+	bc.Chain = append(bc.Chain, newBlock)
+	return newBlock
+}
+
+// Add a checkpoint block, signed by the leader over the chain up to its height
+func (bc *Blockchain) AddCheckpointBlock(checkpoint CheckpointData, timestamp int64) *Block {
+	prevBlock := bc.Chain[len(bc.Chain)-1]
+	newBlock := &Block{
+		Index:     prevBlock.Index + 1,
+		Timestamp: timestamp,
+		PrevHash:  prevBlock.Hash,
+		BlockType: "checkpoint",
+		Data:      &CheckpointData{ClusterID: checkpoint.ClusterID, Height: checkpoint.Height, ChainRoot: checkpoint.ChainRoot, Signer: checkpoint.Signer, PublicKey: checkpoint.PublicKey, Signature: checkpoint.Signature},
+	}
+	newBlock.seal()
+	bc.Chain = append(bc.Chain, newBlock)
+	return newBlock
+}
+
+// Start a batch block. Entries added to it are visible to the chain right away,
+// so every entry is validated against the ones before it.
+func (bc *Blockchain) OpenBatch(timestamp int64) *Block {
+	prevBlock := bc.Chain[len(bc.Chain)-1]
+	batch := &Block{
+		Index:     prevBlock.Index + 1,
+		Timestamp: timestamp,
+		PrevHash:  prevBlock.Hash,
+		BlockType: "batch",
+		Entries:   make([]*Block, 0),
+	}
+	bc.Chain = append(bc.Chain, batch)
+	return batch
+}
+
+// Add an entry to an open batch block
+func (b *Block) AddEntry(blockType string, data BlockData) *Block {
+	entry := &Block{
+		Index:     b.Index,
+		Timestamp: b.Timestamp,
+		BlockType: blockType,
+		Data:      data,
+		Hash:      EntryHash(b.Index, len(b.Entries), blockType, data.CalculateDataHash()),
+	}
+	b.Entries = append(b.Entries, entry)
+	return entry
+}
+
+// Seal the open batch block, or remove it if none of its entries were valid
+func (bc *Blockchain) CloseBatch() *Block {
+	batch := bc.Chain[len(bc.Chain)-1]
+	if len(batch.Entries) == 0 {
+		bc.Chain = bc.Chain[:len(bc.Chain)-1]
+		return nil
+	}
+	batch.seal()
+	return batch
+}
+
+// Get the blocks of the chain with batch blocks replaced by their entries, in commit order
+func (bc *Blockchain) Entries() []*Block {
+	entries := make([]*Block, 0, len(bc.Chain))
+	for _, block := range bc.Chain {
+		if block.BlockType == "batch" {
+			entries = append(entries, block.Entries...)
+		} else {
+			entries = append(entries, block)
+		}
+	}
+	return entries
+}
+
+// Get the Merkle root over the hashes of the blocks up to a height
+func (bc *Blockchain) ChainRoot(height int) string {
+	if height < 0 || height >= len(bc.Chain) {
+		return ""
+	}
+	hashes := make([]string, height+1)
+	for i, block := range bc.Chain[:height+1] {
+		hashes[i] = block.Hash
+	}
+	return MerkleRoot(hashes)
+}
+
+// Get the latest checkpoint, nil if there is none
+func (bc *Blockchain) LatestCheckpoint() *CheckpointData {
+	for i := len(bc.Chain) - 1; i >= 0; i-- {
+		if checkpoint, ok := bc.Chain[i].Data.(*CheckpointData); ok {
+			return checkpoint
+		}
+	}
+	return nil
+}
+
+// Build the inclusion proof of a message, through the first checkpoint covering its block
+func (bc *Blockchain) InclusionProof(messageID string) (*InclusionProof, error) {
+	entry := bc.GetMessageByID(messageID)
+	if entry == nil {
+		return nil, fmt.Errorf("message %s is not in the chain", messageID)
+	}
+	block, position := bc.Chain[entry.Index], 0
+	for i, batched := range block.Entries {
+		if batched == entry {
+			position = i
+		}
+	}
+	payloadPath, err := MerklePath(block.Leaves(), position)
+	if err != nil {
+		return nil, err
+	}
+	proof := &InclusionProof{
+		Message:     entry.Data.(*MessageData).Message,
+		Header:      block.Header(),
+		LeafIndex:   position,
+		PayloadPath: payloadPath,
+	}
+
+	for _, later := range bc.Chain[block.Index+1:] {
+		checkpoint, ok := later.Data.(*CheckpointData)
+		if !ok || checkpoint.Height < block.Index {
+			continue
+		}
+		hashes := make([]string, checkpoint.Height+1)
+		for i, covered := range bc.Chain[:checkpoint.Height+1] {
+			hashes[i] = covered.Hash
+		}
+		chainPath, err := MerklePath(hashes, block.Index)
+		if err != nil {
+			return nil, err
+		}
+		checkpointCopy := *checkpoint
+		proof.Checkpoint = &checkpointCopy
+		proof.ChainPath = chainPath
+		break
+	}
+	return proof, nil
+}
+
+func (bc *Blockchain) AddRetentionBlock(retention Retention, timestamp int64) *Block {
+	prevBlock := bc.Chain[len(bc.Chain)-1]
+	sort.Strings(retention.PeerIDs)
+	newBlock := &Block{
+		Index:     prevBlock.Index + 1,
+		Timestamp: timestamp,
+		PrevHash:  prevBlock.Hash,
+		BlockType: "retention",
+		Data:      &RetentionData{Retention: retention},
+	}
+	newBlock.seal()
+	bc.Chain = append(bc.Chain, newBlock)
+	return newBlock
+}
+
+// Get the message block with the given message ID
+func (bc *Blockchain) GetMessageByID(id string) *Block {
+	if id == "" {
+		return nil
+	}
+	for _, block := range bc.Entries() {
+		if block.BlockType == "message" && block.Data.(*MessageData).ID == id {
+			return block
+		}
+	}
+	return nil
+}
+
+// Get the block or batch entry with the given hash
+func (bc *Blockchain) GetBlockByHash(hash string) *Block {
+	for _, block := range bc.Entries() {
+		if block.Hash == hash {
+			return block
+		}
+	}
+	return nil
+}
+
 func (bc *Blockchain) GetLatestBlock() *Block {
 	return bc.Chain[len(bc.Chain)-1]
 }
 
 func (bc *Blockchain) IsValid() bool {
-	for i := 1; i < len(bc.Chain); i++ {
-		currentBlock := bc.Chain[i]
-		previousBlock := bc.Chain[i-1]
+	return bc.Verify() == nil
+}
+
+// The first block of a chain that failed verification
+type ChainFault struct {
+	Index            int    `json:"index"`
+	BlockType        string `json:"blockType"`
+	Hash             string `json:"hash"`
+	ExpectedHash     string `json:"expectedHash,omitempty"` // Hash calculated from the content of the block
+	PrevHash         string `json:"prevHash"`
+	ExpectedPrevHash string `json:"expectedPrevHash,omitempty"` // Hash of the block before it
+	Reason           string `json:"reason"`
+}
 
-		if currentBlock.Hash != currentBlock.CalculateHash() {
-			return false
+func (fault *ChainFault) Error() string {
+	return fmt.Sprintf("block %d (%s) is invalid: %s", fault.Index, fault.BlockType, fault.Reason)
+}
+
+// Check the entries of a batch block, returning why they are invalid or empty if they are valid
+func (b *Block) checkEntries() string {
+	if b.Data != nil || len(b.Entries) == 0 {
+		return "the batch block has no entries"
+	}
+	for position, entry := range b.Entries {
+		switch entry.BlockType {
+		case "genesis", "batch", "checkpoint":
+			return fmt.Sprintf("entry %d is a %s block", position, entry.BlockType)
+		}
+		if entry.Data == nil {
+			return fmt.Sprintf("entry %d has no data", position)
 		}
+		if entry.Index != b.Index || entry.Timestamp != b.Timestamp {
+			return fmt.Sprintf("entry %d does not belong to the block", position)
+		}
+		if entry.Hash != EntryHash(b.Index, position, entry.BlockType, entry.Data.CalculateDataHash()) {
+			return fmt.Sprintf("entry %d does not match its hash", position)
+		}
+	}
+	return ""
+}
 
-		if currentBlock.PrevHash != previousBlock.Hash {
-			return false
+// Verify every block of the chain, returning the first invalid one or nil if the chain is valid
+func (bc *Blockchain) Verify() *ChainFault {
+	if len(bc.Chain) == 0 {
+		return &ChainFault{Reason: "the chain has no genesis block"}
+	}
+	prevHash := ""
+	for i, block := range bc.Chain {
+		if fault := block.check(i, prevHash); fault != nil {
+			return fault
 		}
+		if checkpoint, ok := block.Data.(*CheckpointData); ok {
+			if checkpoint.Height >= i || checkpoint.ChainRoot != bc.ChainRoot(checkpoint.Height) {
+				return &ChainFault{
+					Index:     block.Index,
+					BlockType: block.BlockType,
+					Hash:      block.Hash,
+					PrevHash:  block.PrevHash,
+					Reason:    fmt.Sprintf("the checkpoint does not match the chain up to block %d", checkpoint.Height),
+				}
+			}
+		}
+		prevHash = block.Hash
 	}
-	return true
+	return nil
+}
+
+// Check a block at a position of the chain that follows the block with prevHash
+func (b *Block) check(index int, prevHash string) *ChainFault {
+	fault := &ChainFault{
+		Index:     b.Index,
+		BlockType: b.BlockType,
+		Hash:      b.Hash,
+		PrevHash:  b.PrevHash,
+	}
+	if b.Index != index {
+		fault.Reason = fmt.Sprintf("block is at position %d", index)
+		return fault
+	}
+	if index == 0 {
+		if b.BlockType != "genesis" || b.PrevHash != "0" {
+			fault.Reason = "the first block is not a genesis block"
+			return fault
+		}
+	} else {
+		if b.BlockType == "batch" {
+			if reason := b.checkEntries(); reason != "" {
+				fault.Reason = reason
+				return fault
+			}
+		} else if b.BlockType == "genesis" || b.Data == nil {
+			fault.Reason = "the block has no data"
+			return fault
+		}
+		if b.PrevHash != prevHash {
+			fault.ExpectedPrevHash = prevHash
+			fault.Reason = "the block does not follow the block before it"
+			return fault
+		}
+	}
+	if expected := b.CalculateMerkleRoot(); b.MerkleRoot != expected {
+		fault.Reason = "the payloads of the block do not match its Merkle root"
+		return fault
+	}
+	if expected := b.CalculateHash(); b.Hash != expected {
+		fault.ExpectedHash = expected
+		fault.Reason = "the content of the block does not match its hash"
+		return fault
+	}
+	return nil
 }
 
 // Check if the blockchain has a first message block with a specific peer
 func (bc *Blockchain) CheckPeerFirstMessage(peerIDs []string) *FirstMessage {
 	// Loop through the blockchain
-	for _, block := range bc.Chain {
+	for _, block := range bc.Entries() {
 		if block.BlockType == "firstMessage" {
 			sort.Strings(peerIDs)
 			if block.Data.(*FirstMessageData).PeerIDs[0] == peerIDs[0] && block.Data.(*FirstMessageData).PeerIDs[1] == peerIDs[1] {
@@ -179,3 +747,227 @@ func (bc *Blockchain) CheckPeerFirstMessage(peerIDs []string) *FirstMessage {
 	}
 	return nil
 }
+
+// Check that an edit or delete targets an existing, not yet deleted message block
+// and that it was issued by the sender of that message
+func (bc *Blockchain) CheckMessageEdit(edit *MessageEdit) error {
+	if edit.TargetIndex <= 0 || edit.TargetIndex >= len(bc.Chain) {
+		return fmt.Errorf("edit target %d is not on the chain", edit.TargetIndex)
+	}
+	// The target is the block itself or one of its batch entries
+	target := bc.Chain[edit.TargetIndex]
+	for _, entry := range target.Entries {
+		if entry.Hash == edit.TargetHash {
+			target = entry
+		}
+	}
+	if target.BlockType != "message" {
+		return fmt.Errorf("edit target %d is not a message block", edit.TargetIndex)
+	}
+	if target.Hash != edit.TargetHash {
+		return fmt.Errorf("edit target hash does not match block %d", edit.TargetIndex)
+	}
+	if target.Data.(*MessageData).Sender != edit.Sender {
+		return fmt.Errorf("only the sender of a message can edit or delete it")
+	}
+	for _, block := range bc.Entries() {
+		if block.BlockType == "delete" && block.Data.(*EditData).TargetHash == edit.TargetHash {
+			return fmt.Errorf("message %s has already been deleted", edit.TargetHash)
+		}
+	}
+	return nil
+}
+
+// Get the message blocks with their edits and deletes applied.
+// Deleted messages are left out and edited messages carry their latest text.
+func (bc *Blockchain) EffectiveMessages() []*Message {
+	// Latest edit or delete for every message block hash
+	latest := make(map[string]*Block)
+	for _, block := range bc.Entries() {
+		if block.BlockType == "edit" || block.BlockType == "delete" {
+			latest[block.Data.(*EditData).TargetHash] = block
+		}
+	}
+
+	messages := make([]*Message, 0)
+	for _, block := range bc.Entries() {
+		if block.BlockType != "message" {
+			continue
+		}
+		message := block.Data.(*MessageData).Message
+		if message.Erased() {
+			continue
+		}
+		if edit, ok := latest[block.Hash]; ok {
+			if edit.BlockType == "delete" {
+				continue
+			}
+			message.Message = edit.Data.(*EditData).Message
+			message.Edited = true
+		}
+		messages = append(messages, &message)
+	}
+	return messages
+}
+
+// Get the original message block followed by every edit and delete block for it
+func (bc *Blockchain) MessageHistory(hash string) []*Block {
+	history := make([]*Block, 0)
+	for _, block := range bc.Entries() {
+		if block.BlockType == "message" && block.Hash == hash {
+			history = append(history, block)
+		}
+		if (block.BlockType == "edit" || block.BlockType == "delete") && block.Data.(*EditData).TargetHash == hash {
+			history = append(history, block)
+		}
+	}
+	return history
+}
+
+// Get a message and every reply below it, in chain order.
+// Edits and deletes are applied, so deleted messages are left out.
+func (bc *Blockchain) Thread(messageID string) []*Message {
+	// Replies always come after the message they reply to, so one pass is enough
+	inThread := map[string]bool{messageID: true}
+	for _, block := range bc.Entries() {
+		if block.BlockType == "message" {
+			message := block.Data.(*MessageData).Message
+			if message.ReplyTo != "" && inThread[message.ReplyTo] {
+				inThread[message.ID] = true
+			}
+		}
+	}
+
+	thread := make([]*Message, 0)
+	for _, message := range bc.EffectiveMessages() {
+		if inThread[message.ID] {
+			thread = append(thread, message)
+		}
+	}
+	return thread
+}
+
+// Count the reactions on a message per emoji, a sender is counted once per emoji
+func (bc *Blockchain) Reactions(messageID string) map[string]int {
+	// Latest reaction state per sender and emoji
+	reacted := make(map[[2]string]bool)
+	for _, block := range bc.Entries() {
+		if block.BlockType != "reaction" {
+			continue
+		}
+		reaction := block.Data.(*ReactionData).Reaction
+		if reaction.MessageID == messageID {
+			reacted[[2]string{reaction.Sender, reaction.Emoji}] = !reaction.Remove
+		}
+	}
+
+	counts := make(map[string]int)
+	for key, active := range reacted {
+		if active {
+			counts[key[1]]++
+		}
+	}
+	return counts
+}
+
+// Check whether the latest reaction of a sender with an emoji on a message is active
+func (bc *Blockchain) HasReaction(messageID string, sender string, emoji string) bool {
+	active := false
+	for _, block := range bc.Entries() {
+		if block.BlockType != "reaction" {
+			continue
+		}
+		reaction := block.Data.(*ReactionData).Reaction
+		if reaction.MessageID == messageID && reaction.Sender == sender && reaction.Emoji == emoji {
+			active = !reaction.Remove
+		}
+	}
+	return active
+}
+
+// Check whether an edit or delete with the same signature is on the chain
+func (bc *Blockchain) HasMessageEdit(edit *MessageEdit) bool {
+	for _, block := range bc.Entries() {
+		if block.BlockType != "edit" && block.BlockType != "delete" {
+			continue
+		}
+		existing := block.Data.(*EditData).MessageEdit
+		if existing.TargetHash == edit.TargetHash && string(existing.Signature) == string(edit.Signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the latest retention setting for the conversation between two peers
+func (bc *Blockchain) GetRetention(peerIDs []string) *Retention {
+	sort.Strings(peerIDs)
+	var retention *Retention
+	for _, block := range bc.Entries() {
+		if block.BlockType == "retention" {
+			setting := &block.Data.(*RetentionData).Retention
+			if setting.PeerIDs[0] == peerIDs[0] && setting.PeerIDs[1] == peerIDs[1] {
+				retention = setting
+			}
+		}
+	}
+	return retention
+}
+
+// Erase the payloads of messages that have expired under their conversation's
+// retention setting, including the edits made to them. The block hashes stay verifiable.
+// Returns the number of messages erased.
+func (bc *Blockchain) ApplyRetention(now time.Time) int {
+	// Latest retention setting per conversation
+	settings := make(map[string]*Retention)
+	for _, block := range bc.Entries() {
+		if block.BlockType == "retention" {
+			setting := &block.Data.(*RetentionData).Retention
+			settings[setting.PeerIDs[0]+setting.PeerIDs[1]] = setting
+		}
+	}
+	if len(settings) == 0 {
+		return 0
+	}
+
+	// Message blocks per conversation, oldest first
+	conversations := make(map[string][]*Block)
+	for _, block := range bc.Entries() {
+		if block.BlockType == "message" {
+			message := block.Data.(*MessageData).Message
+			peerIDs := []string{message.Sender, message.Receiver}
+			sort.Strings(peerIDs)
+			conversations[peerIDs[0]+peerIDs[1]] = append(conversations[peerIDs[0]+peerIDs[1]], block)
+		}
+	}
+
+	expired := make(map[string]bool)
+	for key, setting := range settings {
+		blocks := conversations[key]
+		for i, block := range blocks {
+			tooOld := setting.ExpireAfterHours > 0 && now.Sub(time.Unix(block.Timestamp, 0)) > time.Duration(setting.ExpireAfterHours)*time.Hour
+			tooMany := setting.KeepLast > 0 && i < len(blocks)-setting.KeepLast
+			if tooOld || tooMany {
+				expired[block.Hash] = true
+			}
+		}
+	}
+
+	erased := 0
+	for _, block := range bc.Entries() {
+		switch block.BlockType {
+		case "message":
+			messageData := block.Data.(*MessageData)
+			if expired[block.Hash] && !messageData.Message.Erased() {
+				messageData.Message.Erase()
+				erased++
+			}
+		case "edit":
+			editData := block.Data.(*EditData)
+			if expired[editData.TargetHash] && editData.MessageEdit.Message != "" {
+				editData.MessageEdit.Erase()
+			}
+		}
+	}
+	return erased
+}
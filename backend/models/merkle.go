@@ -0,0 +1,171 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Leaves and inner nodes are hashed with different prefixes, so an inner node can never pass as a leaf
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// One sibling on the path from a leaf to the Merkle root
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // Whether the sibling is on the left of the path
+}
+
+func merkleLeaf(leaf string) string {
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, leaf...))
+	return hex.EncodeToString(hash[:])
+}
+
+func merkleNode(left string, right string) string {
+	hash := sha256.Sum256(append(append([]byte{merkleNodePrefix}, left...), right...))
+	return hex.EncodeToString(hash[:])
+}
+
+// Get the Merkle root of a list of leaves, empty if there are none.
+// A node without a sibling is carried up a level unchanged.
+func MerkleRoot(leaves []string) string {
+	if len(leaves) == 0 {
+		return ""
+	}
+	level := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	for len(level) > 1 {
+		next := make([]string, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Get the siblings on the path from a leaf to the Merkle root
+func MerklePath(leaves []string, index int) ([]ProofStep, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf %d is not among %d leaves", index, len(leaves))
+	}
+	level := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	path := make([]ProofStep, 0)
+	for len(level) > 1 {
+		if index%2 == 1 {
+			path = append(path, ProofStep{Hash: level[index-1], Left: true})
+		} else if index+1 < len(level) {
+			path = append(path, ProofStep{Hash: level[index+1], Left: false})
+		}
+		next := make([]string, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		level = next
+		index /= 2
+	}
+	return path, nil
+}
+
+// Hash a leaf up its path, giving the Merkle root it belongs to
+func FoldMerklePath(leaf string, path []ProofStep) string {
+	hash := merkleLeaf(leaf)
+	for _, step := range path {
+		if step.Left {
+			hash = merkleNode(step.Hash, hash)
+		} else {
+			hash = merkleNode(hash, step.Hash)
+		}
+	}
+	return hash
+}
+
+// CheckpointData implements BlockData, it commits the leader to every block up to a height
+type CheckpointData struct {
+	ClusterID string `json:"clusterID"`
+	Height    int    `json:"height"`    // Index of the last block covered
+	ChainRoot string `json:"chainRoot"` // Merkle root over the hashes of blocks 0 to Height
+	Signer    string `json:"signer"`    // Peer ID of the leader that signed the checkpoint
+	PublicKey []byte `json:"publicKey"` // Marshalled public key of the signer
+	Signature []byte `json:"signature"`
+}
+
+func (cd *CheckpointData) CalculateDataHash() string {
+	return cd.ClusterID + strconv.Itoa(cd.Height) + cd.ChainRoot + cd.Signer + hex.EncodeToString(cd.Signature)
+}
+
+// Bytes covered by the signature of the checkpoint
+func (cd *CheckpointData) SigningBytes() []byte {
+	return []byte(cd.ClusterID + strconv.Itoa(cd.Height) + cd.ChainRoot)
+}
+
+// The fields of a block its hash is calculated from, without its data
+type BlockHeader struct {
+	Index      int    `json:"index"`
+	Timestamp  int64  `json:"timestamp"`
+	PrevHash   string `json:"prevHash"`
+	BlockType  string `json:"blockType"`
+	MerkleRoot string `json:"merkleRoot"`
+	Hash       string `json:"hash"`
+}
+
+// Proves that a message is in the chain without the rest of the chain
+type InclusionProof struct {
+	Message Message     `json:"message"`
+	Header  BlockHeader `json:"header"`
+	// Position of the message among the payloads of the block, and its path to the Merkle root of the block
+	LeafIndex   int         `json:"leafIndex"`
+	PayloadPath []ProofStep `json:"payloadPath"`
+	// First checkpoint covering the block and the path from the block hash to its chain root.
+	// Unset while no checkpoint covers the block yet.
+	Checkpoint *CheckpointData `json:"checkpoint,omitempty"`
+	ChainPath  []ProofStep     `json:"chainPath,omitempty"`
+}
+
+// Check that the message hashes up to the block header, and the block up to the checkpoint if set.
+// The signature of the checkpoint is not checked.
+func (proof *InclusionProof) Verify() error {
+	header := proof.Header
+	messageData := MessageData{Message: proof.Message}
+	leaf := messageData.CalculateDataHash()
+	switch header.BlockType {
+	case "message":
+	case "batch":
+		leaf = EntryHash(header.Index, proof.LeafIndex, "message", leaf)
+	default:
+		return fmt.Errorf("block %d holds no messages", header.Index)
+	}
+	if root := FoldMerklePath(leaf, proof.PayloadPath); root != header.MerkleRoot {
+		return fmt.Errorf("message %s is not in the payloads of block %d", proof.Message.ID, header.Index)
+	}
+	block := Block{Index: header.Index, Timestamp: header.Timestamp, PrevHash: header.PrevHash, BlockType: header.BlockType, MerkleRoot: header.MerkleRoot}
+	if block.CalculateHash() != header.Hash {
+		return fmt.Errorf("header of block %d does not match its hash", header.Index)
+	}
+	if proof.Checkpoint == nil {
+		return nil
+	}
+	if proof.Checkpoint.Height < header.Index {
+		return fmt.Errorf("checkpoint at %d does not cover block %d", proof.Checkpoint.Height, header.Index)
+	}
+	if FoldMerklePath(header.Hash, proof.ChainPath) != proof.Checkpoint.ChainRoot {
+		return fmt.Errorf("block %d is not covered by the checkpoint at %d", header.Index, proof.Checkpoint.Height)
+	}
+	return nil
+}
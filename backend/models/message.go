@@ -1,8 +1,51 @@
 package models
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
 type Message struct {
+	ID        string `json:"id"` // Stable ID chosen by the sender
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Message   string `json:"message"`
 	Timestamp string `json:"timestamp"`
+	ReplyTo   string `json:"replyTo,omitempty"` // ID of the message this is a reply to
+	Edited    bool   `json:"edited,omitempty"`  // Set in the effective view when the message was edited
+	// Hash of the erased payload, set once the message has expired and its payload was removed
+	PayloadHash string `json:"payloadHash,omitempty"`
+}
+
+// Generate a random message ID
+func NewMessageID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Hash of the message payload, which stays available after the payload is erased
+func (m *Message) PayloadDigest() string {
+	if m.Message == "" && m.PayloadHash != "" {
+		return m.PayloadHash
+	}
+	return PayloadDigest(m.Message)
+}
+
+// Remove the payload of the message and keep only its hash
+func (m *Message) Erase() {
+	m.PayloadHash = m.PayloadDigest()
+	m.Message = ""
+}
+
+// Whether the payload of the message has been erased
+func (m *Message) Erased() bool {
+	return m.Message == "" && m.PayloadHash != ""
+}
+
+// SHA256 of a payload as a hex string
+func PayloadDigest(payload string) string {
+	hash := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(hash[:])
 }
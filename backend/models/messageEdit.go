@@ -0,0 +1,36 @@
+package models
+
+import "strconv"
+
+// MessageEdit replaces or deletes a message block that is already on the chain.
+// Edits and deletes are recorded as new blocks, the original block is never changed.
+type MessageEdit struct {
+	Sender      string `json:"sender"`      // Must be the sender of the original message
+	TargetIndex int    `json:"targetIndex"` // Index of the original message block
+	TargetHash  string `json:"targetHash"`  // Hash of the original message block
+	Message     string `json:"message"`     // Replacement message (empty for deletes)
+	Timestamp   string `json:"timestamp"`
+	PublicKey   []byte `json:"publicKey"` // Marshalled public key of the sender
+	Signature   []byte `json:"signature"` // Signature of the edit by the sender
+	// Hash of the erased replacement message, set once the edited message has expired
+	PayloadHash string `json:"payloadHash,omitempty"`
+}
+
+// Bytes covered by the signature of the edit
+func (me *MessageEdit) SigningBytes() []byte {
+	return []byte(me.Sender + strconv.Itoa(me.TargetIndex) + me.TargetHash + me.Message + me.Timestamp)
+}
+
+// Hash of the replacement message, which stays available after it is erased
+func (me *MessageEdit) PayloadDigest() string {
+	if me.Message == "" && me.PayloadHash != "" {
+		return me.PayloadHash
+	}
+	return PayloadDigest(me.Message)
+}
+
+// Remove the replacement message and keep only its hash
+func (me *MessageEdit) Erase() {
+	me.PayloadHash = me.PayloadDigest()
+	me.Message = ""
+}
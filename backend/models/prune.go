@@ -0,0 +1,106 @@
+package models
+
+import "fmt"
+
+// A range of blocks exported to an archive file
+type Segment struct {
+	ClusterID string   `json:"clusterID"`
+	From      int      `json:"from"`     // Index of the first block
+	To        int      `json:"to"`       // Index of the last block
+	PrevHash  string   `json:"prevHash"` // Hash of the block before the segment, empty for the first segment
+	Blocks    []*Block `json:"blocks"`
+}
+
+// Erase the payloads of the messages and edits before keepFrom that belong to
+// conversations self is not part of. Like expired messages they keep the hash of
+// their payload, so the blocks stay verifiable and later blocks can still be checked
+// against them. Returns the number of payloads erased.
+func (bc *Blockchain) Prune(self string, keepFrom int) int {
+	// Whether self is part of the conversation of each message entry, by hash
+	ours := make(map[string]bool)
+	pruned := 0
+	for _, entry := range bc.Entries() {
+		if entry.Index >= keepFrom {
+			break
+		}
+		switch entry.BlockType {
+		case "message":
+			message := &entry.Data.(*MessageData).Message
+			ours[entry.Hash] = message.Sender == self || message.Receiver == self
+			if !ours[entry.Hash] && !message.Erased() {
+				message.Erase()
+				pruned++
+			}
+		case "edit":
+			edit := &entry.Data.(*EditData).MessageEdit
+			if mine, known := ours[edit.TargetHash]; known && !mine && edit.Message != "" {
+				edit.Erase()
+				pruned++
+			}
+		}
+	}
+	return pruned
+}
+
+// Put back an erased payload from a copy of the same entry that still has it.
+// Reports whether the payload was restored.
+func (b *Block) RestorePayload(from *Block) bool {
+	if from.Hash != b.Hash || from.BlockType != b.BlockType {
+		return false
+	}
+	switch data := b.Data.(type) {
+	case *MessageData:
+		source, ok := from.Data.(*MessageData)
+		if !ok || !data.Message.Erased() || source.Message.Erased() || PayloadDigest(source.Message.Message) != data.PayloadHash {
+			return false
+		}
+		data.Message.Message = source.Message.Message
+		data.Message.PayloadHash = ""
+		return true
+	case *EditData:
+		source, ok := from.Data.(*EditData)
+		if !ok || data.MessageEdit.Message != "" || data.MessageEdit.PayloadHash == "" || source.MessageEdit.Message == "" || PayloadDigest(source.MessageEdit.Message) != data.MessageEdit.PayloadHash {
+			return false
+		}
+		data.MessageEdit.Message = source.MessageEdit.Message
+		data.MessageEdit.PayloadHash = ""
+		return true
+	}
+	return false
+}
+
+// Copy the blocks from one index to another into a segment
+func (bc *Blockchain) Segment(from int, to int) (*Segment, error) {
+	if from < 0 || to < from || to >= len(bc.Chain) {
+		return nil, fmt.Errorf("blocks %d to %d are not on the chain of %d blocks", from, to, len(bc.Chain))
+	}
+	segment := &Segment{
+		ClusterID: bc.ClusterID(),
+		From:      from,
+		To:        to,
+		Blocks:    make([]*Block, 0, to-from+1),
+	}
+	if from > 0 {
+		segment.PrevHash = bc.Chain[from-1].Hash
+	}
+	for _, block := range bc.Chain[from : to+1] {
+		segment.Blocks = append(segment.Blocks, block.Copy())
+	}
+	return segment, nil
+}
+
+// Verify every block of a segment and that they follow each other. Checkpoints are not
+// checked, as the blocks they cover may be outside the segment.
+func (segment *Segment) Verify() *ChainFault {
+	if len(segment.Blocks) != segment.To-segment.From+1 {
+		return &ChainFault{Index: segment.From, Reason: fmt.Sprintf("the segment holds %d blocks instead of %d", len(segment.Blocks), segment.To-segment.From+1)}
+	}
+	prevHash := segment.PrevHash
+	for i, block := range segment.Blocks {
+		if fault := block.check(segment.From+i, prevHash); fault != nil {
+			return fault
+		}
+		prevHash = block.Hash
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+package models
+
+// Reaction adds or removes an emoji reaction on a message
+type Reaction struct {
+	MessageID string `json:"messageID"` // ID of the message reacted to
+	Sender    string `json:"sender"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove,omitempty"` // Removes an earlier reaction with the same emoji
+	Timestamp string `json:"timestamp"`
+}
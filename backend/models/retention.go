@@ -0,0 +1,11 @@
+package models
+
+// Retention sets how long the messages of a conversation are kept.
+// Every node erases the payloads of expired messages locally, the block hashes stay verifiable.
+type Retention struct {
+	PeerIDs          []string `json:"peerIDs"`          // The two peers of the conversation
+	ExpireAfterHours int      `json:"expireAfterHours"` // Erase messages older than this (0 to disable)
+	KeepLast         int      `json:"keepLast"`         // Only keep the last N messages (0 to disable)
+	Setter           string   `json:"setter"`           // Peer that changed the setting
+	Timestamp        string   `json:"timestamp"`
+}
@@ -0,0 +1,18 @@
+package models
+
+// Signal is an ephemeral notification (typing, receipts, presence) that is
+// relayed over pubsub but never written to the blockchain
+type Signal struct {
+	Type      string `json:"type"`      // "typing", "delivered", "read" or "presence"
+	Sender    string `json:"sender"`    // Peer ID of the sender
+	Receiver  string `json:"receiver"`  // Peer ID of the receiver (empty for presence)
+	Reference string `json:"reference"` // Hash of the message block a receipt refers to
+	Timestamp string `json:"timestamp"`
+	PublicKey []byte `json:"publicKey"` // Marshalled public key of the sender
+	Signature []byte `json:"signature"` // Signature of the signal by the sender
+}
+
+// Bytes covered by the signature of the signal
+func (s *Signal) SigningBytes() []byte {
+	return []byte(s.Type + s.Sender + s.Receiver + s.Reference + s.Timestamp)
+}
@@ -0,0 +1,342 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	libp2pnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Node modes, see NODE_MODE
+	voterMode    = "voter"
+	observerMode = "observer"
+
+	// Stream protocol peers fetch blocks of the chain on
+	historyProtocol = protocol.ID("/messagemesh/history/1.0.0")
+	// Most blocks returned by a single history request
+	maxHistoryBlocks = 500
+
+	mailboxfile   = "mailbox.db"
+	mailboxdbpath = directory + "/" + mailboxfile
+	// How often the mailbox is delivered
+	mailboxInterval = 10 * time.Second
+	// How long the leader gets to commit a message before the mailbox delivers it
+	mailboxDelay = 30 * time.Second
+	// How long undelivered messages are kept
+	mailboxTTL = 7 * 24 * time.Hour
+)
+
+// Serialises access to the mailbox database
+var mailboxDBMutex sync.Mutex
+
+// Blocks of the chain served by a peer
+type History struct {
+	ClusterID string          `json:"clusterID"`
+	Length    int             `json:"length"` // Number of blocks in the chain of the peer
+	Blocks    []*models.Block `json:"blocks"`
+}
+
+type historyRequest struct {
+	From  int `json:"from"`  // Index of the first block
+	Limit int `json:"limit"` // Number of blocks, at most maxHistoryBlocks
+}
+
+// A message an observer holds until it is committed to the chain
+type mailboxEntry struct {
+	Received     int64                `json:"received"`
+	Message      *models.Message      `json:"message,omitempty"`
+	FirstMessage *models.FirstMessage `json:"firstMessage,omitempty"`
+	// The signed pubsub message it was published in, the leader only accepts it signed by its author
+	Envelope []byte `json:"envelope,omitempty"`
+}
+
+// Get the node mode from NODE_MODE: voter or observer
+func nodeMode() string {
+	switch debug.NodeMode {
+	case "", voterMode:
+		return voterMode
+	case observerMode:
+		return observerMode
+	default:
+		debug.Log("err", fmt.Sprintf("Invalid NODE_MODE %s, using %s", debug.NodeMode, voterMode))
+		return voterMode
+	}
+}
+
+// Answer a history request with a range of blocks
+func (network *Network) handleHistory(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	remote := stream.Conn().RemotePeer()
+
+	if !network.P2pService.PeerAllowed(remote) {
+		debug.Log("raft", fmt.Sprintf("Refused history request from disallowed peer: %s", remote))
+		stream.Reset()
+		return
+	}
+	request := historyRequest{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&request); err != nil {
+		debug.Log("err", fmt.Sprintf("Invalid history request from %s: %s", remote, err))
+		stream.Reset()
+		return
+	}
+
+	if request.Limit <= 0 || request.Limit > maxHistoryBlocks {
+		request.Limit = maxHistoryBlocks
+	}
+	history := History{Blocks: make([]*models.Block, 0)}
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		history.ClusterID = blockchain.ClusterID()
+		history.Length = len(blockchain.Chain)
+		for index := request.From; index >= 0 && index < len(blockchain.Chain) && index < request.From+request.Limit; index++ {
+			history.Blocks = append(history.Blocks, blockchain.Chain[index].Copy())
+		}
+	})
+	debug.Log("raft", fmt.Sprintf("Serving %d blocks from %d to %s", len(history.Blocks), request.From, remote))
+	if err := json.NewEncoder(stream).Encode(history); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer history request from %s: %s", remote, err))
+	}
+}
+
+// Fetch a range of blocks from a peer, checking that they are linked and match their hashes
+func (network *Network) RequestHistory(peerIDStr string, from int, limit int) (History, error) {
+	history := History{}
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return history, fmt.Errorf("invalid peer ID %s: %s", peerIDStr, err.Error())
+	}
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, joinTimeout)
+	defer cancel()
+
+	stream, err := network.P2pService.Host.NewStream(ctx, peerID, historyProtocol)
+	if err != nil {
+		return history, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+
+	if err := json.NewEncoder(stream).Encode(historyRequest{From: from, Limit: limit}); err != nil {
+		return history, err
+	}
+	if err := json.NewDecoder(io.LimitReader(stream, maxMergeSize)).Decode(&history); err != nil {
+		return history, err
+	}
+
+	for i, block := range history.Blocks {
+		if block.MerkleRoot != block.CalculateMerkleRoot() || block.Hash != block.CalculateHash() {
+			return history, fmt.Errorf("block %d does not match its hash", block.Index)
+		}
+		if i > 0 && block.PrevHash != history.Blocks[i-1].Hash {
+			return history, fmt.Errorf("block %d does not follow block %d", block.Index, history.Blocks[i-1].Index)
+		}
+	}
+	return history, nil
+}
+
+// Get the mailbox key of a message or first message, empty if it cannot be held
+func mailboxKey(inbound any) string {
+	switch inbound := inbound.(type) {
+	case models.Message:
+		if inbound.ID == "" {
+			return ""
+		}
+		return "message/" + inbound.ID
+	case models.FirstMessage:
+		if len(inbound.PeerIDs) != 2 {
+			return ""
+		}
+		peerIDs := append([]string{}, inbound.PeerIDs...)
+		sort.Strings(peerIDs)
+		return "firstMessage/" + strings.Join(peerIDs, "/")
+	}
+	return ""
+}
+
+// Hold a message received over pubsub until it is committed, so it is not lost
+// while the cluster has no leader or the recipient is offline
+func (network *Network) storeInMailbox(inbound any, signed []byte) {
+	key := mailboxKey(inbound)
+	if key == "" || signed == nil || network.committed(inbound) {
+		return
+	}
+	entry := mailboxEntry{Received: time.Now().Unix(), Envelope: signed}
+	switch inbound := inbound.(type) {
+	case models.Message:
+		entry.Message = &inbound
+	case models.FirstMessage:
+		entry.FirstMessage = &inbound
+	}
+	if err := writeMailboxEntry(key, &entry); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Save the Mailbox Entry! %s", err.Error()))
+	}
+}
+
+// Check whether a message or first message is in the chain
+func (network *Network) committed(inbound any) bool {
+	committed := false
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		switch inbound := inbound.(type) {
+		case models.Message:
+			committed = blockchain.GetMessageByID(inbound.ID) != nil
+		case models.FirstMessage:
+			committed = blockchain.CheckPeerFirstMessage(inbound.PeerIDs) != nil
+		}
+	})
+	return committed
+}
+
+// Hand the messages that were not committed in time to the leader, and forget the committed ones
+func (network *Network) deliverMailbox() {
+	entries, err := readMailbox()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Read the Mailbox! %s", err.Error()))
+		return
+	}
+
+	keys := make([]string, 0)
+	now := time.Now()
+	for key, entry := range entries {
+		var inbound any
+		if entry.Message != nil {
+			inbound = *entry.Message
+		} else if entry.FirstMessage != nil {
+			inbound = *entry.FirstMessage
+		}
+		received := time.Unix(entry.Received, 0)
+		// Entries without their signed envelope cannot be delivered
+		if inbound == nil || entry.Envelope == nil || network.committed(inbound) || now.Sub(received) > mailboxTTL {
+			if err := writeMailboxEntry(key, nil); err != nil {
+				debug.Log("err", fmt.Sprintf("Failed to Remove the Mailbox Entry! %s", err.Error()))
+			}
+			continue
+		}
+		if now.Sub(received) < mailboxDelay {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	leader, err := peer.Decode(string(network.ConsensusService.Raft.Leader()))
+	if err != nil {
+		debug.Log("raft", fmt.Sprintf("Holding %d messages until there is a leader", len(keys)))
+		return
+	}
+	// Keep the order they were received in, the leader drops what it already has
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].Received < entries[keys[j]].Received
+	})
+	request := mergeRequest{}
+	for _, key := range keys {
+		request.Envelopes = append(request.Envelopes, entries[key].Envelope)
+	}
+	debug.Log("raft", fmt.Sprintf("Delivering %d held messages to the leader %s", len(keys), leader))
+	results, err := network.requestMerge(leader, request)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to deliver the mailbox: %s", err))
+		return
+	}
+	// Messages the leader refused are dropped, those it could not commit in time are retried
+	for i, result := range results {
+		if i >= len(keys) || result.Status != "rejected" || result.Error == errCommitTimeout.Error() {
+			continue
+		}
+		debug.Log("raft", fmt.Sprintf("Leader refused held message %s: %s", keys[i], result.Error))
+		if err := writeMailboxEntry(keys[i], nil); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to Remove the Mailbox Entry! %s", err.Error()))
+		}
+	}
+}
+
+// Deliver the mailbox periodically
+func mailboxLoop(network *Network, stop chan struct{}) {
+	ticker := time.NewTicker(mailboxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			network.deliverMailbox()
+		}
+	}
+}
+
+// Get all entries of the mailbox
+func readMailbox() (map[string]mailboxEntry, error) {
+	entries := make(map[string]mailboxEntry)
+
+	mailboxDBMutex.Lock()
+	defer mailboxDBMutex.Unlock()
+
+	if _, err := os.Stat(mailboxdbpath); os.IsNotExist(err) {
+		return entries, nil
+	}
+	boltDB, err := bolt.Open(mailboxdbpath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer boltDB.Close()
+
+	err = boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("mailbox"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			entry := mailboxEntry{}
+			if err := json.Unmarshal(value, &entry); err != nil {
+				debug.Log("err", fmt.Sprintf("Invalid Mailbox Entry: %s", string(key)))
+			}
+			entries[string(key)] = entry
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Save an entry of the mailbox, or remove it if the entry is nil
+func writeMailboxEntry(key string, entry *mailboxEntry) error {
+	mailboxDBMutex.Lock()
+	defer mailboxDBMutex.Unlock()
+
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	boltDB, err := bolt.Open(mailboxdbpath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer boltDB.Close()
+
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("mailbox"))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		if entry == nil {
+			return bucket.Delete([]byte(key))
+		}
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
@@ -5,36 +5,50 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
-	connmgr "github.com/libp2p/go-libp2p-connmgr"
-	host "github.com/libp2p/go-libp2p-core/host"
-	"github.com/libp2p/go-libp2p-core/peer"
-	"github.com/libp2p/go-libp2p-core/routing"
-	discovery "github.com/libp2p/go-libp2p-discovery"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	tls "github.com/libp2p/go-libp2p-tls"
-	yamux "github.com/libp2p/go-libp2p-yamux"
-	"github.com/libp2p/go-tcp-transport"
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	discovery "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/p2p/muxer/yamux"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
 	"github.com/mr-tron/base58/base58"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
 )
 
 const (
+	// Default rendezvous string, override with RENDEZVOUS
 	service = "qwTYmRbuZl"
 )
 
-func NewP2PService() *P2PService {
+// Create the P2P host and its services, it fails when the private network cannot be set up
+func NewP2PService() (*P2PService, error) {
 	// Setup a background context
 	ctx := context.Background()
 
+	// Load the allowlist and blocklist
+	gater := NewPeerGater()
+
 	// Setup a P2P Host Node
-	nodehost, kaddht := setupHost(ctx)
+	nodehost, kaddht, err := setupHost(ctx, gater)
+	if err != nil {
+		return nil, err
+	}
 	debug.Log("p2p", "Created the P2P Host and the Kademlia DHT.")
 
 	// Bootstrap the Kad DHT
@@ -56,23 +70,23 @@ func NewP2PService() *P2PService {
 		KadDHT:    kaddht,
 		Discovery: routingdiscovery,
 		PubSub:    pubsubhandler,
-	}
+		Gater:     gater,
+	}, nil
 }
 
 func (p2p *P2PService) AdvertiseConnect() {
 	// Advertise the availabilty of the service on this node
-	ttl, err := p2p.Discovery.Advertise(p2p.Ctx, service)
+	ttl, err := p2p.Discovery.Advertise(p2p.Ctx, rendezvous())
 
 	if err != nil {
 		debug.Log("err", fmt.Sprintf("P2P Peer Discovery Failed! %s", err.Error()))
 	} else {
 		debug.Log("p2p", "Advertised the MessageMesh Service.")
 	}
-	time.Sleep(time.Second * 5)
 	debug.Log("p2p", fmt.Sprintf("Service Time-to-Live is %s", ttl))
 
 	// Find all peers advertising the same service
-	peerchan, err := p2p.Discovery.FindPeers(p2p.Ctx, service)
+	peerchan, err := p2p.Discovery.FindPeers(p2p.Ctx, rendezvous())
 	if err != nil {
 		debug.Log("err", fmt.Sprintf("P2P Peer Discovery Failed! %s", err.Error()))
 	} else {
@@ -84,9 +98,37 @@ func (p2p *P2PService) AdvertiseConnect() {
 	debug.Log("p2p", "Started Peer Connection Handler.")
 }
 
+// mdnsNotifee passes peers found on the local network to the peer connection handler
+type mdnsNotifee struct {
+	peerchan chan peer.AddrInfo
+}
+
+func (notifee *mdnsNotifee) HandlePeerFound(peerinfo peer.AddrInfo) {
+	select {
+	case notifee.peerchan <- peerinfo:
+	default:
+		debug.Log("p2p", fmt.Sprintf("Dropped mDNS Peer: %s", peerinfo.ID.String()))
+	}
+}
+
+func (p2p *P2PService) MdnsConnect() {
+	// Start mDNS discovery on the local network segment
+	peerchan := make(chan peer.AddrInfo, 16)
+	p2p.Mdns = mdns.NewMdnsService(p2p.Host, fmt.Sprintf("_%s._udp", rendezvous()), &mdnsNotifee{peerchan: peerchan})
+	if err := p2p.Mdns.Start(); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Start mDNS Local Discovery! %s", err.Error()))
+		return
+	}
+	debug.Log("p2p", "Started mDNS Local Discovery.")
+
+	// Connect to peers as they are discovered
+	go handlePeerDiscovery(p2p.Host, peerchan)
+	debug.Log("p2p", "Started Peer Connection Handler.")
+}
+
 func (p2p *P2PService) AnnounceConnect() {
 	// Generate the Service CID
-	cidvalue := generateCID(service)
+	cidvalue := generateCID(rendezvous())
 	debug.Log("p2p", "Generated the Service CID.")
 
 	// Announce that this host can provide the service CID
@@ -109,7 +151,7 @@ func (p2p *P2PService) AnnounceConnect() {
 	debug.Log("p2p", "Started Peer Connection Handler.")
 }
 
-func setupHost(ctx context.Context) (host.Host, *dht.IpfsDHT) {
+func setupHost(ctx context.Context, gater *PeerGater) (host.Host, *dht.IpfsDHT, error) {
 	// Set up the host identity options
 	// prvkey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
 	keypair, err := ReadKeyPair()
@@ -127,37 +169,43 @@ func setupHost(ctx context.Context) (host.Host, *dht.IpfsDHT) {
 		debug.Log("p2p", "Generated P2P Identity Configuration.")
 	}
 
-	// Set up TLS secured TCP transport and options
-	tlstransport, err := tls.New(prvkey)
-	security := libp2p.Security(tls.ID, tlstransport)
-	transport := libp2p.Transport(tcp.NewTCPTransport)
+	// Set up TLS secured transports and options
+	security := libp2p.Security(tls.ID, tls.New)
+	transport, enabled, err := transportOptions()
 	if err != nil {
-		debug.Log("err", fmt.Sprintf("Failed to Generate P2P Security and Transport Configurations! %s", err.Error()))
-	} else {
-		debug.Log("p2p", "Generated P2P Security and Transport Configurations.")
+		return nil, nil, err
 	}
+	debug.Log("p2p", "Generated P2P Security and Transport Configurations.")
 
 	// Set up host listener address options
-	muladdr, err := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/0")
-	listen := libp2p.ListenAddrs(muladdr)
+	addrs, err := listenAddrs(enabled)
 	if err != nil {
-		debug.Log("err", fmt.Sprintf("Failed to Generate P2P Address Listener Configuration! %s", err.Error()))
-	} else {
-		debug.Log("p2p", "Generated P2P Address Listener Configuration.")
+		return nil, nil, err
 	}
+	listen := libp2p.ListenAddrs(addrs...)
+	debug.Log("p2p", "Generated P2P Address Listener Configuration.")
 
 	// Set up the stream multiplexer and connection manager options
-	muxer := libp2p.Muxer("/yamux/1.0.0", yamux.DefaultTransport)
-	conn := libp2p.ConnectionManager(connmgr.NewConnManager(100, 400, time.Minute))
-	debug.Log("p2p", "Generated P2P Stream Multiplexer, Connection Manager Configurations.")
+	muxer := libp2p.Muxer(yamux.ID, yamux.DefaultTransport)
+	connmanager, err := connmgr.NewConnManager(100, 400, connmgr.WithGracePeriod(time.Minute))
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Create the Connection Manager! %s", err.Error()))
+		return nil, nil, err
+	}
+	conn := libp2p.ConnectionManager(connmanager)
+	gate := libp2p.ConnectionGater(gater)
+	debug.Log("p2p", "Generated P2P Stream Multiplexer, Connection Manager and Connection Gater Configurations.")
 
-	// Setup NAT traversal and relay options
+	// Declare a KadDHT
+	var kaddht *dht.IpfsDHT
+
+	// Setup NAT traversal and relay options, relays are picked among the peers of the DHT
 	nat := libp2p.NATPortMap()
-	relay := libp2p.EnableAutoRelay()
+	relay := libp2p.EnableAutoRelayWithPeerSource(func(ctx context.Context, num int) <-chan peer.AddrInfo {
+		return relayCandidates(kaddht, num)
+	})
 	debug.Log("p2p", "Generated P2P NAT Traversal and Relay Configurations.")
 
-	// Declare a KadDHT
-	var kaddht *dht.IpfsDHT
 	// Setup a routing configuration with the KadDHT
 	routing := libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
 		kaddht = setupKadDHT(ctx, h)
@@ -165,18 +213,48 @@ func setupHost(ctx context.Context) (host.Host, *dht.IpfsDHT) {
 	})
 	debug.Log("p2p", "Generated P2P Routing Configurations.")
 
-	opts := libp2p.ChainOptions(identity, listen, security, transport, muxer, conn, nat, routing, relay)
+	opts := libp2p.ChainOptions(identity, listen, security, transport, muxer, conn, gate, nat, routing, relay)
+
+	// Only peers holding the pre-shared key can connect to a private mesh. Starting
+	// without it would join the public network, so a key that cannot be read is fatal.
+	psk, err := networkKey()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Read the Network Key! %s", err.Error()))
+		return nil, nil, fmt.Errorf("network key %s cannot be used: %s", debug.NetworkKey, err.Error())
+	} else if psk != nil {
+		if enabled["quic"] {
+			return nil, nil, fmt.Errorf("the QUIC transport cannot be used in a private mesh, remove quic from TRANSPORTS")
+		}
+		opts = libp2p.ChainOptions(opts, libp2p.PrivateNetwork(psk))
+		debug.Log("p2p", "Generated P2P Private Network Configuration.")
+	}
 
 	// Construct a new libP2P host with the created options
-	libhost, err := libp2p.New(ctx, opts)
+	libhost, err := libp2p.New(opts)
 	if err != nil {
 		debug.Log("err", fmt.Sprintf("Failed to Create the P2P Host! %s", err.Error()))
-	} else {
-		debug.Log("p2p", "Created the P2P Host.")
+		return nil, nil, err
 	}
+	debug.Log("p2p", "Created the P2P Host.")
 
 	// Return the created host and the kademlia DHT
-	return libhost, kaddht
+	return libhost, kaddht, nil
+}
+
+// Get up to num peers of the DHT routing table to use as relays
+func relayCandidates(kaddht *dht.IpfsDHT, num int) <-chan peer.AddrInfo {
+	peerchan := make(chan peer.AddrInfo, num)
+	defer close(peerchan)
+	if kaddht == nil {
+		return peerchan
+	}
+	for _, peerID := range kaddht.RoutingTable().ListPeers() {
+		if len(peerchan) == num {
+			break
+		}
+		peerchan <- kaddht.Host().Peerstore().PeerInfo(peerID)
+	}
+	return peerchan
 }
 
 // A function that generates a Kademlia DHT object and returns it
@@ -184,7 +262,7 @@ func setupKadDHT(ctx context.Context, nodehost host.Host) *dht.IpfsDHT {
 	// Create DHT server mode option
 	dhtmode := dht.Mode(dht.ModeServer)
 	// Rertieve the list of boostrap peer addresses
-	bootstrappeers := dht.GetDefaultBootstrapPeerAddrInfos()
+	bootstrappeers := bootstrapPeers()
 	// Create the DHT bootstrap peers option
 	dhtpeers := dht.BootstrapPeers(bootstrappeers...)
 
@@ -205,8 +283,13 @@ func setupKadDHT(ctx context.Context, nodehost host.Host) *dht.IpfsDHT {
 }
 
 func setupPubSub(ctx context.Context, nodehost host.Host, routingdiscovery *discovery.RoutingDiscovery) *pubsub.PubSub {
-	// Create a new PubSub service which uses a GossipSub router
-	pubsubhandler, err := pubsub.NewGossipSub(ctx, nodehost, pubsub.WithDiscovery(routingdiscovery))
+	// Create a new PubSub service which uses a GossipSub router,
+	// peers are scored so that misbehaving ones are pruned and graylisted
+	scoreParams, scoreThresholds := peerScoreParams()
+	pubsubhandler, err := pubsub.NewGossipSub(ctx, nodehost,
+		pubsub.WithDiscovery(routingdiscovery),
+		pubsub.WithPeerScore(scoreParams, scoreThresholds),
+	)
 	// Handle any potential error
 	if err != nil {
 		debug.Log("err", fmt.Sprintf("PubSub Handler Creation Failed! %s", err.Error()))
@@ -232,10 +315,9 @@ func bootstrapDHT(ctx context.Context, nodehost host.Host, kaddht *dht.IpfsDHT)
 	var connectedbootpeers int
 	var totalbootpeers int
 
-	// Iterate over the default bootstrap peers provided by libp2p
-	for _, peeraddr := range dht.DefaultBootstrapPeers {
-		// Retrieve the peer address information
-		peerinfo, _ := peer.AddrInfoFromP2pAddr(peeraddr)
+	// Iterate over the configured or default bootstrap peers
+	for _, peerinfo := range bootstrapPeers() {
+		peerinfo := peerinfo
 
 		// Incremenent waitgroup counter
 		wg.Add(1)
@@ -244,7 +326,7 @@ func bootstrapDHT(ctx context.Context, nodehost host.Host, kaddht *dht.IpfsDHT)
 			// Defer the waitgroup decrement
 			defer wg.Done()
 			// Attempt to connect to the bootstrap peer
-			if err := nodehost.Connect(ctx, *peerinfo); err != nil {
+			if err := nodehost.Connect(ctx, peerinfo); err != nil {
 				// Increment the total bootstrap peer count
 				debug.Log("err", fmt.Sprintf("Failed to Connect to Bootstrap Peer: %s %s", peerinfo.ID.String(), err.Error()))
 				totalbootpeers++
@@ -266,6 +348,136 @@ func bootstrapDHT(ctx context.Context, nodehost host.Host, kaddht *dht.IpfsDHT)
 	debug.Log("p2p", fmt.Sprintf("Connected to %d out of %d Bootstrap Peers.", connectedbootpeers, totalbootpeers))
 }
 
+// Get the transport options enabled in TRANSPORTS (default tcp),
+// and which transports are enabled by name
+func transportOptions() (libp2p.Option, map[string]bool, error) {
+	transports := []libp2p.Option{libp2p.Transport(tcp.NewTCPTransport)}
+	enabled := map[string]bool{"tcp": true}
+	for _, name := range strings.Split(debug.Transports, ",") {
+		name = strings.TrimSpace(name)
+		if enabled[name] {
+			continue
+		}
+		switch name {
+		case "":
+		case "ws":
+			transports = append(transports, libp2p.Transport(websocket.New))
+			enabled[name] = true
+			debug.Log("p2p", "Enabled the WebSocket Transport.")
+		case "quic":
+			transports = append(transports, libp2p.Transport(quic.NewTransport))
+			enabled[name] = true
+			debug.Log("p2p", "Enabled the QUIC Transport.")
+		default:
+			debug.Log("err", fmt.Sprintf("Unknown Transport: %s", name))
+		}
+	}
+	return libp2p.ChainOptions(transports...), enabled, nil
+}
+
+// Get the listen addresses from LISTEN_ADDRS, by default any free TCP port on IPv4 and IPv6.
+// A WebSocket and a QUIC address are added when their transport is enabled and none is configured.
+// Invalid addresses are refused, so the node never listens on other ports than configured.
+func listenAddrs(enabled map[string]bool) ([]multiaddr.Multiaddr, error) {
+	addrs := debug.ListenAddrs
+	if addrs == "" {
+		addrs = "/ip4/0.0.0.0/tcp/0,/ip6/::/tcp/0"
+	}
+
+	muladdrs := make([]multiaddr.Multiaddr, 0)
+	hasWebsocket := false
+	hasQuic := false
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		muladdr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			debug.Log("err", fmt.Sprintf("Invalid Listen Address %s: %s", addr, err.Error()))
+			return nil, fmt.Errorf("invalid listen address %s: %s", addr, err.Error())
+		}
+		if _, err := muladdr.ValueForProtocol(multiaddr.P_QUIC); err == nil {
+			return nil, fmt.Errorf("listen address %s uses draft QUIC, which is no longer supported, use quic-v1", addr)
+		}
+		if _, err := muladdr.ValueForProtocol(multiaddr.P_QUIC_V1); err == nil {
+			if !enabled["quic"] {
+				return nil, fmt.Errorf("listen address %s needs the QUIC transport, add quic to TRANSPORTS", addr)
+			}
+			hasQuic = true
+		}
+		if _, err := muladdr.ValueForProtocol(multiaddr.P_WS); err == nil {
+			if !enabled["ws"] {
+				return nil, fmt.Errorf("listen address %s needs the WebSocket transport, add ws to TRANSPORTS", addr)
+			}
+			hasWebsocket = true
+		}
+		muladdrs = append(muladdrs, muladdr)
+	}
+
+	if enabled["ws"] && !hasWebsocket {
+		muladdr, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/0/ws")
+		muladdrs = append(muladdrs, muladdr)
+	}
+	if enabled["quic"] && !hasQuic {
+		muladdr, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/udp/0/quic-v1")
+		muladdrs = append(muladdrs, muladdr)
+	}
+	return muladdrs, nil
+}
+
+// Get the rendezvous string peers advertise and look for
+func rendezvous() string {
+	if debug.Rendezvous != "" {
+		return debug.Rendezvous
+	}
+	return service
+}
+
+// Read the pre-shared key of a private mesh, nil when running on the public network
+func networkKey() (pnet.PSK, error) {
+	if debug.NetworkKey == "" {
+		return nil, nil
+	}
+	keyfile, err := os.Open(debug.NetworkKey)
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.Close()
+	return pnet.DecodeV1PSK(keyfile)
+}
+
+// Get the bootstrap peers from BOOTSTRAP_PEERS. Without any configured the public
+// IPFS bootstrap peers are used, unless this is a private mesh which they cannot join.
+func bootstrapPeers() []peer.AddrInfo {
+	if debug.BootstrapPeers == "" {
+		if debug.NetworkKey != "" {
+			debug.Log("p2p", "No Bootstrap Peers Configured for the Private Mesh.")
+			return []peer.AddrInfo{}
+		}
+		return dht.GetDefaultBootstrapPeerAddrInfos()
+	}
+	return parsePeerAddrs(debug.BootstrapPeers)
+}
+
+// Parse a comma separated list of peer multiaddrs, skipping invalid ones
+func parsePeerAddrs(list string) []peer.AddrInfo {
+	peerinfos := make([]peer.AddrInfo, 0)
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		peerinfo, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			debug.Log("err", fmt.Sprintf("Invalid Peer Address %s: %s", addr, err.Error()))
+			continue
+		}
+		peerinfos = append(peerinfos, *peerinfo)
+	}
+	return peerinfos
+}
+
 func handlePeerDiscovery(nodehost host.Host, peerchan <-chan peer.AddrInfo) {
 	// Iterate over the peer channel
 	for peer := range peerchan {
@@ -277,8 +489,14 @@ func handlePeerDiscovery(nodehost host.Host, peerchan <-chan peer.AddrInfo) {
 		err := nodehost.Connect(context.Background(), peer)
 		if err != nil {
 			debug.Log("err", fmt.Sprintf("Failed to Connect to Peer: %s %s", peer.ID.String(), err.Error()))
+			continue
 		}
 		debug.Log("p2p", fmt.Sprintf("Connected to Peer: %s", peer.ID.String()))
+
+		// Remember the peer so it can be redialed after a restart
+		if err := SavePeerAddrs(nodehost, peer.ID); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to Save Peer Addresses! %s", err.Error()))
+		}
 	}
 }
 
@@ -0,0 +1,239 @@
+package backend
+
+import (
+	"MessageMesh/debug"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	peersfile   = "peers.db"
+	peersdbpath = directory + "/" + peersfile
+
+	// Number of dial attempts before giving up on a peer
+	dialAttempts = 5
+	// Delay before the first redial, doubled after every failed attempt
+	dialBackoff = 2 * time.Second
+	// How often static peers are checked and redialed
+	staticPeerInterval = 30 * time.Second
+	// Address book entries not seen for this long are forgotten
+	addressBookTTL = 30 * 24 * time.Hour
+)
+
+// Serialises access to the peers database
+var peersDBMutex sync.Mutex
+
+// A peer that was connected to before
+type addressBookEntry struct {
+	Addrs    []string `json:"addrs"`
+	LastSeen int64    `json:"lastSeen"`
+}
+
+// Record the addresses of a connected peer in the address book
+func SavePeerAddrs(nodehost host.Host, peerID peer.ID) error {
+	addrs := make([]string, 0)
+	for _, addr := range nodehost.Peerstore().Addrs(peerID) {
+		addrs = append(addrs, addr.String())
+	}
+	entry, err := json.Marshal(addressBookEntry{
+		Addrs:    addrs,
+		LastSeen: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	peersDBMutex.Lock()
+	defer peersDBMutex.Unlock()
+
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	boltDB, err := bolt.Open(peersdbpath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer boltDB.Close()
+
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("addressbook"))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return bucket.Put([]byte(peerID.String()), entry)
+	})
+}
+
+// Get all peers in the address book, forgetting those not seen within addressBookTTL
+func ReadAddressBook() ([]peer.AddrInfo, error) {
+	peerinfos := make([]peer.AddrInfo, 0)
+
+	peersDBMutex.Lock()
+	defer peersDBMutex.Unlock()
+
+	if _, err := os.Stat(peersdbpath); os.IsNotExist(err) {
+		return peerinfos, nil
+	}
+	boltDB, err := bolt.Open(peersdbpath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer boltDB.Close()
+
+	expired := time.Now().Add(-addressBookTTL).Unix()
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("addressbook"))
+		if bucket == nil {
+			return nil
+		}
+		stale := make([][]byte, 0)
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			peerID, err := peer.Decode(string(key))
+			if err != nil {
+				debug.Log("err", fmt.Sprintf("Invalid Peer ID in Address Book: %s", string(key)))
+				return nil
+			}
+			entry := addressBookEntry{}
+			if err := json.Unmarshal(value, &entry); err != nil {
+				debug.Log("err", fmt.Sprintf("Invalid Address Book Entry for %s", peerID.String()))
+				return nil
+			}
+			if entry.LastSeen < expired {
+				stale = append(stale, key)
+				return nil
+			}
+			peerinfo := peer.AddrInfo{ID: peerID}
+			for _, addr := range entry.Addrs {
+				if muladdr, err := multiaddr.NewMultiaddr(addr); err == nil {
+					peerinfo.Addrs = append(peerinfo.Addrs, muladdr)
+				}
+			}
+			peerinfos = append(peerinfos, peerinfo)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range stale {
+			debug.Log("peers", fmt.Sprintf("Forgetting Address Book Peer: %s", string(key)))
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return peerinfos, err
+}
+
+// Dial a peer, retrying with exponential backoff
+func dialWithBackoff(ctx context.Context, nodehost host.Host, peerinfo peer.AddrInfo) error {
+	backoff := dialBackoff
+	var err error
+	for attempt := 1; attempt <= dialAttempts; attempt++ {
+		if err = nodehost.Connect(ctx, peerinfo); err == nil {
+			return nil
+		}
+		debug.Log("peers", fmt.Sprintf("Dial %d of %d to %s failed: %s", attempt, dialAttempts, peerinfo.ID.String(), err.Error()))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// Redial every peer in the address book
+func (p2p *P2PService) RedialAddressBook() {
+	peerinfos, err := ReadAddressBook()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to Read the Address Book! %s", err.Error()))
+		return
+	}
+	debug.Log("peers", fmt.Sprintf("Redialing %d Peers from the Address Book.", len(peerinfos)))
+
+	for _, peerinfo := range peerinfos {
+		go func(peerinfo peer.AddrInfo) {
+			if err := dialWithBackoff(p2p.Ctx, p2p.Host, peerinfo); err != nil {
+				debug.Log("peers", fmt.Sprintf("Gave up on Address Book Peer: %s", peerinfo.ID.String()))
+				return
+			}
+			debug.Log("peers", fmt.Sprintf("Reconnected to Address Book Peer: %s", peerinfo.ID.String()))
+			if err := SavePeerAddrs(p2p.Host, peerinfo.ID); err != nil {
+				debug.Log("err", fmt.Sprintf("Failed to Save Peer Addresses! %s", err.Error()))
+			}
+		}(peerinfo)
+	}
+}
+
+// Keep a connection to every static peer, redialing them when they drop
+func (p2p *P2PService) KeepStaticPeers() {
+	staticpeers := parsePeerAddrs(debug.StaticPeers)
+	if len(staticpeers) == 0 {
+		return
+	}
+	// Static peers are never trimmed by the connection manager
+	for _, peerinfo := range staticpeers {
+		p2p.Host.ConnManager().Protect(peerinfo.ID, "static")
+	}
+	debug.Log("peers", fmt.Sprintf("Keeping %d Static Peers.", len(staticpeers)))
+
+	// Peers that are being dialed, a dial with backoff can outlast the interval
+	var dialingMutex sync.Mutex
+	dialing := make(map[peer.ID]bool)
+
+	ticker := time.NewTicker(staticPeerInterval)
+	defer ticker.Stop()
+	for {
+		for _, peerinfo := range staticpeers {
+			if p2p.Host.Network().Connectedness(peerinfo.ID) == network.Connected {
+				continue
+			}
+			dialingMutex.Lock()
+			inFlight := dialing[peerinfo.ID]
+			dialing[peerinfo.ID] = true
+			dialingMutex.Unlock()
+			if inFlight {
+				continue
+			}
+			go func(peerinfo peer.AddrInfo) {
+				defer func() {
+					dialingMutex.Lock()
+					delete(dialing, peerinfo.ID)
+					dialingMutex.Unlock()
+				}()
+				if err := dialWithBackoff(p2p.Ctx, p2p.Host, peerinfo); err != nil {
+					debug.Log("err", fmt.Sprintf("Failed to Connect to Static Peer: %s %s", peerinfo.ID.String(), err.Error()))
+					return
+				}
+				debug.Log("peers", fmt.Sprintf("Connected to Static Peer: %s", peerinfo.ID.String()))
+			}(peerinfo)
+		}
+		<-ticker.C
+	}
+}
+
+// Connect to a peer by its multiaddr and add it to the address book
+func (p2p *P2PService) AddPeer(addr string) error {
+	peerinfo, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %s: %s", addr, err.Error())
+	}
+	if err := p2p.Host.Connect(p2p.Ctx, *peerinfo); err != nil {
+		return fmt.Errorf("failed to connect to %s: %s", peerinfo.ID.String(), err.Error())
+	}
+	debug.Log("peers", fmt.Sprintf("Connected to Peer: %s", peerinfo.ID.String()))
+	return SavePeerAddrs(p2p.Host, peerinfo.ID)
+}
@@ -0,0 +1,258 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	libp2praft "github.com/libp2p/go-libp2p-raft"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	libp2pnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Stream protocol peers ask each other for inclusion proofs on
+	proofProtocol = protocol.ID("/messagemesh/proof/1.0.0")
+	// Number of blocks between two checkpoints
+	defaultCheckpointInterval = 100
+)
+
+type proofRequest struct {
+	MessageID string `json:"messageID"`
+}
+
+type proofResponse struct {
+	Proof *models.InclusionProof `json:"proof,omitempty"`
+	Error string                 `json:"error,omitempty"` // Set if the peer could not prove the message
+}
+
+// Get the number of blocks between checkpoints from CHECKPOINT_INTERVAL
+func checkpointInterval() int {
+	if debug.CheckpointInterval == "" {
+		return defaultCheckpointInterval
+	}
+	interval, err := strconv.Atoi(debug.CheckpointInterval)
+	if err != nil || interval < 1 {
+		debug.Log("err", fmt.Sprintf("Invalid CHECKPOINT_INTERVAL %s, using %d", debug.CheckpointInterval, defaultCheckpointInterval))
+		return defaultCheckpointInterval
+	}
+	return interval
+}
+
+// Check that a checkpoint matches the chain up to its height and is signed by its signer
+func validateCheckpoint(blockchain *models.Blockchain, checkpoint *models.CheckpointData) error {
+	if checkpoint.Height < 0 || checkpoint.Height >= len(blockchain.Chain) {
+		return fmt.Errorf("checkpoint height %d is not on the chain", checkpoint.Height)
+	}
+	if checkpoint.ClusterID != blockchain.ClusterID() {
+		return fmt.Errorf("checkpoint is for cluster %s", checkpoint.ClusterID)
+	}
+	if checkpoint.ChainRoot != blockchain.ChainRoot(checkpoint.Height) {
+		return fmt.Errorf("checkpoint does not match the chain up to block %d", checkpoint.Height)
+	}
+	return verifyCheckpointSignature(checkpoint)
+}
+
+func verifyCheckpointSignature(checkpoint *models.CheckpointData) error {
+	verified, err := VerifyPeerSignature(checkpoint.Signer, checkpoint.SigningBytes(), checkpoint.Signature, checkpoint.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("checkpoint signature is invalid")
+	}
+	return nil
+}
+
+// Sign and commit a checkpoint once enough blocks were added since the last one
+func addCheckpointBlock(network *Network, interval int, raftconsensus *libp2praft.Consensus, actor *libp2praft.Actor) {
+	if !actor.IsLeader() {
+		return
+	}
+	checkpoint := models.CheckpointData{}
+	due := false
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		latest := blockchain.LatestCheckpoint()
+		height := len(blockchain.Chain) - 1
+		if blockchain.ClusterID() == "" || (latest == nil && height < interval) || (latest != nil && height-latest.Height <= interval) {
+			return
+		}
+		due = true
+		checkpoint.ClusterID = blockchain.ClusterID()
+		checkpoint.Height = height
+		checkpoint.ChainRoot = blockchain.ChainRoot(height)
+	})
+	if !due {
+		return
+	}
+
+	keyPair, err := ReadKeyPair()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Error reading key pair: %s", err.Error()))
+		return
+	}
+	checkpoint.Signer = network.P2pService.Host.ID().String()
+	checkpoint.PublicKey, err = libp2pcrypto.MarshalPublicKey(keyPair.PubKey)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to marshal public key: %s", err.Error()))
+		return
+	}
+	checkpoint.Signature, err = keyPair.SignWithPrivateKey(checkpoint.SigningBytes())
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to sign checkpoint: %s", err.Error()))
+		return
+	}
+
+	debug.Log("raft", fmt.Sprintf("Adding checkpoint block at height %d", checkpoint.Height))
+	op := &raftOP{
+		Type:       "ADD_CHECKPOINT_BLOCK",
+		Checkpoint: &checkpoint,
+		Timestamp:  time.Now().Unix(),
+	}
+	if _, err := raftconsensus.CommitOp(op); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to commit block: %s", err))
+	}
+}
+
+// Get the latest checkpoint of the chain, nil if there is none yet
+func (network *Network) LatestCheckpoint() (*models.CheckpointData, error) {
+	var checkpoint *models.CheckpointData
+	err := network.Query(func(blockchain *models.Blockchain) {
+		if latest := blockchain.LatestCheckpoint(); latest != nil {
+			checkpointCopy := *latest
+			checkpoint = &checkpointCopy
+		}
+	})
+	return checkpoint, err
+}
+
+// Prove that a message is in the local chain
+func (network *Network) ProveMessage(messageID string) (*models.InclusionProof, error) {
+	var proof *models.InclusionProof
+	var proofErr error
+	err := network.Query(func(blockchain *models.Blockchain) {
+		proof, proofErr = blockchain.InclusionProof(messageID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proof, proofErr
+}
+
+// Verify an inclusion proof, including the signature of its checkpoint and that its signer is
+// trusted. A proof without a checkpoint only shows that the message is in the block with the
+// hash in its header.
+func (network *Network) VerifyInclusionProof(proof *models.InclusionProof) error {
+	if err := proof.Verify(); err != nil {
+		return err
+	}
+	if proof.Checkpoint == nil {
+		return nil
+	}
+	if err := verifyCheckpointSignature(proof.Checkpoint); err != nil {
+		return err
+	}
+	return network.trustCheckpointSigner(proof.Checkpoint)
+}
+
+// Check that a checkpoint is for the cluster of the local chain and signed by its current
+// leader or by a leader that signed a checkpoint on the local chain. A valid signature alone
+// only shows that the signer holds its own key.
+func (network *Network) trustCheckpointSigner(checkpoint *models.CheckpointData) error {
+	consensusService := network.ConsensusService
+	clusterID := ""
+	trusted := false
+	consensusService.View(func(blockchain *models.Blockchain) {
+		clusterID = blockchain.ClusterID()
+		for _, entry := range blockchain.Entries() {
+			if signed, ok := entry.Data.(*models.CheckpointData); ok && signed.Signer == checkpoint.Signer {
+				trusted = true
+				return
+			}
+		}
+	})
+	if clusterID == "" || checkpoint.ClusterID != clusterID {
+		return fmt.Errorf("checkpoint is for cluster %s, not ours", checkpoint.ClusterID)
+	}
+	if trusted || (consensusService.Raft != nil && string(consensusService.Raft.Leader()) == checkpoint.Signer) {
+		return nil
+	}
+	return fmt.Errorf("checkpoint signer %s is not a leader of our cluster", checkpoint.Signer)
+}
+
+// Answer a proof request of a peer
+func (network *Network) handleProof(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+	remote := stream.Conn().RemotePeer()
+
+	if !network.P2pService.PeerAllowed(remote) {
+		debug.Log("raft", fmt.Sprintf("Refused proof request from disallowed peer: %s", remote))
+		stream.Reset()
+		return
+	}
+	request := proofRequest{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&request); err != nil {
+		debug.Log("err", fmt.Sprintf("Invalid proof request from %s: %s", remote, err))
+		stream.Reset()
+		return
+	}
+
+	response := proofResponse{}
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		proof, err := blockchain.InclusionProof(request.MessageID)
+		if err != nil {
+			response.Error = err.Error()
+			return
+		}
+		response.Proof = proof
+	})
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer proof request from %s: %s", remote, err))
+	}
+}
+
+// Ask a peer to prove that a message is in its chain, and verify the proof
+func (network *Network) RequestProof(peerIDStr string, messageID string) (*models.InclusionProof, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID %s: %s", peerIDStr, err.Error())
+	}
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, joinTimeout)
+	defer cancel()
+
+	stream, err := network.P2pService.Host.NewStream(ctx, peerID, proofProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(joinTimeout))
+
+	if err := json.NewEncoder(stream).Encode(proofRequest{MessageID: messageID}); err != nil {
+		return nil, err
+	}
+	response := proofResponse{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxMergeSize)).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s", response.Error)
+	}
+	if response.Proof == nil {
+		return nil, fmt.Errorf("peer %s sent no proof", peerID)
+	}
+	if response.Proof.Message.ID != messageID {
+		return nil, fmt.Errorf("peer %s proved another message", peerID)
+	}
+	if err := network.VerifyInclusionProof(response.Proof); err != nil {
+		return nil, err
+	}
+	return response.Proof, nil
+}
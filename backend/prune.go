@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// How often payloads outside the window are pruned
+	pruneInterval = time.Minute
+	// Number of blocks in an archive segment
+	segmentSize = 1000
+	// Directory the archive segments are written to
+	archivesPath = directory + "/archives"
+)
+
+// The result of verifying an archive segment
+type ArchiveReport struct {
+	Path      string             `json:"path"`
+	ClusterID string             `json:"clusterID"`
+	From      int                `json:"from"`
+	To        int                `json:"to"`
+	Valid     bool               `json:"valid"`
+	Fault     *models.ChainFault `json:"fault,omitempty"` // Set if the segment is invalid
+	// Whether the blocks of the segment are the blocks at the same indexes of the local chain
+	MatchesChain bool `json:"matchesChain"`
+}
+
+// Get the number of recent blocks kept in full from PRUNE_WINDOW, 0 to keep every payload
+func pruneWindow() int {
+	if debug.PruneWindow == "" {
+		return 0
+	}
+	window, err := strconv.Atoi(debug.PruneWindow)
+	if err != nil || window < 0 {
+		debug.Log("err", fmt.Sprintf("Invalid PRUNE_WINDOW %s, using 0", debug.PruneWindow))
+		return 0
+	}
+	return window
+}
+
+func segmentPath(from int, to int) string {
+	return fmt.Sprintf("%s/segment-%d-%d.json", archivesPath, from, to)
+}
+
+// Write the blocks from one index to another to an archive file, returning its path
+func (network *Network) ExportSegment(from int, to int) (string, error) {
+	var segment *models.Segment
+	var segmentErr error
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		segment, segmentErr = blockchain.Segment(from, to)
+	})
+	if segmentErr != nil {
+		return "", segmentErr
+	}
+	return WriteSegment(segment)
+}
+
+// Write a segment to the archive file of its range, returning its path
+func WriteSegment(segment *models.Segment) (string, error) {
+	segmentJSON, err := json.Marshal(segment)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(archivesPath, 0755); err != nil {
+		return "", err
+	}
+	path := segmentPath(segment.From, segment.To)
+	if err := os.WriteFile(path, segmentJSON, 0644); err != nil {
+		return "", err
+	}
+	debug.Log("prune", fmt.Sprintf("Exported blocks %d to %d to %s", segment.From, segment.To, path))
+	return path, nil
+}
+
+// Load an archive file and verify its blocks, and whether they are part of the local chain
+func (network *Network) VerifyArchive(path string) (ArchiveReport, error) {
+	report, segment, err := CheckArchive(path)
+	if err != nil || !report.Valid {
+		return report, err
+	}
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		report.MatchesChain = ArchiveMatches(segment, blockchain)
+	})
+	return report, nil
+}
+
+// Load an archive file and verify its blocks on their own
+func CheckArchive(path string) (ArchiveReport, *models.Segment, error) {
+	report := ArchiveReport{Path: path}
+	segmentJSON, err := os.ReadFile(path)
+	if err != nil {
+		return report, nil, err
+	}
+	segment := &models.Segment{}
+	if err := json.Unmarshal(segmentJSON, segment); err != nil {
+		return report, nil, fmt.Errorf("invalid archive %s: %s", path, err.Error())
+	}
+	report.ClusterID = segment.ClusterID
+	report.From = segment.From
+	report.To = segment.To
+	report.Fault = segment.Verify()
+	report.Valid = report.Fault == nil
+	return report, segment, nil
+}
+
+// Check whether the blocks of a segment are the blocks at the same indexes of a chain
+func ArchiveMatches(segment *models.Segment, blockchain *models.Blockchain) bool {
+	if segment.ClusterID != blockchain.ClusterID() || segment.To >= len(blockchain.Chain) {
+		return false
+	}
+	for i, block := range segment.Blocks {
+		if blockchain.Chain[segment.From+i].Hash != block.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the paths of the archive files, oldest segment first
+func (network *Network) ListArchives() ([]string, error) {
+	paths, err := filepath.Glob(archivesPath + "/segment-*.json")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		var fromI, fromJ, to int
+		fmt.Sscanf(filepath.Base(paths[i]), "segment-%d-%d.json", &fromI, &to)
+		fmt.Sscanf(filepath.Base(paths[j]), "segment-%d-%d.json", &fromJ, &to)
+		return fromI < fromJ
+	})
+	return paths, nil
+}
+
+// Archive the full segments before keepFrom that have no archive file yet.
+// Reports whether all of them are archived.
+func (network *Network) archiveSegments(keepFrom int) bool {
+	for from := 0; from+segmentSize <= keepFrom; from += segmentSize {
+		to := from + segmentSize - 1
+		if _, err := os.Stat(segmentPath(from, to)); err == nil {
+			continue
+		}
+		if _, err := network.ExportSegment(from, to); err != nil {
+			debug.Log("err", fmt.Sprintf("Failed to archive blocks %d to %d: %s", from, to, err))
+			return false
+		}
+	}
+	return true
+}
+
+// Periodically erase the payloads of other peers' conversations that are older than the
+// window. Observers keep every payload, as they serve the history to others.
+func (network *Network) pruneLoop() {
+	window := pruneWindow()
+	if window == 0 || nodeMode() == observerMode {
+		return
+	}
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		length := 0
+		network.ConsensusService.View(func(blockchain *models.Blockchain) {
+			length = len(blockchain.Chain)
+		})
+		keepFrom := length - window
+		if keepFrom <= 0 {
+			continue
+		}
+		// Segments are archived whole, so only the blocks of archived segments are pruned
+		if debug.ArchiveSegments {
+			if !network.archiveSegments(keepFrom) {
+				continue
+			}
+			keepFrom -= keepFrom % segmentSize
+		}
+
+		self := network.P2pService.Host.ID().String()
+		consensusService := network.ConsensusService
+		consensusService.chainLock.Lock()
+		pruned := consensusService.Blockchain.Prune(self, keepFrom)
+		consensusService.chainLock.Unlock()
+		if pruned > 0 {
+			debug.Log("prune", fmt.Sprintf("Pruned %d payloads before block %d", pruned, keepFrom))
+		}
+	}
+}
+
+// Put back the erased payloads of this node's own conversations from peers that still
+// have them, such as after installing a snapshot of a node that pruned them. Payloads
+// erased by a retention setting are restored too if a peer still has them, and erased
+// again by the next retention pass.
+func (network *Network) refillPayloads() {
+	self := network.P2pService.Host.ID().String()
+	// Block indexes holding erased entries of our conversations
+	missing := make(map[int]bool)
+	candidates := make([]peer.ID, 0)
+	seen := make(map[peer.ID]bool)
+	addCandidate := func(peerIDStr string) {
+		peerID, err := peer.Decode(peerIDStr)
+		if err != nil || peerID.String() == self || seen[peerID] {
+			return
+		}
+		seen[peerID] = true
+		candidates = append(candidates, peerID)
+	}
+
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		// Conversation peer of each of our message entries, by hash
+		peers := make(map[string]string)
+		for _, entry := range blockchain.Entries() {
+			switch entry.BlockType {
+			case "message":
+				message := entry.Data.(*models.MessageData).Message
+				if message.Sender != self && message.Receiver != self {
+					continue
+				}
+				other := message.Sender
+				if other == self {
+					other = message.Receiver
+				}
+				peers[entry.Hash] = other
+				if message.Erased() {
+					missing[entry.Index] = true
+					addCandidate(other)
+				}
+			case "edit":
+				edit := entry.Data.(*models.EditData).MessageEdit
+				if other, ours := peers[edit.TargetHash]; ours && edit.Message == "" && edit.PayloadHash != "" {
+					missing[entry.Index] = true
+					addCandidate(other)
+				}
+			}
+		}
+	})
+	if len(missing) == 0 {
+		return
+	}
+
+	// Fall back on the other members once the conversation peers were asked
+	if configuration, err := network.ConsensusService.Membership.configuration(); err == nil {
+		for _, server := range configuration.Servers {
+			addCandidate(string(server.ID))
+		}
+	}
+
+	restored := 0
+	for _, peerID := range candidates {
+		for from := 0; len(missing) > 0; {
+			// Ask for the page starting at the next block still missing
+			next := -1
+			for index := range missing {
+				if index >= from && (next == -1 || index < next) {
+					next = index
+				}
+			}
+			if next == -1 {
+				break
+			}
+			history, err := network.RequestHistory(peerID.String(), next, maxHistoryBlocks)
+			if err != nil || len(history.Blocks) == 0 {
+				break
+			}
+			restored += network.restorePayloads(history.Blocks, missing)
+			from = history.Blocks[len(history.Blocks)-1].Index + 1
+		}
+		if len(missing) == 0 {
+			break
+		}
+	}
+	if restored > 0 {
+		debug.Log("prune", fmt.Sprintf("Restored %d payloads of our conversations", restored))
+	}
+}
+
+// Restore the erased payloads of the missing blocks from copies fetched from a peer,
+// forgetting the blocks a payload was restored in. Returns the number of payloads restored.
+func (network *Network) restorePayloads(blocks []*models.Block, missing map[int]bool) int {
+	consensusService := network.ConsensusService
+	consensusService.chainLock.Lock()
+	defer consensusService.chainLock.Unlock()
+
+	chain := consensusService.Blockchain.Chain
+	restored := 0
+	for _, block := range blocks {
+		if !missing[block.Index] || block.Index >= len(chain) || chain[block.Index].Hash != block.Hash {
+			continue
+		}
+		local := chain[block.Index]
+		count := 0
+		if local.BlockType != "batch" {
+			if local.RestorePayload(block) {
+				count++
+			}
+		} else {
+			for i, entry := range local.Entries {
+				if i < len(block.Entries) && entry.RestorePayload(block.Entries[i]) {
+					count++
+				}
+			}
+		}
+		if count > 0 {
+			delete(missing, block.Index)
+			restored += count
+		}
+	}
+	return restored
+}
@@ -6,21 +6,47 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 
-	"github.com/libp2p/go-libp2p-core/peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// The topic every node joins, it carries the consensus traffic
+const meshTopic = "messagemesh"
+
 // Define a message envelope structure
 type MessageEnvelope struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data"`
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data"`
+	Topic string          `json:"topic,omitempty"` // Room topic to publish to (empty for the mesh topic)
+}
+
+// A value received on a topic, with the signed pubsub message it was published in
+type InboundPacket struct {
+	Value any
+	// Set for messages and first messages, so an observer can hold them for their author
+	Signed []byte
 }
 
-func JoinPubSub(p2phost *P2PService) (*PubSubService, error) {
+// A joined room topic with its own subscription
+type pubSubRoom struct {
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	events *pubsub.TopicEventHandler
+	cancel context.CancelFunc
+}
+
+func JoinPubSub(p2phost *P2PService, events *EventBus) (*PubSubService, error) {
+
+	// Validate every envelope before it is delivered or forwarded
+	if err := p2phost.PubSub.RegisterTopicValidator(meshTopic, validateEnvelope); err != nil {
+		debug.Log("err", "Could not register the chat room validator")
+		return nil, err
+	}
 
 	// Create a PubSub topic with the room name
-	topic, err := p2phost.PubSub.Join("messagemesh")
+	topic, err := p2phost.PubSub.Join(meshTopic)
 	// Check the error
 	if err != nil {
 		debug.Log("err", "Could not join the chat room")
@@ -42,20 +68,22 @@ func JoinPubSub(p2phost *P2PService) (*PubSubService, error) {
 
 	// Create a ChatRoom object
 	pubsubservice := &PubSubService{
-		Inbound:   make(chan any),
-		Outbound:  make(chan any),
-		PeerJoin:  make(chan peer.ID, 10),
-		PeerLeave: make(chan peer.ID, 10),
-		PeerIDs:   make(chan []peer.ID, 10),
-		psctx:     pubsubctx,
-		pscancel:  cancel,
-		pstopic:   topic,
-		psub:      sub,
-		selfid:    p2phost.Host.ID(),
+		Topic:    meshTopic,
+		Inbound:  make(chan InboundPacket),
+		Signals:  make(chan models.Signal, 32),
+		Outbound: make(chan any),
+		events:   events,
+		psctx:    pubsubctx,
+		pscancel: cancel,
+		pstopic:  topic,
+		psub:     sub,
+		selfid:   p2phost.Host.ID(),
+		pubsub:   p2phost.PubSub,
+		rooms:    make(map[string]*pubSubRoom),
 	}
 
 	// Start the subscribe loop
-	go pubsubservice.SubLoop()
+	go pubsubservice.SubLoop(pubsubctx, sub, meshTopic)
 	debug.Log("pubsub", "SubLoop started")
 
 	// Start the publish loop
@@ -89,10 +117,26 @@ func (pubSubService *PubSubService) PubLoop() {
 			}
 			// fmt.Println(green + "[chatRoom.go]" + " [" + time.Now().Format("15:04:05") + "] " + reset + "Pub Message marshalled")
 
-			// Publish the message to the topic
-			err = pubSubService.pstopic.Publish(pubSubService.psctx, messagebytes)
+			// Publish the message to its room, or to the mesh topic
+			topic := pubSubService.pstopic
+			if envelope, ok := packet.(MessageEnvelope); ok && envelope.Topic != "" && envelope.Topic != meshTopic {
+				pubSubService.mu.RLock()
+				room, joined := pubSubService.rooms[envelope.Topic]
+				pubSubService.mu.RUnlock()
+				if !joined {
+					debug.Log("err", "Could not publish to room that is not joined: "+envelope.Topic)
+					continue
+				}
+				topic = room.topic
+			}
+			err = topic.Publish(pubSubService.psctx, messagebytes)
 			if err != nil {
 				debug.Log("err", "Could not publish to topic")
+				if envelope, ok := packet.(MessageEnvelope); ok {
+					if id, receiver := envelopeMessage(envelope); id != "" {
+						pubSubService.events.Publish(Event{Type: EventSendStatus, Send: &SendStatus{MessageID: id, Receiver: receiver, Status: "failed", Error: err.Error()}})
+					}
+				}
 				continue
 			}
 			// fmt.Println(green + "[chatRoom.go]" + " [" + time.Now().Format("15:04:05") + "] " + reset + "Pub Message published")
@@ -101,20 +145,25 @@ func (pubSubService *PubSubService) PubLoop() {
 }
 
 // A method of ChatRoom that continously reads from the subscription
-// until either the subscription or pubsub context closes.
+// until either the subscription or its context closes.
 // The recieved message is parsed sent into the inbound channel
-func (pubSubService *PubSubService) SubLoop() {
+func (pubSubService *PubSubService) SubLoop(ctx context.Context, sub *pubsub.Subscription, topicName string) {
 	// Start loop
 	for {
 		select {
-		case <-pubSubService.psctx.Done():
+		case <-ctx.Done():
 			return
 
 		default:
 			// Read a message from the subscription
-			packet, err := pubSubService.psub.Next(pubSubService.psctx)
+			packet, err := sub.Next(ctx)
 			// Check error
 			if err != nil {
+				// Rooms can be left, only the mesh subscription closes the messages queue
+				if topicName != meshTopic {
+					debug.Log("pubsub", "Room subscription has closed: "+topicName)
+					return
+				}
 				// Close the messages queue (subscription has closed)
 				close(pubSubService.Inbound)
 				debug.Log("err", "Subscription has closed")
@@ -144,7 +193,7 @@ func (pubSubService *PubSubService) SubLoop() {
 					debug.Log("err", "Could not unmarshal Message: "+err.Error())
 					continue
 				}
-				pubSubService.Inbound <- *message
+				pubSubService.Inbound <- InboundPacket{Value: *message, Signed: signedPacket(packet)}
 
 			case "FirstMessage":
 				firstMessage := &models.FirstMessage{}
@@ -152,7 +201,7 @@ func (pubSubService *PubSubService) SubLoop() {
 					debug.Log("err", "Could not unmarshal FirstMessage: "+err.Error())
 					continue
 				}
-				pubSubService.Inbound <- *firstMessage
+				pubSubService.Inbound <- InboundPacket{Value: *firstMessage, Signed: signedPacket(packet)}
 
 			case "Account":
 				account := &models.Account{}
@@ -160,7 +209,44 @@ func (pubSubService *PubSubService) SubLoop() {
 					debug.Log("err", "Could not unmarshal Account: "+err.Error())
 					continue
 				}
-				pubSubService.Inbound <- *account
+				pubSubService.Inbound <- InboundPacket{Value: *account}
+
+			case "MessageEdit":
+				edit := &models.MessageEdit{}
+				if err := json.Unmarshal(envelope.Data, edit); err != nil {
+					debug.Log("err", "Could not unmarshal MessageEdit: "+err.Error())
+					continue
+				}
+				pubSubService.Inbound <- InboundPacket{Value: *edit}
+
+			case "Reaction":
+				reaction := &models.Reaction{}
+				if err := json.Unmarshal(envelope.Data, reaction); err != nil {
+					debug.Log("err", "Could not unmarshal Reaction: "+err.Error())
+					continue
+				}
+				pubSubService.Inbound <- InboundPacket{Value: *reaction}
+
+			case "Retention":
+				retention := &models.Retention{}
+				if err := json.Unmarshal(envelope.Data, retention); err != nil {
+					debug.Log("err", "Could not unmarshal Retention: "+err.Error())
+					continue
+				}
+				pubSubService.Inbound <- InboundPacket{Value: *retention}
+
+			case "Signal":
+				signal := &models.Signal{}
+				if err := json.Unmarshal(envelope.Data, signal); err != nil {
+					debug.Log("err", "Could not unmarshal Signal: "+err.Error())
+					continue
+				}
+				// Signals are ephemeral, drop them if nobody is listening
+				select {
+				case pubSubService.Signals <- *signal:
+				default:
+					debug.Log("pubsub", "Signal channel full, dropping signal")
+				}
 
 			default:
 				debug.Log("warn", "Unknown message type: "+envelope.Type)
@@ -169,6 +255,16 @@ func (pubSubService *PubSubService) SubLoop() {
 	}
 }
 
+// Marshal a received pubsub message with its signature, nil if it cannot be
+func signedPacket(packet *pubsub.Message) []byte {
+	signed, err := packet.Message.Marshal()
+	if err != nil {
+		debug.Log("err", "Could not marshal pubsub message: "+err.Error())
+		return nil
+	}
+	return signed
+}
+
 func (pubSubService *PubSubService) PeerJoinedLoop() {
 	// Get the event handler for the topic
 	evts, err := pubSubService.pstopic.EventHandler()
@@ -177,11 +273,6 @@ func (pubSubService *PubSubService) PeerJoinedLoop() {
 		return
 	}
 
-	// Initialize PeerIDs channel if not already initialized
-	if pubSubService.PeerIDs == nil {
-		pubSubService.PeerIDs = make(chan []peer.ID, 10)
-	}
-
 	for {
 		peerEvent, err := evts.NextPeerEvent(context.Background())
 		if err != nil {
@@ -192,41 +283,24 @@ func (pubSubService *PubSubService) PeerJoinedLoop() {
 		switch peerEvent.Type {
 		case pubsub.PeerJoin:
 			debug.Log("pubsub", fmt.Sprintf("Peer joined: %s", peerEvent.Peer))
-			select {
-			case pubSubService.PeerJoin <- peerEvent.Peer:
-				debug.Log("pubsub", fmt.Sprintf("Successfully sent peer join event for: %s", peerEvent.Peer))
-			default:
-				debug.Log("err", fmt.Sprintf("Channel blocked, couldn't send peer join event for: %s", peerEvent.Peer))
-			}
-
-			// Send updated peer list
-			select {
-			case pubSubService.PeerIDs <- pubSubService.PeerList():
-				debug.Log("pubsub", "Sent updated peer list")
-			default:
-				debug.Log("err", "Channel blocked, couldn't send updated peer list")
-			}
-
+			pubSubService.events.Publish(Event{Type: EventPeerJoined, Peer: peerEvent.Peer.String()})
 		case pubsub.PeerLeave:
 			debug.Log("pubsub", fmt.Sprintf("Peer left: %s", peerEvent.Peer))
-			select {
-			case pubSubService.PeerLeave <- peerEvent.Peer:
-				debug.Log("pubsub", fmt.Sprintf("Successfully sent peer leave event for: %s", peerEvent.Peer))
-			default:
-				debug.Log("err", fmt.Sprintf("Channel blocked, couldn't send peer leave event for: %s", peerEvent.Peer))
-			}
-
-			// Send updated peer list
-			select {
-			case pubSubService.PeerIDs <- pubSubService.PeerList():
-				debug.Log("pubsub", "Sent updated peer list")
-			default:
-				debug.Log("err", "Channel blocked, couldn't send updated peer list")
-			}
+			pubSubService.events.Publish(Event{Type: EventPeerLeft, Peer: peerEvent.Peer.String()})
 		}
+		pubSubService.publishPeerList()
 	}
 }
 
+// Publish the peers of the active room
+func (pubSubService *PubSubService) publishPeerList() {
+	peers := make([]string, 0)
+	for _, peerID := range pubSubService.ActivePeerList() {
+		peers = append(peers, peerID.String())
+	}
+	pubSubService.events.Publish(Event{Type: EventPeerList, Peers: peers})
+}
+
 // A method of ChatRoom that returns a list
 // of all peer IDs connected to it
 func (pubSubService *PubSubService) PeerList() []peer.ID {
@@ -234,11 +308,184 @@ func (pubSubService *PubSubService) PeerList() []peer.ID {
 	return pubSubService.pstopic.ListPeers()
 }
 
+// Join a room topic with its own subscription, joining twice is a no-op
+func (pubSubService *PubSubService) JoinTopic(name string) error {
+	pubSubService.mu.Lock()
+	defer pubSubService.mu.Unlock()
+
+	if name == meshTopic {
+		return nil
+	}
+	if _, joined := pubSubService.rooms[name]; joined {
+		return nil
+	}
+
+	if err := pubSubService.pubsub.RegisterTopicValidator(name, validateEnvelope); err != nil {
+		debug.Log("err", "Could not register validator for room "+name)
+		return err
+	}
+	topic, err := pubSubService.pubsub.Join(name)
+	if err != nil {
+		pubSubService.pubsub.UnregisterTopicValidator(name)
+		debug.Log("err", "Could not join room "+name)
+		return err
+	}
+	// Rooms are scored like the mesh topic
+	if err := topic.SetScoreParams(topicScoreParams()); err != nil {
+		debug.Log("err", fmt.Sprintf("Could not set score parameters for room %s: %s", name, err))
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		pubSubService.pubsub.UnregisterTopicValidator(name)
+		debug.Log("err", "Could not subscribe to room "+name)
+		return err
+	}
+	evts, err := topic.EventHandler()
+	if err != nil {
+		sub.Cancel()
+		topic.Close()
+		pubSubService.pubsub.UnregisterTopicValidator(name)
+		debug.Log("err", "Could not get event handler for room "+name)
+		return err
+	}
+
+	roomctx, cancel := context.WithCancel(pubSubService.psctx)
+	room := &pubSubRoom{
+		topic:  topic,
+		sub:    sub,
+		events: evts,
+		cancel: cancel,
+	}
+	pubSubService.rooms[name] = room
+
+	go pubSubService.SubLoop(roomctx, sub, name)
+	go pubSubService.roomPeerLoop(roomctx, name, evts)
+	debug.Log("pubsub", "Joined room "+name)
+	return nil
+}
+
+// Leave a room topic, the mesh topic cannot be left
+func (pubSubService *PubSubService) LeaveTopic(name string) error {
+	pubSubService.mu.Lock()
+	defer pubSubService.mu.Unlock()
+
+	if name == meshTopic {
+		return fmt.Errorf("cannot leave the mesh topic")
+	}
+	room, joined := pubSubService.rooms[name]
+	if !joined {
+		return fmt.Errorf("room %s is not joined", name)
+	}
+
+	room.cancel()
+	room.sub.Cancel()
+	room.events.Cancel()
+	if err := room.topic.Close(); err != nil {
+		debug.Log("err", fmt.Sprintf("Could not close room %s: %s", name, err))
+	}
+	pubSubService.pubsub.UnregisterTopicValidator(name)
+	delete(pubSubService.rooms, name)
+
+	// Fall back to the mesh topic if the active room was left
+	if pubSubService.Topic == name {
+		pubSubService.Topic = meshTopic
+	}
+	debug.Log("pubsub", "Left room "+name)
+	return nil
+}
+
+// Switch the active room, joining it if needed
+func (pubSubService *PubSubService) SetActiveTopic(name string) error {
+	if err := pubSubService.JoinTopic(name); err != nil {
+		return err
+	}
+	pubSubService.mu.Lock()
+	pubSubService.Topic = name
+	pubSubService.mu.Unlock()
+	debug.Log("pubsub", "Active room is now "+name)
+
+	// Send the peer list of the new room
+	pubSubService.publishPeerList()
+	return nil
+}
+
+// Get the name of the active room
+func (pubSubService *PubSubService) ActiveTopic() string {
+	pubSubService.mu.RLock()
+	defer pubSubService.mu.RUnlock()
+	return pubSubService.Topic
+}
+
+// Check whether a topic is joined, the mesh topic always is
+func (pubSubService *PubSubService) Joined(name string) bool {
+	if name == meshTopic {
+		return true
+	}
+	pubSubService.mu.RLock()
+	defer pubSubService.mu.RUnlock()
+	_, joined := pubSubService.rooms[name]
+	return joined
+}
+
+// Get the names of all joined topics, starting with the mesh topic
+func (pubSubService *PubSubService) Topics() []string {
+	pubSubService.mu.RLock()
+	defer pubSubService.mu.RUnlock()
+
+	topics := []string{meshTopic}
+	for name := range pubSubService.rooms {
+		topics = append(topics, name)
+	}
+	sort.Strings(topics[1:])
+	return topics
+}
+
+// Get the peers in a joined topic
+func (pubSubService *PubSubService) TopicPeerList(name string) []peer.ID {
+	if name == meshTopic {
+		return pubSubService.PeerList()
+	}
+	pubSubService.mu.RLock()
+	room, joined := pubSubService.rooms[name]
+	pubSubService.mu.RUnlock()
+	if !joined {
+		return []peer.ID{}
+	}
+	return room.topic.ListPeers()
+}
+
+// Get the peers in the active room
+func (pubSubService *PubSubService) ActivePeerList() []peer.ID {
+	return pubSubService.TopicPeerList(pubSubService.ActiveTopic())
+}
+
+// Publish the peer list of a room when its peers change while it is active.
+// Raft membership only follows the mesh topic, see PeerJoinedLoop.
+func (pubSubService *PubSubService) roomPeerLoop(ctx context.Context, name string, evts *pubsub.TopicEventHandler) {
+	for {
+		peerEvent, err := evts.NextPeerEvent(ctx)
+		if err != nil {
+			return
+		}
+		debug.Log("pubsub", fmt.Sprintf("Room %s peer event: %s", name, peerEvent.Peer))
+		if pubSubService.ActiveTopic() != name {
+			continue
+		}
+		pubSubService.publishPeerList()
+	}
+}
+
 // A method of ChatRoom that updates the chat
 // room by subscribing to the new topic
 func (pubSubService *PubSubService) Exit() {
 	defer pubSubService.pscancel()
 
+	// Leave all rooms
+	for _, name := range pubSubService.Topics()[1:] {
+		pubSubService.LeaveTopic(name)
+	}
+
 	// Cancel the existing subscription
 	pubSubService.psub.Cancel()
 	// Close the topic handler
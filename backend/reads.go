@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	libp2praft "github.com/libp2p/go-libp2p-raft"
+	libp2pnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Stream protocol followers ask the leader for a read index on
+	readIndexProtocol = protocol.ID("/messagemesh/readindex/1.0.0")
+	// How long a linearizable read waits for the leader and for this node to catch up
+	readTimeout = 5 * time.Second
+
+	localReads        = "local"
+	linearizableReads = "linearizable"
+)
+
+// The Raft FSM of a chain, applying and restoring it under the write lock of the chain
+// so that queries holding the read lock never see a block half applied
+type lockedFSM struct {
+	fsm   *libp2praft.FSM
+	state *raftState
+	lock  *sync.RWMutex
+	// Notified after a snapshot was installed, so the chain gets verified
+	restored chan struct{}
+}
+
+// What applying a command did, handed to the leader that committed it
+type applyResult struct {
+	// Whether the chain accepted the op, an op it refused leaves the FSM inconsistent
+	Applied bool
+	// Why ops of a batch were left out, by their position in the batch
+	Rejected map[int]error
+}
+
+func (lockedFSM *lockedFSM) Apply(log *raft.Log) interface{} {
+	lockedFSM.lock.Lock()
+	defer lockedFSM.lock.Unlock()
+	lockedFSM.state.rejected = nil
+	result := lockedFSM.fsm.Apply(log)
+	// Raft only hands commands to the FSM, barriers and configuration changes are not counted
+	lockedFSM.state.Index = log.Index
+	return applyResult{Applied: result != nil, Rejected: lockedFSM.state.rejected}
+}
+
+func (lockedFSM *lockedFSM) Snapshot() (raft.FSMSnapshot, error) {
+	lockedFSM.lock.RLock()
+	defer lockedFSM.lock.RUnlock()
+	return lockedFSM.fsm.Snapshot()
+}
+
+func (lockedFSM *lockedFSM) Restore(reader io.ReadCloser) error {
+	lockedFSM.lock.Lock()
+	defer lockedFSM.lock.Unlock()
+	if err := lockedFSM.fsm.Restore(reader); err != nil {
+		return err
+	}
+	select {
+	case lockedFSM.restored <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+type readIndexResponse struct {
+	Index uint64 `json:"index"`           // Index the reader has to apply before reading
+	Error string `json:"error,omitempty"` // Set if the peer could not serve a read index
+}
+
+// Get the read consistency from READ_CONSISTENCY: local or linearizable
+func readConsistency() string {
+	switch debug.ReadConsistency {
+	case "", localReads:
+		return localReads
+	case linearizableReads:
+		return linearizableReads
+	default:
+		debug.Log("err", fmt.Sprintf("Invalid READ_CONSISTENCY %s, using %s", debug.ReadConsistency, localReads))
+		return localReads
+	}
+}
+
+// Read the local chain under the read lock. The chain must not be used after read returns.
+func (consensusService *ConsensusService) View(read func(blockchain *models.Blockchain)) {
+	consensusService.chainLock.RLock()
+	defer consensusService.chainLock.RUnlock()
+	read(consensusService.Blockchain)
+}
+
+// Read the chain for a query. With linearizable reads this node first catches up with
+// everything the leader committed before the query started.
+func (network *Network) Query(read func(blockchain *models.Blockchain)) error {
+	if network.ConsensusService.ReadConsistency == linearizableReads {
+		index, err := network.readIndex()
+		if err != nil {
+			return fmt.Errorf("linearizable read failed: %s", err.Error())
+		}
+		if err := network.waitForApplied(index); err != nil {
+			return fmt.Errorf("linearizable read failed: %s", err.Error())
+		}
+	}
+	network.ConsensusService.View(read)
+	return nil
+}
+
+// Get the index every committed entry is at or below. The leader confirms it still leads
+// with a barrier, followers forward the request to the leader.
+func (network *Network) readIndex() (uint64, error) {
+	raftInstance := network.ConsensusService.Raft
+	if raftInstance.State() == raft.Leader {
+		// A barrier only commits while we lead, and is applied after every earlier entry
+		if err := raftInstance.Barrier(readTimeout).Error(); err != nil {
+			return 0, err
+		}
+		return network.ConsensusService.appliedIndex(), nil
+	}
+
+	leader, err := peer.Decode(string(raftInstance.Leader()))
+	if err != nil {
+		return 0, fmt.Errorf("there is no leader")
+	}
+	ctx, cancel := context.WithTimeout(network.P2pService.Ctx, readTimeout)
+	defer cancel()
+
+	stream, err := network.P2pService.Host.NewStream(ctx, leader, readIndexProtocol)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(readTimeout))
+
+	response := readIndexResponse{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxJoinMessageSize)).Decode(&response); err != nil {
+		return 0, err
+	}
+	if response.Error != "" {
+		return 0, fmt.Errorf("%s", response.Error)
+	}
+	return response.Index, nil
+}
+
+// Answer a read index request of a member
+func (network *Network) handleReadIndex(stream libp2pnetwork.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(readTimeout))
+	remote := stream.Conn().RemotePeer()
+
+	consensusService := network.ConsensusService
+	if !consensusService.Membership.isMember(remote) || !network.P2pService.PeerAllowed(remote) {
+		debug.Log("raft", fmt.Sprintf("Refused read index request from %s", remote))
+		stream.Reset()
+		return
+	}
+
+	response := readIndexResponse{}
+	if consensusService.Raft.State() != raft.Leader {
+		response.Error = "not the leader"
+	} else if index, err := network.readIndex(); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Index = index
+	}
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to answer read index request from %s: %s", remote, err))
+	}
+}
+
+// Get the index of the last command applied to the chain
+func (consensusService *ConsensusService) appliedIndex() uint64 {
+	consensusService.chainLock.RLock()
+	defer consensusService.chainLock.RUnlock()
+	return consensusService.state.Index
+}
+
+// Wait until the chain has applied the command at an index
+func (network *Network) waitForApplied(index uint64) error {
+	consensusService := network.ConsensusService
+	deadline := time.Now().Add(readTimeout)
+	for consensusService.appliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("applied %d of %d", consensusService.appliedIndex(), index)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
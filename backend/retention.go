@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// How often expired messages are erased
+const retentionInterval = time.Minute
+
+// Propose a retention setting for the conversation with a peer in a room
+func (network *Network) SendRetention(peer string, expireAfterHours int, keepLast int, room string) {
+	sender := network.PubSubService.SelfID().String()
+	retention := models.Retention{
+		PeerIDs:          []string{sender, peer},
+		ExpireAfterHours: expireAfterHours,
+		KeepLast:         keepLast,
+		Setter:           sender,
+		Timestamp:        time.Now().Format(time.RFC3339),
+	}
+
+	// Marshal retention to JSON
+	retentionJSON, err := json.Marshal(retention)
+	if err != nil {
+		debug.Log("retention", fmt.Sprintf("Error marshaling retention: %s", err.Error()))
+		return
+	}
+
+	if err := network.publishToRoom("Retention", retentionJSON, room, mergeRequest{Retentions: []models.Retention{retention}}); err != nil {
+		debug.Log("retention", fmt.Sprintf("Error sending retention: %s", err.Error()))
+	}
+}
+
+// Periodically erase the payloads of expired messages on this node
+func (network *Network) retentionLoop() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Erasing changes blocks in place, so queries must not read them meanwhile
+		consensusService := network.ConsensusService
+		consensusService.chainLock.Lock()
+		erased := consensusService.Blockchain.ApplyRetention(time.Now())
+		consensusService.chainLock.Unlock()
+		if erased > 0 {
+			debug.Log("retention", fmt.Sprintf("Erased %d expired messages", erased))
+		}
+	}
+}
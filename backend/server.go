@@ -10,9 +10,13 @@ import (
 	"os"
 	"sort"
 	"time"
+
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-func (network *Network) ConnectToNetwork() {
+// Start the services of the node, it fails when the node must not start
+func (network *Network) ConnectToNetwork() error {
 	debug.Log("server", "This may take upto 30 seconds.")
 
 	// Initialize system monitor
@@ -24,66 +28,218 @@ func (network *Network) ConnectToNetwork() {
 		go network.runMonitoring(monitor)
 	}
 
+	// Create the event bus before the services publishing to it
+	network.Events = NewEventBus()
+
 	// Create a new P2PHost
-	network.P2pService = NewP2PService()
+	p2pService, err := NewP2PService()
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Failed to set up P2P: %s", err.Error()))
+		return err
+	}
+	network.P2pService = p2pService
 	debug.Log("server", "Completed P2P Setup")
 
+	// Reconnect to known peers and keep the static peers connected
+	network.P2pService.RedialAddressBook()
+	go network.P2pService.KeepStaticPeers()
+
+	// Find peers on the local network, this works without internet access
+	if debug.MdnsEnabled {
+		network.P2pService.MdnsConnect()
+	}
+
 	// Connect to peers with the chosen discovery method
 	network.P2pService.AdvertiseConnect()
 	// network.P2p.AnnounceConnect()
 	debug.Log("server", "Connected to Service Peers")
 	// Join the chat room
-	network.PubSubService, _ = JoinPubSub(network.P2pService)
+	network.PubSubService, _ = JoinPubSub(network.P2pService, network.Events)
 	debug.Log("server", "Joined the PubSub")
-	// Wait for network setup to complete
-	time.Sleep(time.Second * 5)
-	debug.Log("server", "Connected to Service Peers")
+
+	// Accept signals and follow the messages of our conversations, subscribed before the first block is committed
+	go network.signalLoop()
+	go network.messageLoop(network.Events.Subscribe("messages", internalEventBuffer(), EventBlockCommitted, EventSignal))
 
 	debug.Log("server", fmt.Sprintf("My Peer ID: %s", network.PubSubService.SelfID()))
 	debug.Log("server", fmt.Sprintf("My Multiaddress: %s", network.P2pService.AllNodeAddr()))
 
 	network.ConsensusService, _ = StartConsensus(network)
 	debug.Log("server", "Blockchain loaded")
+
+	// Start broadcasting presence
+	go network.presenceLoop()
+
+	// Start erasing expired messages
+	go network.retentionLoop()
+
+	// Start pruning the payloads of other peers' conversations, if PRUNE_WINDOW is set
+	go network.pruneLoop()
+
+	// Serve the HTTP API, if API_ADDR is set
+	go network.startAPI()
+
+	// Let the command line talk to this node
+	go network.startControlSocket()
+	return nil
+}
+
+// Send a message to a peer in a room, the active room if room is empty
+func (network *Network) SendMessage(message string, receiver string, room string) {
+	network.SendReply(message, receiver, "", room)
+}
+
+// Send a message in reply to the message with the replyTo ID (empty for none)
+func (network *Network) SendReply(message string, receiver string, replyTo string, room string) {
+	network.QueueReply(message, receiver, replyTo, room)
 }
 
-func (network *Network) SendMessage(message string, receiver string) {
+// Queue a reply for publishing to a room, returning the ID of the message
+func (network *Network) QueueReply(message string, receiver string, replyTo string, room string) (string, error) {
 	sender := network.PubSubService.SelfID().String() // Self ID
 	msg := models.Message{
+		ID:        models.NewMessageID(),
 		Sender:    sender,
 		Receiver:  receiver,
 		Message:   message,
 		Timestamp: time.Now().Format(time.RFC3339),
+		ReplyTo:   replyTo,
 	}
 
 	// Marshal message to JSON
 	messageJSON, err := json.Marshal(msg)
 	if err != nil {
 		debug.Log("server", fmt.Sprintf("Error marshaling message: %s", err.Error()))
-		return
+		network.publishSendStatus(SendStatus{MessageID: msg.ID, Receiver: receiver, Status: "failed", Error: err.Error()})
+		return "", err
 	}
 
-	network.PubSubService.Outbound <- MessageEnvelope{
-		Type: "Message",
-		Data: messageJSON,
+	if err := network.publishToRoom("Message", messageJSON, room, mergeRequest{Messages: []models.Message{msg}}); err != nil {
+		debug.Log("server", fmt.Sprintf("Error sending message: %s", err.Error()))
+		network.publishSendStatus(SendStatus{MessageID: msg.ID, Receiver: receiver, Status: "failed", Error: err.Error()})
+		return "", err
 	}
+	network.publishSendStatus(SendStatus{MessageID: msg.ID, Receiver: receiver, Status: "sent"})
+	return msg.ID, nil
 }
 
-func (network *Network) SendEncryptedMessage(message string, receiver string) {
+func (network *Network) SendEncryptedMessage(message string, receiver string, room string) {
+	network.SendEncryptedReply(message, receiver, "", room)
+}
+
+func (network *Network) SendEncryptedReply(message string, receiver string, replyTo string, room string) {
+	network.QueueEncryptedReply(message, receiver, replyTo, room)
+}
+
+// Encrypt a reply and queue it for publishing to a room, returning the ID of the message
+func (network *Network) QueueEncryptedReply(message string, receiver string, replyTo string, room string) (string, error) {
 	sender := network.PubSubService.SelfID().String() // Self ID
 	peerIDs := []string{sender, receiver}
 	sort.Strings(peerIDs)
 
 	// Encrypt the message with the symmetric key
-	encryptedMessage, err := network.EncryptMessage(message, receiver)
+	encryptedMessage, err := network.EncryptMessage(message, receiver, room)
 	if err != nil {
 		debug.Log("server", fmt.Sprintf("Error encrypting message for %s: %s", receiver, err.Error()))
-		return
+		network.publishSendStatus(SendStatus{Receiver: receiver, Status: "failed", Error: err.Error()})
+		return "", err
 	}
 	debug.Log("server", fmt.Sprintf("Sending encrypted message: %s", encryptedMessage))
-	network.SendMessage(encryptedMessage, receiver)
+	return network.QueueReply(encryptedMessage, receiver, replyTo, room)
+}
+
+// React to a message with an emoji, or remove an earlier reaction, in a room
+func (network *Network) SendReaction(messageID string, emoji string, remove bool, room string) {
+	reaction := models.Reaction{
+		MessageID: messageID,
+		Sender:    network.PubSubService.SelfID().String(),
+		Emoji:     emoji,
+		Remove:    remove,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+
+	// Marshal reaction to JSON
+	reactionJSON, err := json.Marshal(reaction)
+	if err != nil {
+		debug.Log("server", fmt.Sprintf("Error marshaling reaction: %s", err.Error()))
+		return
+	}
+
+	if err := network.publishToRoom("Reaction", reactionJSON, room, mergeRequest{Reactions: []models.Reaction{reaction}}); err != nil {
+		debug.Log("server", fmt.Sprintf("Error sending reaction: %s", err.Error()))
+	}
 }
 
-func (network *Network) EncryptMessage(message string, receiver string) (string, error) {
+// Edit one of our messages on the blockchain from a room, an empty message deletes it
+func (network *Network) SendMessageEdit(targetHash string, message string, room string) error {
+	var target *models.Block
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		if block := blockchain.GetBlockByHash(targetHash); block != nil {
+			target = block.Copy()
+		}
+	})
+	if target == nil || target.BlockType != "message" {
+		return fmt.Errorf("message block %s not found", targetHash)
+	}
+
+	keyPair, err := ReadKeyPair()
+	if err != nil {
+		debug.Log("server", fmt.Sprintf("Error reading key pair: %s", err.Error()))
+		return err
+	}
+	publicKey, err := libp2pcrypto.MarshalPublicKey(keyPair.PubKey)
+	if err != nil {
+		debug.Log("server", fmt.Sprintf("Error marshalling public key: %s", err.Error()))
+		return err
+	}
+
+	edit := models.MessageEdit{
+		Sender:      network.PubSubService.SelfID().String(),
+		TargetIndex: target.Index,
+		TargetHash:  target.Hash,
+		Message:     message,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		PublicKey:   publicKey,
+	}
+	edit.Signature, err = keyPair.SignWithPrivateKey(edit.SigningBytes())
+	if err != nil {
+		debug.Log("server", fmt.Sprintf("Error signing edit: %s", err.Error()))
+		return err
+	}
+
+	// Marshal edit to JSON
+	editJSON, err := json.Marshal(edit)
+	if err != nil {
+		debug.Log("server", fmt.Sprintf("Error marshaling edit: %s", err.Error()))
+		return err
+	}
+
+	return network.publishToRoom("MessageEdit", editJSON, room, mergeRequest{Edits: []models.MessageEdit{edit}})
+}
+
+// Edit one of our encrypted messages, the replacement is encrypted for the same receiver
+func (network *Network) SendEncryptedMessageEdit(targetHash string, message string, room string) error {
+	var target *models.Block
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		if block := blockchain.GetBlockByHash(targetHash); block != nil {
+			target = block.Copy()
+		}
+	})
+	if target == nil || target.BlockType != "message" {
+		return fmt.Errorf("message block %s not found", targetHash)
+	}
+
+	receiver := target.Data.(*models.MessageData).Receiver
+	encryptedMessage, err := network.EncryptMessage(message, receiver, room)
+	if err != nil {
+		debug.Log("server", fmt.Sprintf("Error encrypting edit for %s: %s", receiver, err.Error()))
+		return err
+	}
+	return network.SendMessageEdit(targetHash, encryptedMessage, room)
+}
+
+// Encrypt a message for a receiver, the first message of a new conversation is sent to the room
+func (network *Network) EncryptMessage(message string, receiver string, room string) (string, error) {
 	sender := network.PubSubService.SelfID().String() // Self ID
 	peerIDs := []string{sender, receiver}
 	sort.Strings(peerIDs)
@@ -97,7 +253,10 @@ func (network *Network) EncryptMessage(message string, receiver string) (string,
 	if symmetricKey == nil {
 		debug.Log("server", fmt.Sprintf("Symmetric key not found in keyMap for %s and %s", peerIDs[0], peerIDs[1]))
 		// Check if the firstMessage is shared between the two peers in the blockchain
-		firstMessage := network.ConsensusService.Blockchain.CheckPeerFirstMessage(peerIDs)
+		var firstMessage *models.FirstMessage
+		network.ConsensusService.View(func(blockchain *models.Blockchain) {
+			firstMessage = blockchain.CheckPeerFirstMessage(peerIDs)
+		})
 		keyPair, err := ReadKeyPair()
 		if err != nil {
 			debug.Log("server", fmt.Sprintf("Error reading key pair: %s", err.Error()))
@@ -114,7 +273,7 @@ func (network *Network) EncryptMessage(message string, receiver string) (string,
 		} else {
 			// If the first message is not found, send a first message and decrypt the symmetric key with the private key
 			debug.Log("server", fmt.Sprintf("First message not found for %s and %s", peerIDs[0], peerIDs[1]))
-			firstMessage, err := network.SendFirstMessage(peerIDs, receiver)
+			firstMessage, err := network.SendFirstMessage(peerIDs, receiver, room)
 			if err != nil {
 				debug.Log("server", fmt.Sprintf("Error sending first message to %s and %s: %s", peerIDs[0], peerIDs[1], err.Error()))
 				return "", err
@@ -151,7 +310,10 @@ func (network *Network) DecryptMessage(message string, peerIDs []string) (string
 	if symmetricKey == nil {
 		debug.Log("server", fmt.Sprintf("Symmetric key not found in keyMap for %s and %s", peerIDs[0], peerIDs[1]))
 		// Check if the firstMessage is shared between the two peers in the blockchain
-		firstMessage := network.ConsensusService.Blockchain.CheckPeerFirstMessage(peerIDs)
+		var firstMessage *models.FirstMessage
+		network.ConsensusService.View(func(blockchain *models.Blockchain) {
+			firstMessage = blockchain.CheckPeerFirstMessage(peerIDs)
+		})
 		if firstMessage == nil {
 			debug.Log("server", fmt.Sprintf("First message not found for %s and %s", peerIDs[0], peerIDs[1]))
 			return "", fmt.Errorf("first message not found for %s and %s", peerIDs[0], peerIDs[1])
@@ -197,7 +359,7 @@ func (network *Network) DecryptMessage(message string, peerIDs []string) (string
 	return string(decryptedMessage), nil
 }
 
-func (network *Network) SendFirstMessage(peerIDs []string, receiver string) (models.FirstMessage, error) {
+func (network *Network) SendFirstMessage(peerIDs []string, receiver string, room string) (models.FirstMessage, error) {
 	sort.Strings(peerIDs)
 	// Check if the user is online
 	debug.Log("server", fmt.Sprintf("Checking if user %s is online", receiver))
@@ -261,14 +423,74 @@ func (network *Network) SendFirstMessage(peerIDs []string, receiver string) (mod
 		return models.FirstMessage{}, err
 	}
 
-	network.PubSubService.Outbound <- MessageEnvelope{
-		Type: "FirstMessage",
-		Data: firstMessageJSON,
+	if err := network.publishToRoom("FirstMessage", firstMessageJSON, room, mergeRequest{FirstMessages: []models.FirstMessage{firstMessage}}); err != nil {
+		debug.Log("server", fmt.Sprintf("Error sending first message: %s", err.Error()))
+		return models.FirstMessage{}, err
 	}
 	debug.Log("server", fmt.Sprintf("First message sent to %s and %s", peerID0, peerID1))
 	return firstMessage, nil
 }
 
+// Publish conversation traffic to a room, the active room if room is empty. Only the leader
+// commits it, so the item is also handed to the leader directly when it is not in the room.
+func (network *Network) publishToRoom(envelopeType string, data []byte, room string, item mergeRequest) error {
+	if room == "" {
+		room = network.PubSubService.ActiveTopic()
+	}
+	if !network.PubSubService.Joined(room) {
+		return fmt.Errorf("room %s is not joined", room)
+	}
+
+	network.PubSubService.Outbound <- MessageEnvelope{
+		Type:  envelopeType,
+		Data:  data,
+		Topic: room,
+	}
+	go network.sendToLeader(room, item)
+	return nil
+}
+
+// Hand our own item to the leader when it cannot read the room it was published to
+func (network *Network) sendToLeader(room string, item mergeRequest) {
+	consensusService := network.ConsensusService
+	if room == meshTopic || consensusService == nil || consensusService.Raft == nil {
+		return
+	}
+	leaderID := string(consensusService.Raft.Leader())
+	if leaderID == "" || leaderID == network.PubSubService.SelfID().String() {
+		return
+	}
+	for _, member := range network.PubSubService.TopicPeerList(room) {
+		if member.String() == leaderID {
+			return
+		}
+	}
+
+	leader, err := peer.Decode(leaderID)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Invalid leader ID %s: %s", leaderID, err.Error()))
+		return
+	}
+	debug.Log("server", fmt.Sprintf("Leader %s is not in room %s, sending the item directly", leaderID, room))
+	results, err := network.requestMerge(leader, item)
+	if err != nil {
+		debug.Log("err", fmt.Sprintf("Error sending to the leader %s: %s", leaderID, err.Error()))
+		results = make([]MergeResult, 0)
+		for _, message := range item.Messages {
+			results = append(results, MergeResult{Kind: "message", ID: message.ID, Status: "rejected", Error: err.Error()})
+		}
+	}
+	for _, result := range results {
+		if result.Status != "rejected" {
+			continue
+		}
+		debug.Log("err", fmt.Sprintf("Leader rejected %s %s: %s", result.Kind, result.ID, result.Error))
+		if result.Kind == "message" && len(item.Messages) == 1 {
+			network.publishSendStatus(SendStatus{MessageID: result.ID, Receiver: item.Messages[0].Receiver, Status: "failed", Error: result.Error})
+		}
+	}
+}
+
 func (network *Network) runMonitoring(monitor *monitoring.SystemMonitor) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+)
+
+const (
+	// How often presence is broadcast to the topic
+	presenceInterval = 30 * time.Second
+	// Signals older than this are dropped
+	signalMaxAge = 2 * time.Minute
+)
+
+// Rate limiters for ephemeral signals, keyed by sender (inbound)
+// or by signal type and receiver (outbound)
+var (
+	inboundSignalLimiter  = newSignalLimiter(20, 10*time.Second)
+	outboundSignalLimiter = newSignalLimiter(5, 10*time.Second)
+)
+
+// A sliding window rate limiter
+type signalLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	seen   map[string][]time.Time
+	// When keys without recent events were last evicted
+	evicted time.Time
+}
+
+func newSignalLimiter(limit int, window time.Duration) *signalLimiter {
+	return &signalLimiter{
+		limit:  limit,
+		window: window,
+		seen:   make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for the key and reports whether it is within the limit
+func (limiter *signalLimiter) Allow(key string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.evicted) >= limiter.window {
+		limiter.evict(now)
+	}
+	recent := limiter.seen[key][:0]
+	for _, t := range limiter.seen[key] {
+		if now.Sub(t) < limiter.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= limiter.limit {
+		limiter.seen[key] = recent
+		return false
+	}
+	limiter.seen[key] = append(recent, now)
+	return true
+}
+
+// Forget the keys whose last event is outside the window, so idle senders do not pile up
+func (limiter *signalLimiter) evict(now time.Time) {
+	for key, times := range limiter.seen {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= limiter.window {
+			delete(limiter.seen, key)
+		}
+	}
+	limiter.evicted = now
+}
+
+// Sign and publish an ephemeral signal, it is never written to the blockchain
+func (network *Network) SendSignal(signalType string, receiver string, reference string) error {
+	if !outboundSignalLimiter.Allow(signalType + receiver) {
+		return fmt.Errorf("%s signal to %s is rate limited", signalType, receiver)
+	}
+
+	keyPair, err := ReadKeyPair()
+	if err != nil {
+		debug.Log("signals", fmt.Sprintf("Error reading key pair: %s", err.Error()))
+		return err
+	}
+	publicKey, err := libp2pcrypto.MarshalPublicKey(keyPair.PubKey)
+	if err != nil {
+		debug.Log("signals", fmt.Sprintf("Error marshalling public key: %s", err.Error()))
+		return err
+	}
+
+	signal := models.Signal{
+		Type:      signalType,
+		Sender:    network.PubSubService.SelfID().String(),
+		Receiver:  receiver,
+		Reference: reference,
+		Timestamp: time.Now().Format(time.RFC3339),
+		PublicKey: publicKey,
+	}
+	signal.Signature, err = keyPair.SignWithPrivateKey(signal.SigningBytes())
+	if err != nil {
+		debug.Log("signals", fmt.Sprintf("Error signing signal: %s", err.Error()))
+		return err
+	}
+
+	signalJSON, err := json.Marshal(signal)
+	if err != nil {
+		debug.Log("signals", fmt.Sprintf("Error marshaling signal: %s", err.Error()))
+		return err
+	}
+
+	// Signals stay within the active room
+	network.PubSubService.Outbound <- MessageEnvelope{
+		Type:  "Signal",
+		Data:  signalJSON,
+		Topic: network.PubSubService.ActiveTopic(),
+	}
+	return nil
+}
+
+// Check that an inbound signal is addressed to us, fresh, signed by its sender
+// and within the sender's rate limit
+func (network *Network) AcceptSignal(signal models.Signal) bool {
+	self := network.PubSubService.SelfID().String()
+	if signal.Sender == self {
+		return false
+	}
+	if signal.Receiver != "" && signal.Receiver != self {
+		return false
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, signal.Timestamp)
+	if err != nil || time.Since(timestamp) > signalMaxAge {
+		debug.Log("signals", fmt.Sprintf("Dropping stale %s signal from %s", signal.Type, signal.Sender))
+		return false
+	}
+
+	// Verified first, so forged signals cannot use up the budget of the sender they claim
+	verified, err := VerifyPeerSignature(signal.Sender, signal.SigningBytes(), signal.Signature, signal.PublicKey)
+	if err != nil || !verified {
+		debug.Log("err", fmt.Sprintf("Dropping %s signal with invalid signature from %s", signal.Type, signal.Sender))
+		return false
+	}
+
+	if !inboundSignalLimiter.Allow(signal.Sender) {
+		debug.Log("signals", fmt.Sprintf("Dropping rate limited %s signal from %s", signal.Type, signal.Sender))
+		return false
+	}
+	return true
+}
+
+// Publish the inbound signals that are accepted
+func (network *Network) signalLoop() {
+	for signal := range network.PubSubService.Signals {
+		if network.AcceptSignal(signal) {
+			network.Events.Publish(Event{Type: EventSignal, Signal: &signal})
+		}
+	}
+}
+
+// Periodically broadcast that this node is online
+func (network *Network) presenceLoop() {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := network.SendSignal("presence", "", ""); err != nil {
+			debug.Log("signals", fmt.Sprintf("Error sending presence: %s", err.Error()))
+		}
+		<-ticker.C
+	}
+}
@@ -5,59 +5,145 @@ import (
 	"MessageMesh/debug"
 	"context"
 	"encoding/hex"
+	"fmt"
 	"time"
 
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
+// How often the UI gets the peer list even if no peer joined or left
+const peerListInterval = 10 * time.Second
+
+// Pass the events of the bus on to the Wails frontend, or log them in headless mode
 func UIDataLoop(network Network, ctx context.Context) {
-	debug.Log("ui", "Wails events emitter started")
-	if !debug.IsHeadless {
-		runtime.EventsEmit(ctx, "getUserPeerID", network.P2pService.Host.ID())
-		runtime.EventsEmit(ctx, "getPeerList", network.PubSubService.PeerList())
+	events := network.Events.Subscribe("ui", internalEventBuffer())
+	defer events.Close()
+
+	if debug.IsHeadless {
 		for {
 			select {
-			case peerIDs := <-network.PubSubService.PeerIDs:
-				runtime.EventsEmit(ctx, "getPeerList", peerIDs)
-				debug.Log("ui", "Peers: "+string(len(peerIDs)))
-				runtime.EventsEmit(ctx, "getConnected", true)
+			case event := <-events.Events:
+				logEvent(event)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
 
-			// repeat this every 10 seconds
-			case <-time.After(10 * time.Second):
-				runtime.EventsEmit(ctx, "getPeerList", network.PubSubService.PeerList())
+	debug.Log("ui", "Wails events emitter started")
+	runtime.EventsEmit(ctx, "getUserPeerID", network.P2pService.Host.ID())
+	runtime.EventsEmit(ctx, "getPeerList", network.PubSubService.ActivePeerList())
+	ticker := time.NewTicker(peerListInterval)
+	defer ticker.Stop()
 
-			case block := <-network.ConsensusService.LatestBlock:
-				// Check if the block is a message block
-				if block.BlockType == "message" {
-					runtime.EventsEmit(ctx, "getMessage", block.Data.(*models.MessageData).Message)
-					debug.Log("ui", "Message: "+block.Data.(*models.MessageData).Message.Message)
-				}
-				if block.BlockType == "account" {
-					runtime.EventsEmit(ctx, "getAccount", block.Data.(*models.AccountData).Account)
-					debug.Log("ui", "Account: "+block.Data.(*models.AccountData).Account.Username)
-				}
-				if block.BlockType == "firstMessage" {
-					runtime.EventsEmit(ctx, "getFirstMessage", block.Data.(*models.FirstMessageData).FirstMessage)
-					debug.Log("ui", "First Message: "+hex.EncodeToString(block.Data.(*models.FirstMessageData).FirstMessage.SymetricKey0)+" and "+hex.EncodeToString(block.Data.(*models.FirstMessageData).FirstMessage.SymetricKey1))
-				}
+	// Index of the last block the chain was emitted for, the entries of a batch share their block index
+	emittedIndex := -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
 
-				runtime.EventsEmit(ctx, "getBlock", block)
-				runtime.EventsEmit(ctx, "getBlockchain", network.ConsensusService.Blockchain.Chain)
+		case <-ticker.C:
+			runtime.EventsEmit(ctx, "getPeerList", network.PubSubService.ActivePeerList())
 
-			case <-network.ConsensusService.Connected:
+		case event := <-events.Events:
+			switch event.Type {
+			case EventPeerList:
+				runtime.EventsEmit(ctx, "getPeerList", event.Peers)
+				debug.Log("ui", fmt.Sprintf("Peers: %d", len(event.Peers)))
 				runtime.EventsEmit(ctx, "getConnected", true)
+
+			case EventBlockCommitted:
+				emitBlock(ctx, network, event.Block, event.Block.Index != emittedIndex)
+				emittedIndex = event.Block.Index
+
+			case EventLeaderChanged:
+				runtime.EventsEmit(ctx, "getLeader", event.Leader)
+
+			case EventMessageDecrypted:
+				runtime.EventsEmit(ctx, "getDecryptedMessage", event.Message)
+
+			case EventSendStatus:
+				runtime.EventsEmit(ctx, "getSendStatus", event.Send)
+
+			case EventSignal:
+				switch event.Signal.Type {
+				case "typing":
+					runtime.EventsEmit(ctx, "getTyping", event.Signal)
+				case "delivered", "read":
+					runtime.EventsEmit(ctx, "getReceipt", event.Signal)
+				case "presence":
+					runtime.EventsEmit(ctx, "getPresence", event.Signal)
+				}
 			}
 		}
-	} else {
-		for {
-			select {
-			case block := <-network.ConsensusService.LatestBlock:
-				debug.Log("ui", "Block: "+block.BlockType)
-			// case <-time.After(30 * time.Second):
-			// 	network.SendEncryptedMessage("Its "+time.Now().Format("2006-01-02 15:04:05")+" I am "+debug.Username, "Qma9HU4gynWXNzWwpqmHRnLXikstTgCbYHfG6aqJTLrxfq")
-			case <-ctx.Done():
-				return
-			}
+	}
+}
+
+// Emit a committed block and the event of its type, and the whole chain if emitChain is set.
+// The chain is read once per block, it already holds every entry of a batch.
+func emitBlock(ctx context.Context, network Network, block *models.Block, emitChain bool) {
+	switch block.BlockType {
+	case "message":
+		runtime.EventsEmit(ctx, "getMessage", block.Data.(*models.MessageData).Message)
+		debug.Log("ui", "Message: "+block.Data.(*models.MessageData).Message.Message)
+	case "account":
+		runtime.EventsEmit(ctx, "getAccount", block.Data.(*models.AccountData).Account)
+		debug.Log("ui", "Account: "+block.Data.(*models.AccountData).Account.Username)
+	case "firstMessage":
+		runtime.EventsEmit(ctx, "getFirstMessage", block.Data.(*models.FirstMessageData).FirstMessage)
+		debug.Log("ui", "First Message: "+hex.EncodeToString(block.Data.(*models.FirstMessageData).FirstMessage.SymetricKey0)+" and "+hex.EncodeToString(block.Data.(*models.FirstMessageData).FirstMessage.SymetricKey1))
+	case "reaction":
+		runtime.EventsEmit(ctx, "getReaction", block.Data.(*models.ReactionData).Reaction)
+		debug.Log("ui", "Reaction: "+block.Data.(*models.ReactionData).Reaction.Emoji)
+	case "retention":
+		runtime.EventsEmit(ctx, "getRetention", block.Data.(*models.RetentionData).Retention)
+	case "edit", "delete":
+		runtime.EventsEmit(ctx, "getMessageEdit", block)
+		debug.Log("ui", fmt.Sprintf("Message %s: %d", block.BlockType, block.Data.(*models.EditData).TargetIndex))
+	}
+
+	runtime.EventsEmit(ctx, "getBlock", block)
+	if !emitChain {
+		return
+	}
+	// The UI reads the entries of batch blocks like any other block
+	var chain []*models.Block
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		for _, block := range blockchain.Entries() {
+			chain = append(chain, block.Copy())
 		}
+	})
+	runtime.EventsEmit(ctx, "getBlockchain", chain)
+}
+
+// Log an event of the bus in headless mode
+func logEvent(event Event) {
+	switch event.Type {
+	case EventBlockCommitted:
+		debug.Log("ui", "Block: "+event.Block.BlockType)
+	case EventPeerJoined, EventPeerLeft:
+		debug.Log("ui", fmt.Sprintf("%s: %s", event.Type, event.Peer))
+	case EventPeerList:
+		debug.Log("ui", fmt.Sprintf("Peers: %d", len(event.Peers)))
+	case EventLeaderChanged:
+		debug.Log("ui", "Leader: "+event.Leader.Leader)
+	case EventMessageDecrypted:
+		debug.Log("ui", "Decrypted message from "+event.Message.Sender)
+	case EventSendStatus:
+		debug.Log("ui", fmt.Sprintf("Message %s to %s: %s %s", event.Send.MessageID, event.Send.Receiver, event.Send.Status, event.Send.Error))
+	case EventSignal:
+		debug.Log("ui", "Signal: "+event.Signal.Type+" from "+event.Signal.Sender)
+	}
+}
+
+// Let the sender know a message addressed to us has been committed
+func sendDeliveredReceipt(network *Network, block *models.Block) {
+	message := block.Data.(*models.MessageData).Message
+	if message.Receiver != network.PubSubService.SelfID().String() {
+		return
+	}
+	if err := network.SendSignal("delivered", message.Sender, block.Hash); err != nil {
+		debug.Log("ui", fmt.Sprintf("Error sending delivered receipt: %s", err.Error()))
 	}
 }
@@ -0,0 +1,308 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// Largest envelope accepted on a topic
+	maxEnvelopeSize = 64 * 1024
+	// How long envelopes are remembered to reject replays, older ones are rejected by timestamp
+	replayWindow = 5 * time.Minute
+	// How far a timestamp may be ahead of the local clock
+	maxClockSkew = time.Minute
+)
+
+// Returned for envelopes whose payload was already seen within the replay window
+var errReplayedEnvelope = errors.New("replayed envelope")
+
+// Payload hashes of recently accepted envelopes
+var envelopeReplayCache = &replayCache{seen: make(map[string]time.Time)}
+
+type replayCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// Seen records the key and reports whether it was already recorded within the replay window
+func (cache *replayCache) Seen(key string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(cache.lastPrune) > time.Minute {
+		for seenKey, seenAt := range cache.seen {
+			if now.Sub(seenAt) > replayWindow {
+				delete(cache.seen, seenKey)
+			}
+		}
+		cache.lastPrune = now
+	}
+
+	if seenAt, ok := cache.seen[key]; ok && now.Sub(seenAt) <= replayWindow {
+		return true
+	}
+	cache.seen[key] = now
+	return false
+}
+
+// Topic validator run by GossipSub before an envelope is delivered or forwarded.
+// Rejected envelopes count against the score of the peer that sent them.
+func validateEnvelope(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	err := checkEnvelope(msg)
+	// Honest peers can repeat a payload (e.g. two typing signals within a second),
+	// so replays are dropped without penalty, stale ones are already rejected by timestamp
+	if errors.Is(err, errReplayedEnvelope) {
+		debug.Log("validation", fmt.Sprintf("Ignored replayed envelope from %s", from))
+		return pubsub.ValidationIgnore
+	}
+	if err != nil {
+		debug.Log("validation", fmt.Sprintf("Rejected envelope from %s: %s", from, err.Error()))
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
+
+// Check that an envelope is small, well formed, signed by its publisher and not a replay
+func checkEnvelope(msg *pubsub.Message) error {
+	if len(msg.Data) > maxEnvelopeSize {
+		return fmt.Errorf("envelope of %d bytes is too large", len(msg.Data))
+	}
+	if len(msg.Signature) == 0 {
+		return fmt.Errorf("envelope is not signed")
+	}
+	publisher := msg.GetFrom().String()
+
+	envelope := &MessageEnvelope{}
+	if err := json.Unmarshal(msg.Data, envelope); err != nil {
+		return fmt.Errorf("malformed envelope: %s", err.Error())
+	}
+
+	switch envelope.Type {
+	case "Message":
+		message := &models.Message{}
+		if err := json.Unmarshal(envelope.Data, message); err != nil {
+			return fmt.Errorf("malformed Message: %s", err.Error())
+		}
+		if message.Sender != publisher {
+			return fmt.Errorf("message sender is not the publisher")
+		}
+		if err := checkTimestamp(message.Timestamp, replayWindow); err != nil {
+			return err
+		}
+
+	case "FirstMessage":
+		firstMessage := &models.FirstMessage{}
+		if err := json.Unmarshal(envelope.Data, firstMessage); err != nil {
+			return fmt.Errorf("malformed FirstMessage: %s", err.Error())
+		}
+		if len(firstMessage.PeerIDs) != 2 {
+			return fmt.Errorf("first message must have exactly 2 peer IDs")
+		}
+		if firstMessage.PeerIDs[0] != publisher && firstMessage.PeerIDs[1] != publisher {
+			return fmt.Errorf("first message publisher is not one of its peers")
+		}
+
+	case "Account":
+		account := &models.Account{}
+		if err := json.Unmarshal(envelope.Data, account); err != nil {
+			return fmt.Errorf("malformed Account: %s", err.Error())
+		}
+		if account.Username == "" {
+			return fmt.Errorf("account is missing a username")
+		}
+
+	case "MessageEdit":
+		edit := &models.MessageEdit{}
+		if err := json.Unmarshal(envelope.Data, edit); err != nil {
+			return fmt.Errorf("malformed MessageEdit: %s", err.Error())
+		}
+		if edit.Sender != publisher {
+			return fmt.Errorf("edit sender is not the publisher")
+		}
+		if err := checkTimestamp(edit.Timestamp, replayWindow); err != nil {
+			return err
+		}
+		verified, err := VerifyPeerSignature(edit.Sender, edit.SigningBytes(), edit.Signature, edit.PublicKey)
+		if err != nil || !verified {
+			return fmt.Errorf("edit signature is invalid")
+		}
+
+	case "Reaction":
+		reaction := &models.Reaction{}
+		if err := json.Unmarshal(envelope.Data, reaction); err != nil {
+			return fmt.Errorf("malformed Reaction: %s", err.Error())
+		}
+		if reaction.Sender != publisher {
+			return fmt.Errorf("reaction sender is not the publisher")
+		}
+		if err := checkTimestamp(reaction.Timestamp, replayWindow); err != nil {
+			return err
+		}
+
+	case "Retention":
+		retention := &models.Retention{}
+		if err := json.Unmarshal(envelope.Data, retention); err != nil {
+			return fmt.Errorf("malformed Retention: %s", err.Error())
+		}
+		if retention.Setter != publisher {
+			return fmt.Errorf("retention setter is not the publisher")
+		}
+		if err := checkTimestamp(retention.Timestamp, replayWindow); err != nil {
+			return err
+		}
+
+	case "Signal":
+		signal := &models.Signal{}
+		if err := json.Unmarshal(envelope.Data, signal); err != nil {
+			return fmt.Errorf("malformed Signal: %s", err.Error())
+		}
+		if signal.Sender != publisher {
+			return fmt.Errorf("signal sender is not the publisher")
+		}
+		if err := checkTimestamp(signal.Timestamp, signalMaxAge); err != nil {
+			return err
+		}
+		verified, err := VerifyPeerSignature(signal.Sender, signal.SigningBytes(), signal.Signature, signal.PublicKey)
+		if err != nil || !verified {
+			return fmt.Errorf("signal signature is invalid")
+		}
+
+	default:
+		return fmt.Errorf("unknown envelope type %s", envelope.Type)
+	}
+
+	// The same payload cannot be published twice, even under a new sequence number
+	payloadHash := sha256.Sum256(envelope.Data)
+	if envelopeReplayCache.Seen(envelope.Type + hex.EncodeToString(payloadHash[:])) {
+		return errReplayedEnvelope
+	}
+	return nil
+}
+
+// Check that an RFC3339 timestamp is no older than maxAge and not too far in the future
+func checkTimestamp(timestamp string, maxAge time.Duration) error {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return fmt.Errorf("malformed timestamp: %s", err.Error())
+	}
+	age := time.Since(parsed)
+	if age > maxAge {
+		return fmt.Errorf("timestamp is %s old", age.Round(time.Second))
+	}
+	if age < -maxClockSkew {
+		return fmt.Errorf("timestamp is in the future")
+	}
+	return nil
+}
+
+// GossipSub peer score parameters. Peers that deliver invalid envelopes or misbehave
+// in the mesh lose score, and are pruned, ignored and finally graylisted.
+func peerScoreParams() (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	params := &pubsub.PeerScoreParams{
+		Topics: map[string]*pubsub.TopicScoreParams{
+			meshTopic: topicScoreParams(),
+		},
+		TopicScoreCap:    50,
+		AppSpecificScore: func(peer.ID) float64 { return 0 },
+		// Many nodes may run behind one address (LAN, NAT, containers), so only penalise large groups
+		IPColocationFactorWeight:    -5,
+		IPColocationFactorThreshold: 10,
+		BehaviourPenaltyWeight:      -10,
+		BehaviourPenaltyThreshold:   6,
+		BehaviourPenaltyDecay:       pubsub.ScoreParameterDecay(10 * time.Minute),
+		DecayInterval:               time.Second,
+		DecayToZero:                 0.01,
+		RetainScore:                 time.Hour,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -10,
+		PublishThreshold:            -50,
+		GraylistThreshold:           -80,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 5,
+	}
+	return params, thresholds
+}
+
+// Score parameters for a single topic
+func topicScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight: 1,
+		// Reward peers for staying in the mesh and for delivering new envelopes first
+		TimeInMeshWeight:             0.01,
+		TimeInMeshQuantum:            time.Second,
+		TimeInMeshCap:                300,
+		FirstMessageDeliveriesWeight: 1,
+		FirstMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(10 * time.Minute),
+		FirstMessageDeliveriesCap:    20,
+		// Chat traffic is bursty, so mesh delivery rates are not scored
+		MeshMessageDeliveriesWeight: 0,
+		MeshFailurePenaltyWeight:    0,
+		// Each rejected envelope costs a lot and is slowly forgiven
+		InvalidMessageDeliveriesWeight: -50,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+}
+
+// Open a pubsub message as it was published, checking the signature of its publisher, and get
+// the envelope it carries. Peers that held a message for its author hand it on in this form.
+func openSignedEnvelope(signed []byte) (*MessageEnvelope, peer.ID, error) {
+	message := &pb.Message{}
+	if err := message.Unmarshal(signed); err != nil {
+		return nil, "", fmt.Errorf("malformed pubsub message: %s", err.Error())
+	}
+	if len(message.Data) > maxEnvelopeSize {
+		return nil, "", fmt.Errorf("envelope of %d bytes is too large", len(message.Data))
+	}
+	publisher, err := peer.IDFromBytes(message.From)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed publisher: %s", err.Error())
+	}
+
+	// Keys that do not fit in the peer ID travel with the message
+	var publicKey libp2pcrypto.PubKey
+	if message.Key == nil {
+		publicKey, err = publisher.ExtractPublicKey()
+	} else {
+		publicKey, err = libp2pcrypto.UnmarshalPublicKey(message.Key)
+		if err == nil && !publisher.MatchesPublicKey(publicKey) {
+			err = fmt.Errorf("key does not belong to %s", publisher)
+		}
+	}
+	if err != nil || publicKey == nil {
+		return nil, "", fmt.Errorf("no public key for %s", publisher)
+	}
+	unsigned := *message
+	unsigned.Signature = nil
+	unsigned.Key = nil
+	unsignedBytes, err := unsigned.Marshal()
+	if err != nil {
+		return nil, "", err
+	}
+	verified, err := publicKey.Verify(append([]byte(pubsub.SignPrefix), unsignedBytes...), message.Signature)
+	if err != nil || !verified {
+		return nil, "", fmt.Errorf("signature of %s is invalid", publisher)
+	}
+
+	envelope := &MessageEnvelope{}
+	if err := json.Unmarshal(message.Data, envelope); err != nil {
+		return nil, "", fmt.Errorf("malformed envelope: %s", err.Error())
+	}
+	return envelope, publisher, nil
+}
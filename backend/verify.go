@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"MessageMesh/backend/models"
+	"MessageMesh/debug"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// How often a starting node checks whether it has caught up, to verify the chain it received
+	catchUpInterval = 2 * time.Second
+	// Least time between two resyncs, so a peer serving a corrupt chain cannot keep us restarting
+	resyncInterval = time.Minute
+)
+
+// The result of verifying the chain
+type ChainReport struct {
+	Valid        bool               `json:"valid"`
+	Length       int                `json:"length"`
+	FirstInvalid *models.ChainFault `json:"firstInvalid,omitempty"` // Set if the chain is invalid
+	Trigger      string             `json:"trigger"`                // startup, snapshot or manual
+	CheckedAt    int64              `json:"checkedAt"`
+}
+
+// Verify every block of the chain
+func (network *Network) VerifyChain() ChainReport {
+	return network.verifyChain("manual")
+}
+
+func (network *Network) verifyChain(trigger string) ChainReport {
+	report := ChainReport{Trigger: trigger, CheckedAt: time.Now().Unix()}
+	network.ConsensusService.View(func(blockchain *models.Blockchain) {
+		report.Length = len(blockchain.Chain)
+		report.FirstInvalid = blockchain.Verify()
+	})
+	report.Valid = report.FirstInvalid == nil
+
+	if report.Valid {
+		debug.Log("raft", fmt.Sprintf("Verified the chain of %d blocks on %s", report.Length, trigger))
+	} else {
+		fault := report.FirstInvalid
+		debug.Log("err", fmt.Sprintf("Chain verification on %s failed at block %d of %d (%s): %s. Hash %s, expected %s. Previous hash %s, expected %s",
+			trigger, fault.Index, report.Length, fault.BlockType, fault.Reason, fault.Hash, fault.ExpectedHash, fault.PrevHash, fault.ExpectedPrevHash))
+	}
+	return report
+}
+
+// Fetch the whole chain of a peer through the history protocol
+func (network *Network) fetchChain(peerID peer.ID) (*models.Blockchain, error) {
+	blockchain := &models.Blockchain{Chain: make([]*models.Block, 0)}
+	for {
+		history, err := network.RequestHistory(peerID.String(), len(blockchain.Chain), maxHistoryBlocks)
+		if err != nil {
+			return nil, err
+		}
+		if len(history.Blocks) == 0 {
+			break
+		}
+		blockchain.Chain = append(blockchain.Chain, history.Blocks...)
+		if len(blockchain.Chain) >= history.Length {
+			break
+		}
+	}
+	return blockchain, nil
+}
+
+// Throw away the local chain and replicate it again from the leader, once the chain of the
+// leader was verified. A leader with an invalid chain is reported and not resynced from again
+// until another node leads, as replicating from it would only bring back an invalid chain.
+func (network *Network) ResyncChain() error {
+	consensusService := network.ConsensusService
+	consensusService.resyncMu.Lock()
+	defer consensusService.resyncMu.Unlock()
+
+	if since := time.Since(consensusService.lastResync); since < resyncInterval {
+		return fmt.Errorf("the chain was resynced %s ago", since.Round(time.Second))
+	}
+	if consensusService.Raft.State() == raft.Leader {
+		return fmt.Errorf("the leader cannot resync, transfer leadership first")
+	}
+	leader, err := peer.Decode(string(consensusService.Raft.Leader()))
+	if err != nil {
+		return fmt.Errorf("no leader to resync from")
+	}
+	if leader == consensusService.invalidLeader {
+		return fmt.Errorf("the chain of the leader %s is invalid, waiting for another leader", leader)
+	}
+	consensusService.lastResync = time.Now()
+	blockchain, err := network.fetchChain(leader)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the chain of the leader %s: %s", leader, err)
+	}
+	if fault := blockchain.Verify(); fault != nil {
+		consensusService.invalidLeader = leader
+		debug.Log("err", fmt.Sprintf("Not resyncing, the chain of the leader %s is invalid too: %s", leader, fault.Error()))
+		return fmt.Errorf("the chain of the leader %s is invalid: %s", leader, fault.Error())
+	}
+
+	debug.Log("raft", fmt.Sprintf("Resyncing the chain from the leader %s", leader))
+	return network.restartRaft(leader)
+}
+
+// Verify the chain once this node has caught up after starting, and whenever a snapshot is installed.
+// A corrupt chain is resynced from a healthy member, a valid one gets back the payloads of our
+// conversations that the node it came from had pruned.
+func syncLoop(network *Network, stop chan struct{}) {
+	ticker := time.NewTicker(catchUpInterval)
+	defer ticker.Stop()
+	verified := false
+
+	for {
+		trigger := ""
+		select {
+		case <-stop:
+			return
+		case <-network.ConsensusService.restored:
+			trigger = "snapshot"
+		case <-ticker.C:
+			if verified || !network.caughtUp() {
+				continue
+			}
+			verified = true
+			trigger = "startup"
+		}
+
+		if report := network.verifyChain(trigger); !report.Valid {
+			if err := network.ResyncChain(); err != nil {
+				debug.Log("err", fmt.Sprintf("Failed to resync the chain: %s", err))
+			}
+		} else {
+			network.refillPayloads()
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	backend "MessageMesh/backend"
+	debug "MessageMesh/debug"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+const usage = `Usage: MessageMesh [command]
+
+Without a command the app starts, or runs headless if HEADLESS=true.
+
+Commands:
+  init                              Create the identity of this node
+  run                               Run the node headless
+  send [-encrypted] [-reply-to ID] [-room NAME] PEER MESSAGE
+                                    Send a message through the running node
+  peers                             List the peers of the running node
+  status                            Show the status of the node
+  chain export [-from N] [-to N]    Export blocks to an archive file
+  chain verify [ARCHIVE]            Verify the chain, or an archive file
+  keys export FILE                  Write the private key to a file
+  keys import [-force] FILE         Replace the identity with a key file
+
+Commands talk to the node running on the data directory over its control socket.
+init, keys and, when no node is running, status and chain work on the data directory.
+`
+
+// Run a command of the command line, returning the exit code
+func runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "init":
+		err = initCommand()
+	case "run":
+		err = runCommandLoop()
+	case "send":
+		err = sendCommand(args[1:])
+	case "peers":
+		err = peersCommand()
+	case "status":
+		err = statusCommand()
+	case "chain":
+		err = chainCommand(args[1:])
+	case "keys":
+		err = keysCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n%s", args[0], usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// Print a value as indented JSON
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func initCommand() error {
+	if peerID, err := backend.LocalPeerID(); err == nil {
+		fmt.Println("Identity already exists:", peerID)
+		return nil
+	}
+	if _, err := backend.NewKeyPair(); err != nil {
+		return err
+	}
+	peerID, err := backend.LocalPeerID()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Created identity:", peerID)
+	return nil
+}
+
+// Run the node headless until interrupted
+func runCommandLoop() error {
+	debug.IsHeadless = true
+	debug.Log("main", "Running in headless mode")
+	app := NewApp()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := app.start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func sendCommand(args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	encrypted := flags.Bool("encrypted", false, "Encrypt the message for the receiver")
+	replyTo := flags.String("reply-to", "", "ID of the message this replies to")
+	room := flags.String("room", "", "Room to send in, the active room if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("send needs a peer ID and a message")
+	}
+	control, err := backend.DialControl()
+	if err != nil {
+		return err
+	}
+	request := map[string]any{
+		"receiver":  flags.Arg(0),
+		"message":   flags.Arg(1),
+		"replyTo":   *replyTo,
+		"encrypted": *encrypted,
+		"room":      *room,
+	}
+	response := map[string]string{}
+	if err := control.Do(http.MethodPost, "/api/messages", request, &response); err != nil {
+		return err
+	}
+	fmt.Println("Queued message", response["id"])
+	return nil
+}
+
+func peersCommand() error {
+	control, err := backend.DialControl()
+	if err != nil {
+		return err
+	}
+	var peers any
+	if err := control.Do(http.MethodGet, "/api/peers", nil, &peers); err != nil {
+		return err
+	}
+	return printJSON(peers)
+}
+
+// Show the status of the running node, or what the data directory holds
+func statusCommand() error {
+	if control, err := backend.DialControl(); err == nil {
+		var status any
+		if err := control.Do(http.MethodGet, "/api/status", nil, &status); err != nil {
+			return err
+		}
+		return printJSON(status)
+	}
+
+	status := map[string]any{"running": false}
+	peerID, err := backend.LocalPeerID()
+	if err != nil {
+		return err
+	}
+	status["peerID"] = peerID
+	if blockchain, meta, err := backend.ReadSnapshotChain(); err == nil {
+		status["clusterID"] = blockchain.ClusterID()
+		status["length"] = len(blockchain.Chain)
+		status["snapshotIndex"] = meta.Index
+	}
+	return printJSON(status)
+}
+
+func chainCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("chain needs export or verify")
+	}
+	switch args[0] {
+	case "export":
+		return chainExportCommand(args[1:])
+	case "verify":
+		return chainVerifyCommand(args[1:])
+	}
+	return fmt.Errorf("unknown chain command %s", args[0])
+}
+
+// Export blocks to an archive file, through the running node or from the latest snapshot
+func chainExportCommand(args []string) error {
+	flags := flag.NewFlagSet("chain export", flag.ContinueOnError)
+	from := flags.Int("from", 0, "Index of the first block")
+	to := flags.Int("to", -1, "Index of the last block (default the latest block)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if control, err := backend.DialControl(); err == nil {
+		request := map[string]any{"from": *from}
+		if *to >= 0 {
+			request["to"] = *to
+		}
+		response := map[string]string{}
+		if err := control.Do(http.MethodPost, "/api/chain/export", request, &response); err != nil {
+			return err
+		}
+		fmt.Println("Exported to", response["path"])
+		return nil
+	}
+
+	blockchain, meta, err := backend.ReadSnapshotChain()
+	if err != nil {
+		return err
+	}
+	if *to < 0 {
+		*to = len(blockchain.Chain) - 1
+	}
+	segment, err := blockchain.Segment(*from, *to)
+	if err != nil {
+		return err
+	}
+	path, err := backend.WriteSegment(segment)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported to %s from the snapshot at Raft index %d\n", path, meta.Index)
+	return nil
+}
+
+// Verify the chain or an archive file, through the running node or against the latest snapshot
+func chainVerifyCommand(args []string) error {
+	control, controlErr := backend.DialControl()
+	if len(args) > 0 {
+		if controlErr == nil {
+			var report backend.ArchiveReport
+			if err := control.Do(http.MethodPost, "/api/archives/verify", map[string]string{"path": args[0]}, &report); err != nil {
+				return err
+			}
+			return printVerdict(report, report.Valid)
+		}
+		report, segment, err := backend.CheckArchive(args[0])
+		if err != nil {
+			return err
+		}
+		if report.Valid {
+			if blockchain, _, err := backend.ReadSnapshotChain(); err == nil {
+				report.MatchesChain = backend.ArchiveMatches(segment, blockchain)
+			}
+		}
+		return printVerdict(report, report.Valid)
+	}
+
+	if controlErr == nil {
+		var report backend.ChainReport
+		if err := control.Do(http.MethodGet, "/api/chain/verify", nil, &report); err != nil {
+			return err
+		}
+		return printVerdict(report, report.Valid)
+	}
+	blockchain, _, err := backend.ReadSnapshotChain()
+	if err != nil {
+		return err
+	}
+	fault := blockchain.Verify()
+	report := map[string]any{"valid": fault == nil, "length": len(blockchain.Chain), "trigger": "snapshot"}
+	if fault != nil {
+		report["firstInvalid"] = fault
+	}
+	return printVerdict(report, fault == nil)
+}
+
+// Print a verification report, failing the command if it is invalid
+func printVerdict(report any, valid bool) error {
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("verification failed")
+	}
+	return nil
+}
+
+func keysCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("keys needs export or import and a file")
+	}
+	switch args[0] {
+	case "export":
+		if len(args) != 2 {
+			return fmt.Errorf("keys export needs a file")
+		}
+		if err := backend.ExportKeyPair(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Exported the private key to", args[1])
+		return nil
+	case "import":
+		flags := flag.NewFlagSet("keys import", flag.ContinueOnError)
+		force := flags.Bool("force", false, "Replace an existing identity, backing up its key")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("keys import needs a file")
+		}
+		// The running node keeps using the key it started with
+		if _, err := backend.DialControl(); err == nil {
+			return fmt.Errorf("stop the running node before importing keys")
+		}
+		peerID, backup, err := backend.ImportKeyPair(flags.Arg(0), *force)
+		if err != nil {
+			return err
+		}
+		if backup != "" {
+			fmt.Println("Backed up the replaced key to", backup)
+		}
+		fmt.Println("Imported identity:", peerID)
+		return nil
+	}
+	return fmt.Errorf("unknown keys command %s", args[0])
+}
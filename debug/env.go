@@ -11,6 +11,78 @@ var IsHeadless = GetEnvVar("HEADLESS") == "true"
 
 var Username = GetEnvVar("USERNAME")
 
+// Path to a pre-shared network key (swarm.key), set to run a private mesh
+var NetworkKey = GetEnvVar("NETWORK_KEY")
+
+// Comma separated multiaddrs of bootstrap peers, replaces the public IPFS bootstrap peers
+var BootstrapPeers = GetEnvVar("BOOTSTRAP_PEERS")
+
+// Comma separated multiaddrs of peers to always stay connected to
+var StaticPeers = GetEnvVar("STATIC_PEERS")
+
+// Rendezvous string peers advertise and look for
+var Rendezvous = GetEnvVar("RENDEZVOUS")
+
+// Comma separated multiaddrs to listen on, e.g. /ip4/0.0.0.0/tcp/4001,/ip6/::/tcp/4001
+var ListenAddrs = GetEnvVar("LISTEN_ADDRS")
+
+// Comma separated transports to enable: tcp (always on), ws and quic
+var Transports = GetEnvVar("TRANSPORTS")
+
+// Discover peers on the local network with mDNS, on unless set to false
+var MdnsEnabled = GetEnvVar("MDNS") != "false"
+
+// Maximum number of Raft voters, later peers join as non-voters
+var MaxVoters = GetEnvVar("MAX_VOTERS")
+
+// How long a disconnected peer keeps its Raft membership, e.g. 2m
+var MemberGracePeriod = GetEnvVar("MEMBER_GRACE_PERIOD")
+
+// Comma separated invitation tokens this node admits peers with
+var InviteTokens = GetEnvVar("INVITE_TOKENS")
+
+// Promote any peer to voter without an allowlist entry or invitation token, off unless set to true
+var OpenAdmission = GetEnvVar("OPEN_ADMISSION") == "true"
+
+// Invitation token this node presents to be admitted as a voter
+var JoinToken = GetEnvVar("JOIN_TOKEN")
+
+// Bootstrap a new cluster when no existing one is found, set on the node founding a mesh
+var FoundMesh = GetEnvVar("FOUND_MESH") == "true"
+
+// Which node should lead: stay, uptime (default), latency or rotate
+var LeadershipPolicy = GetEnvVar("LEADERSHIP_POLICY")
+
+// How often the leadership policy is evaluated, e.g. 5m
+var LeadershipInterval = GetEnvVar("LEADERSHIP_INTERVAL")
+
+// How this node takes part in the mesh: voter (default) or observer, which replicates the chain without voting
+var NodeMode = GetEnvVar("NODE_MODE")
+
+// How queries read the chain: local (default) or linearizable
+var ReadConsistency = GetEnvVar("READ_CONSISTENCY")
+
+// Number of blocks between two checkpoints signed by the leader, default 100
+var CheckpointInterval = GetEnvVar("CHECKPOINT_INTERVAL")
+
+// Most ops the leader commits in one block, default 100
+var BatchSize = GetEnvVar("BATCH_SIZE")
+
+// How long the leader collects ops before committing them as one block, e.g. 50ms
+var BatchWindow = GetEnvVar("BATCH_WINDOW")
+
+// Number of recent blocks kept in full, older payloads of other peers' conversations are pruned. Unset keeps everything
+var PruneWindow = GetEnvVar("PRUNE_WINDOW")
+
+// Export each full segment of old blocks to an archive file before pruning it
+var ArchiveSegments = GetEnvVar("ARCHIVE_SEGMENTS") == "true"
+
+// Loopback address to serve the HTTP API on, e.g. 127.0.0.1:8765. Unset turns the API off
+var APIAddr = GetEnvVar("API_ADDR")
+
+// Token clients of the HTTP API present, generated into db/api_token if unset
+var APIToken = GetEnvVar("API_TOKEN")
+
 func GetEnvVar(key string) string {
 	err := godotenv.Load(".env")
 	if err != nil {
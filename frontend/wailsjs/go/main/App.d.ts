@@ -1,23 +1,106 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
+import {backend} from '../models';
 import {models} from '../models';
 
+export function AddPeer(arg1:string):Promise<void>;
+
+export function AllowPeer(arg1:string):Promise<void>;
+
+export function BlockPeer(arg1:string):Promise<void>;
+
+export function DeleteContact(arg1:string):Promise<void>;
+
+export function DeleteMessage(arg1:string,arg2:string):Promise<void>;
+
+export function DisallowPeer(arg1:string):Promise<void>;
+
+export function EditEncryptedMessage(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function EditMessage(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function ExportSegment(arg1:number,arg2:number):Promise<string>;
+
+export function GetAccessList():Promise<backend.AccessList>;
+
 export function GetAccounts():Promise<Array<models.Account>>;
 
+export function GetActiveTopic():Promise<string>;
+
 export function GetBlockchain():Promise<Array<models.Block>>;
 
+export function GetClusterConflicts():Promise<Array<backend.ClusterConflict>>;
+
+export function GetClusterInfo():Promise<backend.ClusterInfo>;
+
+export function GetContacts():Promise<Array<backend.Contact>>;
+
 export function GetDecryptedMessage(arg1:string,arg2:Array<string>):Promise<string>;
 
+export function GetHistory(arg1:string,arg2:number,arg3:number):Promise<backend.History>;
+
+export function GetLatestCheckpoint():Promise<models.CheckpointData>;
+
+export function GetMessageHistory(arg1:string):Promise<Array<models.Block>>;
+
 export function GetMessages():Promise<Array<models.Message>>;
 
 export function GetMessagesFromPeer(arg1:string):Promise<Array<models.Message>>;
 
+export function GetNodeStatus():Promise<backend.NodeStatus>;
+
 export function GetPeerList():Promise<Array<string>>;
 
+export function GetReactions(arg1:string):Promise<{[key: string]: number}>;
+
+export function GetRetention(arg1:string):Promise<models.Retention>;
+
+export function GetThread(arg1:string):Promise<Array<models.Message>>;
+
+export function GetTopics():Promise<Array<string>>;
+
 export function GetUserPeerID():Promise<string>;
 
-export function SendEncryptedMessage(arg1:string,arg2:string):Promise<void>;
+export function LeaveTopic(arg1:string):Promise<void>;
+
+export function ListArchives():Promise<Array<string>>;
+
+export function ProveMessage(arg1:string):Promise<models.InclusionProof>;
+
+export function React(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function RejoinCluster(arg1:string):Promise<backend.MergeReport>;
+
+export function RemoveReaction(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function RequestProof(arg1:string,arg2:string):Promise<models.InclusionProof>;
+
+export function ResyncChain():Promise<void>;
+
+export function SaveContact(arg1:string,arg2:string):Promise<backend.Contact>;
+
+export function SendEncryptedMessage(arg1:string,arg2:string,arg3:string):Promise<void>;
 
-export function SendMessage(arg1:string,arg2:string):Promise<void>;
+export function SendEncryptedReply(arg1:string,arg2:string,arg3:string,arg4:string):Promise<void>;
+
+export function SendMessage(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function SendReadReceipt(arg1:string,arg2:string):Promise<void>;
+
+export function SendReply(arg1:string,arg2:string,arg3:string,arg4:string):Promise<void>;
+
+export function SendTyping(arg1:string):Promise<void>;
+
+export function SetRetention(arg1:string,arg2:number,arg3:number,arg4:string):Promise<void>;
 
 export function SetTopic(arg1:string):Promise<void>;
+
+export function TransferLeadership(arg1:string):Promise<void>;
+
+export function UnblockPeer(arg1:string):Promise<void>;
+
+export function VerifyArchive(arg1:string):Promise<backend.ArchiveReport>;
+
+export function VerifyChain():Promise<backend.ChainReport>;
+
+export function VerifyProof(arg1:models.InclusionProof):Promise<void>;
@@ -2,18 +2,86 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function AddPeer(arg1) {
+  return window['go']['main']['App']['AddPeer'](arg1);
+}
+
+export function AllowPeer(arg1) {
+  return window['go']['main']['App']['AllowPeer'](arg1);
+}
+
+export function BlockPeer(arg1) {
+  return window['go']['main']['App']['BlockPeer'](arg1);
+}
+
+export function DeleteContact(arg1) {
+  return window['go']['main']['App']['DeleteContact'](arg1);
+}
+
+export function DeleteMessage(arg1, arg2) {
+  return window['go']['main']['App']['DeleteMessage'](arg1, arg2);
+}
+
+export function DisallowPeer(arg1) {
+  return window['go']['main']['App']['DisallowPeer'](arg1);
+}
+
+export function EditEncryptedMessage(arg1, arg2, arg3) {
+  return window['go']['main']['App']['EditEncryptedMessage'](arg1, arg2, arg3);
+}
+
+export function EditMessage(arg1, arg2, arg3) {
+  return window['go']['main']['App']['EditMessage'](arg1, arg2, arg3);
+}
+
+export function ExportSegment(arg1, arg2) {
+  return window['go']['main']['App']['ExportSegment'](arg1, arg2);
+}
+
+export function GetAccessList() {
+  return window['go']['main']['App']['GetAccessList']();
+}
+
 export function GetAccounts() {
   return window['go']['main']['App']['GetAccounts']();
 }
 
+export function GetActiveTopic() {
+  return window['go']['main']['App']['GetActiveTopic']();
+}
+
 export function GetBlockchain() {
   return window['go']['main']['App']['GetBlockchain']();
 }
 
+export function GetClusterConflicts() {
+  return window['go']['main']['App']['GetClusterConflicts']();
+}
+
+export function GetClusterInfo() {
+  return window['go']['main']['App']['GetClusterInfo']();
+}
+
+export function GetContacts() {
+  return window['go']['main']['App']['GetContacts']();
+}
+
 export function GetDecryptedMessage(arg1, arg2) {
   return window['go']['main']['App']['GetDecryptedMessage'](arg1, arg2);
 }
 
+export function GetHistory(arg1, arg2, arg3) {
+  return window['go']['main']['App']['GetHistory'](arg1, arg2, arg3);
+}
+
+export function GetLatestCheckpoint() {
+  return window['go']['main']['App']['GetLatestCheckpoint']();
+}
+
+export function GetMessageHistory(arg1) {
+  return window['go']['main']['App']['GetMessageHistory'](arg1);
+}
+
 export function GetMessages() {
   return window['go']['main']['App']['GetMessages']();
 }
@@ -22,22 +90,118 @@ export function GetMessagesFromPeer(arg1) {
   return window['go']['main']['App']['GetMessagesFromPeer'](arg1);
 }
 
+export function GetNodeStatus() {
+  return window['go']['main']['App']['GetNodeStatus']();
+}
+
 export function GetPeerList() {
   return window['go']['main']['App']['GetPeerList']();
 }
 
+export function GetReactions(arg1) {
+  return window['go']['main']['App']['GetReactions'](arg1);
+}
+
+export function GetRetention(arg1) {
+  return window['go']['main']['App']['GetRetention'](arg1);
+}
+
+export function GetThread(arg1) {
+  return window['go']['main']['App']['GetThread'](arg1);
+}
+
+export function GetTopics() {
+  return window['go']['main']['App']['GetTopics']();
+}
+
 export function GetUserPeerID() {
   return window['go']['main']['App']['GetUserPeerID']();
 }
 
-export function SendEncryptedMessage(arg1, arg2) {
-  return window['go']['main']['App']['SendEncryptedMessage'](arg1, arg2);
+export function LeaveTopic(arg1) {
+  return window['go']['main']['App']['LeaveTopic'](arg1);
+}
+
+export function ListArchives() {
+  return window['go']['main']['App']['ListArchives']();
+}
+
+export function ProveMessage(arg1) {
+  return window['go']['main']['App']['ProveMessage'](arg1);
+}
+
+export function React(arg1, arg2, arg3) {
+  return window['go']['main']['App']['React'](arg1, arg2, arg3);
+}
+
+export function RejoinCluster(arg1) {
+  return window['go']['main']['App']['RejoinCluster'](arg1);
+}
+
+export function RemoveReaction(arg1, arg2, arg3) {
+  return window['go']['main']['App']['RemoveReaction'](arg1, arg2, arg3);
+}
+
+export function RequestProof(arg1, arg2) {
+  return window['go']['main']['App']['RequestProof'](arg1, arg2);
+}
+
+export function ResyncChain() {
+  return window['go']['main']['App']['ResyncChain']();
+}
+
+export function SaveContact(arg1, arg2) {
+  return window['go']['main']['App']['SaveContact'](arg1, arg2);
+}
+
+export function SendEncryptedMessage(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SendEncryptedMessage'](arg1, arg2, arg3);
 }
 
-export function SendMessage(arg1, arg2) {
-  return window['go']['main']['App']['SendMessage'](arg1, arg2);
+export function SendEncryptedReply(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['SendEncryptedReply'](arg1, arg2, arg3, arg4);
+}
+
+export function SendMessage(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SendMessage'](arg1, arg2, arg3);
+}
+
+export function SendReadReceipt(arg1, arg2) {
+  return window['go']['main']['App']['SendReadReceipt'](arg1, arg2);
+}
+
+export function SendReply(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['SendReply'](arg1, arg2, arg3, arg4);
+}
+
+export function SendTyping(arg1) {
+  return window['go']['main']['App']['SendTyping'](arg1);
+}
+
+export function SetRetention(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['SetRetention'](arg1, arg2, arg3, arg4);
 }
 
 export function SetTopic(arg1) {
   return window['go']['main']['App']['SetTopic'](arg1);
 }
+
+export function TransferLeadership(arg1) {
+  return window['go']['main']['App']['TransferLeadership'](arg1);
+}
+
+export function UnblockPeer(arg1) {
+  return window['go']['main']['App']['UnblockPeer'](arg1);
+}
+
+export function VerifyArchive(arg1) {
+  return window['go']['main']['App']['VerifyArchive'](arg1);
+}
+
+export function VerifyChain() {
+  return window['go']['main']['App']['VerifyChain']();
+}
+
+export function VerifyProof(arg1) {
+  return window['go']['main']['App']['VerifyProof'](arg1);
+}
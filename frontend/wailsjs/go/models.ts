@@ -1,3 +1,292 @@
+export namespace backend {
+	
+	export class AccessList {
+	    allow: string[];
+	    block: string[];
+	
+	    static createFrom(source: any = {}) {
+	        return new AccessList(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.allow = source["allow"];
+	        this.block = source["block"];
+	    }
+	}
+	export class ArchiveReport {
+	    path: string;
+	    clusterID: string;
+	    from: number;
+	    to: number;
+	    valid: boolean;
+	    fault?: models.ChainFault;
+	    matchesChain: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new ArchiveReport(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.path = source["path"];
+	        this.clusterID = source["clusterID"];
+	        this.from = source["from"];
+	        this.to = source["to"];
+	        this.valid = source["valid"];
+	        this.fault = this.convertValues(source["fault"], models.ChainFault);
+	        this.matchesChain = source["matchesChain"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class ChainReport {
+	    valid: boolean;
+	    length: number;
+	    firstInvalid?: models.ChainFault;
+	    trigger: string;
+	    checkedAt: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ChainReport(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.valid = source["valid"];
+	        this.length = source["length"];
+	        this.firstInvalid = this.convertValues(source["firstInvalid"], models.ChainFault);
+	        this.trigger = source["trigger"];
+	        this.checkedAt = source["checkedAt"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Contact {
+	    peerID: string;
+	    name: string;
+	    addedAt: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new Contact(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.peerID = source["peerID"];
+	        this.name = source["name"];
+	        this.addedAt = source["addedAt"];
+	    }
+	}
+	export class ClusterInfo {
+	    clusterID: string;
+	    genesisHash: string;
+	    leader: string;
+	    length: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ClusterInfo(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.clusterID = source["clusterID"];
+	        this.genesisHash = source["genesisHash"];
+	        this.leader = source["leader"];
+	        this.length = source["length"];
+	    }
+	}
+	export class ClusterConflict {
+	    peerID: string;
+	    remote: ClusterInfo;
+	    detectedAt: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ClusterConflict(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.peerID = source["peerID"];
+	        this.remote = this.convertValues(source["remote"], ClusterInfo);
+	        this.detectedAt = source["detectedAt"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class History {
+	    clusterID: string;
+	    length: number;
+	    blocks: models.Block[];
+	
+	    static createFrom(source: any = {}) {
+	        return new History(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.clusterID = source["clusterID"];
+	        this.length = source["length"];
+	        this.blocks = this.convertValues(source["blocks"], models.Block);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class NodeStatus {
+	    peerID: string;
+	    mode: string;
+	    state: string;
+	    startedAt: number;
+	    appliedIndex: number;
+	    latency: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new NodeStatus(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.peerID = source["peerID"];
+	        this.mode = source["mode"];
+	        this.state = source["state"];
+	        this.startedAt = source["startedAt"];
+	        this.appliedIndex = source["appliedIndex"];
+	        this.latency = source["latency"];
+	    }
+	}
+	export class MergeReport {
+	    clusterID: string;
+	    firstMessages: number;
+	    messages: number;
+	    reactions: number;
+	    retentions: number;
+	    edits: number;
+	    existing: number;
+	    rejected: number;
+	    skipped: number;
+	    results: MergeResult[];
+	
+	    static createFrom(source: any = {}) {
+	        return new MergeReport(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.clusterID = source["clusterID"];
+	        this.firstMessages = source["firstMessages"];
+	        this.messages = source["messages"];
+	        this.reactions = source["reactions"];
+	        this.retentions = source["retentions"];
+	        this.edits = source["edits"];
+	        this.existing = source["existing"];
+	        this.rejected = source["rejected"];
+	        this.skipped = source["skipped"];
+	        this.results = this.convertValues(source["results"], MergeResult);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class MergeResult {
+	    kind: string;
+	    id: string;
+	    status: string;
+	    error?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new MergeResult(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.kind = source["kind"];
+	        this.id = source["id"];
+	        this.status = source["status"];
+	        this.error = source["error"];
+	    }
+	}
+
+}
+
 export namespace models {
 	
 	export class Account {
@@ -14,13 +303,39 @@ export namespace models {
 	        this.publicKey = source["publicKey"];
 	    }
 	}
+	export class ChainFault {
+	    index: number;
+	    blockType: string;
+	    hash: string;
+	    expectedHash?: string;
+	    prevHash: string;
+	    expectedPrevHash?: string;
+	    reason: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ChainFault(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.index = source["index"];
+	        this.blockType = source["blockType"];
+	        this.hash = source["hash"];
+	        this.expectedHash = source["expectedHash"];
+	        this.prevHash = source["prevHash"];
+	        this.expectedPrevHash = source["expectedPrevHash"];
+	        this.reason = source["reason"];
+	    }
+	}
 	export class Block {
 	    Index: number;
 	    Timestamp: number;
 	    PrevHash: string;
 	    Hash: string;
 	    BlockType: string;
+	    MerkleRoot: string;
 	    Data: any;
+	    Entries?: Block[];
 	
 	    static createFrom(source: any = {}) {
 	        return new Block(source);
@@ -33,14 +348,122 @@ export namespace models {
 	        this.PrevHash = source["PrevHash"];
 	        this.Hash = source["Hash"];
 	        this.BlockType = source["BlockType"];
+	        this.MerkleRoot = source["MerkleRoot"];
 	        this.Data = source["Data"];
+	        this.Entries = this.convertValues(source["Entries"], Block);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class BlockHeader {
+	    index: number;
+	    timestamp: number;
+	    prevHash: string;
+	    blockType: string;
+	    merkleRoot: string;
+	    hash: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new BlockHeader(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.index = source["index"];
+	        this.timestamp = source["timestamp"];
+	        this.prevHash = source["prevHash"];
+	        this.blockType = source["blockType"];
+	        this.merkleRoot = source["merkleRoot"];
+	        this.hash = source["hash"];
 	    }
 	}
+	export class CheckpointData {
+	    clusterID: string;
+	    height: number;
+	    chainRoot: string;
+	    signer: string;
+	    publicKey: number[];
+	    signature: number[];
+	
+	    static createFrom(source: any = {}) {
+	        return new CheckpointData(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.clusterID = source["clusterID"];
+	        this.height = source["height"];
+	        this.chainRoot = source["chainRoot"];
+	        this.signer = source["signer"];
+	        this.publicKey = source["publicKey"];
+	        this.signature = source["signature"];
+	    }
+	}
+	export class InclusionProof {
+	    message: Message;
+	    header: BlockHeader;
+	    leafIndex: number;
+	    payloadPath: ProofStep[];
+	    checkpoint?: CheckpointData;
+	    chainPath?: ProofStep[];
+	
+	    static createFrom(source: any = {}) {
+	        return new InclusionProof(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.message = this.convertValues(source["message"], Message);
+	        this.header = this.convertValues(source["header"], BlockHeader);
+	        this.leafIndex = source["leafIndex"];
+	        this.payloadPath = this.convertValues(source["payloadPath"], ProofStep);
+	        this.checkpoint = this.convertValues(source["checkpoint"], CheckpointData);
+	        this.chainPath = this.convertValues(source["chainPath"], ProofStep);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
 	export class Message {
+	    id: string;
 	    sender: string;
 	    receiver: string;
 	    message: string;
 	    timestamp: string;
+	    replyTo?: string;
+	    edited?: boolean;
+	    payloadHash?: string;
 	
 	    static createFrom(source: any = {}) {
 	        return new Message(source);
@@ -48,10 +471,48 @@ export namespace models {
 	
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
 	        this.sender = source["sender"];
 	        this.receiver = source["receiver"];
 	        this.message = source["message"];
 	        this.timestamp = source["timestamp"];
+	        this.replyTo = source["replyTo"];
+	        this.edited = source["edited"];
+	        this.payloadHash = source["payloadHash"];
+	    }
+	}
+	export class ProofStep {
+	    hash: string;
+	    left: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new ProofStep(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.hash = source["hash"];
+	        this.left = source["left"];
+	    }
+	}
+	export class Retention {
+	    peerIDs: string[];
+	    expireAfterHours: number;
+	    keepLast: number;
+	    setter: string;
+	    timestamp: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Retention(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.peerIDs = source["peerIDs"];
+	        this.expireAfterHours = source["expireAfterHours"];
+	        this.keepLast = source["keepLast"];
+	        this.setter = source["setter"];
+	        this.timestamp = source["timestamp"];
 	    }
 	}
 
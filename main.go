@@ -4,6 +4,7 @@ import (
 	debug "MessageMesh/debug"
 	"context"
 	"embed"
+	"os"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -15,12 +16,18 @@ var assets embed.FS
 
 func main() {
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	if debug.IsHeadless {
 		debug.Log("main", "Running in headless mode")
 		app := NewApp()
 		ctx := context.Background()
-		app.startup(ctx)
-		// Keep the app running
+		if err := app.start(ctx); err != nil {
+			os.Exit(1)
+		}
+		// Keep the app running, it is operated through the HTTP API if API_ADDR is set
 		select {}
 	}
 